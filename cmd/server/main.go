@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"flag"
 	"log"
 	"os"
@@ -11,45 +10,66 @@ import (
 	"time"
 
 	"imgstore/internal/api"
-	_ "github.com/mattn/go-sqlite3"
+	"imgstore/internal/config"
+	"imgstore/internal/metadata"
+	"imgstore/internal/service"
+	"imgstore/internal/storage"
 )
 
 func main() {
 	var (
-		dbPath   = flag.String("db", "./store.db", "SQLite database path")
+		dbPath    = flag.String("db", "", "SQLite database path or postgres:// URL (default: config database or ./store.db)")
 		storePath = flag.String("store", "./store", "Storage root path")
-		addr     = flag.String("addr", ":8080", "HTTP server address")
+		addr      = flag.String("addr", ":8080", "HTTP server address")
+		cfgPath   = flag.String("config", "./imgstore.json", "Config file path")
 	)
 	flag.Parse()
 
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := storage.ReexecRootless(cfg.Snapshotter); err != nil {
+		log.Printf("Rootless overlay: %v", err)
+	}
+
 	// Initialize database
-	db, err := sql.Open("sqlite3", *dbPath+"?_journal_mode=WAL")
+	if *dbPath != "" {
+		cfg.Database = *dbPath
+	}
+	meta, err := metadata.Open(cfg.DatabaseDSN())
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer meta.Close()
 
-	if err := initSchema(db); err != nil {
+	if err := initSchema(meta); err != nil {
 		log.Fatal(err)
 	}
 
 	// Initialize service
-	svc := NewService(db, *storePath)
+	svc, err := service.NewService(meta, *storePath, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if err := svc.Init(); err != nil {
 		log.Fatal(err)
 	}
+	if err := svc.Reconcile(); err != nil {
+		log.Printf("Mount reconciliation failed: %v", err)
+	}
 
 	// Start background worker
 	ctx, cancel := context.WithCancel(context.Background())
-	go svc.RunWorker(ctx)
+	go svc.RunMaintenance(ctx)
 
 	// Start API server
-	server := api.NewServer(db, svc, *addr)
-	
+	server := api.NewServer(meta, svc, *addr)
+
 	// Handle graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	
+
 	go func() {
 		if err := server.Start(); err != nil {
 			log.Printf("Server error: %v", err)
@@ -58,13 +78,20 @@ func main() {
 
 	<-sigCh
 	log.Println("Shutting down...")
-	
+
 	cancel() // Stop worker
-	
+
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
-	
+
 	if err := server.Stop(shutdownCtx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	}
-}
\ No newline at end of file
+	if err := svc.Shutdown(); err != nil {
+		log.Printf("Unmount error: %v", err)
+	}
+}
+
+func initSchema(meta metadata.Store) error {
+	return meta.Migrate("migrations")
+}
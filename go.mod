@@ -2,4 +2,9 @@ module imgstore
 
 go 1.21
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/klauspost/compress v1.17.9
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
+	golang.org/x/sys v0.20.0
+)
@@ -0,0 +1,190 @@
+package api_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"imgstore/internal/api"
+	"imgstore/internal/export"
+)
+
+// exportService exports one tree from a real export cache; the export
+// endpoint needs nothing else from the service.
+type exportService struct {
+	api.ServiceInterface
+	exports *export.Cache
+	dir     string
+}
+
+func (s exportService) Export(w io.Writer, image, snapshot, compression string) error {
+	return export.Write(w, s.dir, compression)
+}
+
+func (s exportService) ExportFile(image, snapshot, compression string, resume bool) (*export.File, error) {
+	return s.exports.Get(image, s.dir, compression, time.Time{})
+}
+
+// exportStore starts an API server that exports dir as any image.
+func exportStore(t *testing.T, dir string) *httptest.Server {
+	t.Helper()
+
+	svc := exportService{exports: export.NewCache(t.TempDir()), dir: dir}
+	srv := httptest.NewServer(api.NewServer(nil, svc, "").Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rootfs builds a small tree with entries written out of lexical order.
+func rootfs(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range []string{"usr/bin/tool", "etc/hostname", "bin/sh", "etc/motd"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, bytes.Repeat([]byte(name), 200), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	return do(t, http.MethodGet, url, header)
+}
+
+func do(t *testing.T, method, url string, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestExportIsDeterministic(t *testing.T) {
+	dir := rootfs(t)
+	for name, compression := range map[string]string{"tar": export.None, "gzip": export.Gzip, "zstd": export.Zstd} {
+		t.Run(name, func(t *testing.T) {
+			url := "/api/v1/images/a/export?compression=" + compression
+			resp, first := get(t, exportStore(t, dir).URL+url, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+
+			// Touching the tree changes nothing, nor does a fresh cache.
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(filepath.Join(dir, "etc", "motd"), later, later); err != nil {
+				t.Fatal(err)
+			}
+			_, second := get(t, exportStore(t, dir).URL+url, nil)
+			if !bytes.Equal(first, second) {
+				t.Fatalf("two exports of the same tree differ: %d and %d bytes", len(first), len(second))
+			}
+			if compression == export.Zstd {
+				return
+			}
+
+			var r io.Reader = bytes.NewReader(first)
+			if compression == export.Gzip {
+				gz, err := gzip.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = gz
+			}
+			var names []string
+			tr := tar.NewReader(r)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !hdr.ModTime.Equal(export.Epoch) || hdr.Uname != "" || hdr.Gname != "" {
+					t.Errorf("%s: mtime %v, owner %q:%q", hdr.Name, hdr.ModTime, hdr.Uname, hdr.Gname)
+				}
+				names = append(names, hdr.Name)
+			}
+			if !sort.StringsAreSorted(names) || len(names) != 8 {
+				t.Fatalf("entries %q, want all 8 in order", names)
+			}
+		})
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	url := exportStore(t, rootfs(t)).URL + "/api/v1/images/a/export"
+
+	// A plain GET is streamed; HEAD tells a client what it can resume.
+	resp, whole := get(t, url, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || len(whole) < 1024 {
+		t.Fatalf("status %d, Accept-Ranges %q, %d bytes", resp.StatusCode, resp.Header.Get("Accept-Ranges"), len(whole))
+	}
+	resp, _ = do(t, http.MethodHead, url, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(whole)) {
+		t.Fatalf("HEAD: status %d, Content-Length %d for %d bytes", resp.StatusCode, resp.ContentLength, len(whole))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != fmt.Sprintf(`"%x"`, sha256.Sum256(whole)) {
+		t.Fatalf("ETag %s is not the digest of the streamed export", etag)
+	}
+
+	resp, part := get(t, url, map[string]string{"Range": "bytes=512-1023"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes 512-1023/%d", len(whole)); got != want {
+		t.Fatalf("Content-Range %q, want %q", got, want)
+	}
+	if !bytes.Equal(part, whole[512:1024]) {
+		t.Fatal("the range differs from the same bytes of the whole export")
+	}
+
+	resp, _ = get(t, url, map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(whole))})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status %d for a range past the end, want 416", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Range"), fmt.Sprintf("bytes */%d", len(whole)); got != want {
+		t.Fatalf("Content-Range %q, want %q", got, want)
+	}
+
+	// A stale If-Range gets the whole export instead of the range.
+	resp, body := get(t, url, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, whole) {
+		t.Fatalf("status %d and %d bytes for a stale If-Range", resp.StatusCode, len(body))
+	}
+	resp, _ = get(t, url, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status %d for a current If-Range, want 206", resp.StatusCode)
+	}
+}
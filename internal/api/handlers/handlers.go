@@ -2,42 +2,93 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
+	"imgstore/internal/cache"
+	"imgstore/internal/export"
+	"imgstore/internal/layers"
+	"imgstore/internal/manifest"
+	"imgstore/internal/metadata"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
 	"imgstore/internal/types"
 )
 
 type Handlers struct {
-	db  *sql.DB
-	svc ServiceInterface
+	meta metadata.Store
+	svc  ServiceInterface
 }
 
 type ServiceInterface interface {
-	EnqueueImage(ctx context.Context, name, url, checksum string) error
+	EnqueueImage(ctx context.Context, name, url, checksum, policy string) error
 	GetImageStatus(name string) (string, error)
 	GetAllImages() ([]types.ImageInfo, error)
+	ListFiles(name, prefix string) ([]manifest.Entry, error)
+	CreateSnapshot(image, name string, quota int64) (types.SnapshotInfo, error)
+	GetImageUsage(name string) (types.ImageUsage, error)
+	ListSnapshots(image string) ([]types.SnapshotInfo, error)
+	GetSnapshot(image, name string) (types.SnapshotInfo, error)
+	RemoveSnapshot(image, name string) error
+	CommitSnapshot(image, snapshot, newImage string) (string, error)
+	Export(w io.Writer, image, snapshot, compression string) error
+	ExportFile(image, snapshot, compression string, resume bool) (*export.File, error)
+	ActivateImage(name string) error
+	DeactivateImage(name string, discard bool) error
 	RemoveImage(name string) error
-	Cleanup() error
+	GC(dryRun bool, grace time.Duration) (types.GCReport, error)
+	OpenBlob(checksum string) (*os.File, error)
+	CacheStats() (types.CacheStats, error)
+	DedupStats() (types.DedupStats, error)
+	Pin(kind, target, reason string, ttl time.Duration) (types.Pin, error)
+	Unpin(kind, target string) error
+	ListPins() ([]types.Pin, error)
 }
 
-
-
 type CreateImageRequest struct {
 	Name     string `json:"name"`
 	URL      string `json:"url"`
 	Checksum string `json:"checksum"`
+	Policy   string `json:"policy,omitempty"`
+}
+
+// CreateSnapshotRequest names the snapshot; Quota, in bytes, optionally
+// limits what can be written to it.
+type CreateSnapshotRequest struct {
+	Name  string `json:"name"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+type DeactivateRequest struct {
+	Discard bool `json:"discard"`
+}
+
+// PinRequest optionally gives a reason and a TTL ("72h") after which the
+// pin expires.
+type PinRequest struct {
+	Reason string `json:"reason,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+}
+
+// CommitRequest names the image to create. Snapshot selects a named
+// snapshot; when empty the image's own active snapshot is committed.
+type CommitRequest struct {
+	Name     string `json:"name"`
+	Snapshot string `json:"snapshot,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-func New(db *sql.DB, svc ServiceInterface) *Handlers {
-	return &Handlers{db: db, svc: svc}
+func New(meta metadata.Store, svc ServiceInterface) *Handlers {
+	return &Handlers{meta: meta, svc: svc}
 }
 
 func (h *Handlers) HandleImages(w http.ResponseWriter, r *http.Request) {
@@ -52,12 +103,45 @@ func (h *Handlers) HandleImages(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handlers) HandleImageByName(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/v1/images/")
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/images/")
+	name, sub, _ := strings.Cut(path, "/")
 	if name == "" {
 		http.Error(w, "Image name required", http.StatusBadRequest)
 		return
 	}
 
+	switch sub {
+	case "":
+	case "files":
+		h.handleFiles(w, r, name)
+		return
+	case "snapshots":
+		h.handleSnapshots(w, r, name)
+		return
+	case "commit":
+		h.handleCommit(w, r, name)
+		return
+	case "export":
+		h.handleExport(w, r, name)
+		return
+	case "activate":
+		h.handleActivate(w, r, name)
+		return
+	case "deactivate":
+		h.handleDeactivate(w, r, name)
+		return
+	case "pin":
+		h.handlePin(w, r, cache.PinImage, name)
+		return
+	default:
+		if snapshot, ok := strings.CutPrefix(sub, "snapshots/"); ok && snapshot != "" {
+			h.handleSnapshot(w, r, name, snapshot)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		h.getImage(w, r, name)
@@ -88,9 +172,13 @@ func (h *Handlers) createImage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "name, url, and checksum are required", http.StatusBadRequest)
 		return
 	}
+	if !cache.ValidDigest(req.Checksum) {
+		h.writeError(w, fmt.Errorf("invalid checksum %q", req.Checksum), http.StatusBadRequest)
+		return
+	}
 
-	if err := h.svc.EnqueueImage(r.Context(), req.Name, req.URL, req.Checksum); err != nil {
-		h.writeError(w, err, http.StatusInternalServerError)
+	if err := h.svc.EnqueueImage(r.Context(), req.Name, req.URL, req.Checksum, req.Policy); err != nil {
+		h.writeError(w, err, snapshotStatus(err))
 		return
 	}
 
@@ -104,15 +192,232 @@ func (h *Handlers) getImage(w http.ResponseWriter, r *http.Request, name string)
 		h.writeError(w, err, http.StatusNotFound)
 		return
 	}
-	h.writeJSON(w, map[string]string{"name": name, "state": state})
+	usage, err := h.svc.GetImageUsage(name)
+	if err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+	h.writeJSON(w, map[string]interface{}{"name": name, "state": state, "usage": usage})
+}
+
+func (h *Handlers) handleFiles(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := h.svc.ListFiles(name, r.URL.Query().Get("prefix"))
+	if err != nil {
+		h.writeError(w, err, http.StatusNotFound)
+		return
+	}
+	h.writeJSON(w, files)
+}
+
+func (h *Handlers) handleSnapshots(w http.ResponseWriter, r *http.Request, image string) {
+	switch r.Method {
+	case http.MethodGet:
+		snaps, err := h.svc.ListSnapshots(image)
+		if err != nil {
+			h.writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		h.writeJSON(w, snaps)
+	case http.MethodPost:
+		var req CreateSnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		snap, err := h.svc.CreateSnapshot(image, req.Name, req.Quota)
+		if err != nil {
+			h.writeError(w, err, snapshotStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snap)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) handleSnapshot(w http.ResponseWriter, r *http.Request, image, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		snap, err := h.svc.GetSnapshot(image, name)
+		if err != nil {
+			h.writeError(w, err, snapshotStatus(err))
+			return
+		}
+		h.writeJSON(w, snap)
+	case http.MethodDelete:
+		if err := h.svc.RemoveSnapshot(image, name); err != nil {
+			h.writeError(w, err, snapshotStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) handleCommit(w http.ResponseWriter, r *http.Request, image string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	checksum, err := h.svc.CommitSnapshot(image, req.Snapshot, req.Name)
+	if err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"name": req.Name, "parent": image, "checksum": checksum})
+}
+
+func (h *Handlers) handleActivate(w http.ResponseWriter, r *http.Request, image string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.svc.ActivateImage(image); err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": image, "state": "ACTIVE"})
+}
+
+// handleDeactivate accepts an optional body; {"discard": true} also deletes
+// the upper dir, so the image comes back as it was extracted.
+func (h *Handlers) handleDeactivate(w http.ResponseWriter, r *http.Request, image string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req DeactivateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := h.svc.DeactivateImage(image, req.Discard); err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": image, "state": "STORED"})
+}
+
+// handleExport serves ?compression=gzip|zstd exports of an image, or of
+// ?snapshot=<id>. A plain GET is streamed as the tar is written; HEAD,
+// Range and If-Range requests are served from the export cache, whose ETag
+// lets an interrupted download resume.
+func (h *Handlers) handleExport(w http.ResponseWriter, r *http.Request, image string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Building a large export can take longer than the server's write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	query := r.URL.Query()
+	snapshot, compression := query.Get("snapshot"), query.Get("compression")
+	ext, err := export.Extension(compression)
+	if err != nil {
+		h.writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	filename := image
+	if snapshot != "" {
+		filename = snapshots.Key(image, snapshot)
+	}
+	contentType := map[string]string{
+		export.None: "application/x-tar",
+		export.Gzip: "application/gzip",
+		export.Zstd: "application/zstd",
+	}[compression]
+	setHeaders := func() {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+ext))
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	ranged := r.Header.Get("Range") != "" || r.Header.Get("If-Range") != ""
+	if r.Method == http.MethodGet && !ranged {
+		out := &startedWriter{w: w, start: setHeaders}
+		if err := h.svc.Export(out, image, snapshot, compression); err != nil {
+			if !out.started {
+				h.writeError(w, err, snapshotStatus(err))
+				return
+			}
+			// The status is sent; only a broken connection tells the
+			// client the export is incomplete.
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	file, err := h.svc.ExportFile(image, snapshot, compression, r.Header.Get("Range") != "")
+	if err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+	defer file.Close()
+
+	setHeaders()
+	w.Header().Set("ETag", file.ETag)
+	http.ServeContent(w, r, "", file.ModTime, file)
+}
+
+// startedWriter calls start before the first write to w.
+type startedWriter struct {
+	w       io.Writer
+	start   func()
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.start()
+	}
+	return s.w.Write(p)
+}
+
+func snapshotStatus(err error) int {
+	switch {
+	case errors.Is(err, snapshots.ErrNotFound), errors.Is(err, layers.ErrNotFound), errors.Is(err, cache.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, snapshots.ErrExists), errors.Is(err, snapshots.ErrNotReady):
+		return http.StatusConflict
+	case errors.Is(err, snapshots.ErrInvalidName), errors.Is(err, snapshots.ErrInvalidQuota):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrNotSupported):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
 }
 
 func (h *Handlers) deleteImage(w http.ResponseWriter, r *http.Request, name string) {
 	if err := h.svc.RemoveImage(name); err != nil {
-		h.writeError(w, err, http.StatusInternalServerError)
+		h.writeError(w, err, snapshotStatus(err))
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleting", "name": name})
 }
 
 func (h *Handlers) HandleStatus(w http.ResponseWriter, r *http.Request) {
@@ -122,8 +427,7 @@ func (h *Handlers) HandleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Simple health check
-	var count int
-	err := h.db.QueryRow("SELECT COUNT(*) FROM images").Scan(&count)
+	count, err := h.meta.CountImages()
 	if err != nil {
 		h.writeError(w, err, http.StatusInternalServerError)
 		return
@@ -143,12 +447,133 @@ func (h *Handlers) HandleCleanup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.svc.Cleanup(); err != nil {
+	query := r.URL.Query()
+	dryRun := query.Get("dry_run") == "true"
+	var grace time.Duration
+	if value := query.Get("grace"); value != "" {
+		var err error
+		if grace, err = time.ParseDuration(value); err != nil {
+			h.writeError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := h.svc.GC(dryRun, grace)
+	if err != nil {
+		h.writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, report)
+}
+
+func (h *Handlers) HandleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := h.svc.CacheStats()
+	if err != nil {
+		h.writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, stats)
+}
+
+func (h *Handlers) HandleDedup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := h.svc.DedupStats()
+	if err != nil {
+		h.writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, stats)
+}
+
+// handlePin pins (POST) or unpins (DELETE) an image or a blob.
+func (h *Handlers) handlePin(w http.ResponseWriter, r *http.Request, kind, target string) {
+	switch r.Method {
+	case http.MethodPost:
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			h.writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				h.writeError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		pin, err := h.svc.Pin(kind, target, req.Reason, ttl)
+		if err != nil {
+			h.writeError(w, err, snapshotStatus(err))
+			return
+		}
+		h.writeJSON(w, pin)
+	case http.MethodDelete:
+		if err := h.svc.Unpin(kind, target); err != nil {
+			h.writeError(w, err, snapshotStatus(err))
+			return
+		}
+		h.writeJSON(w, map[string]string{"kind": kind, "target": target, "status": "unpinned"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) HandlePins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pins, err := h.svc.ListPins()
+	if err != nil {
 		h.writeError(w, err, http.StatusInternalServerError)
 		return
 	}
+	h.writeJSON(w, pins)
+}
+
+// HandleBlob serves a cached blob read-only, so that other stores can use
+// this one as a peer. Clients verify the checksum themselves.
+func (h *Handlers) HandleBlob(w http.ResponseWriter, r *http.Request) {
+	digest := strings.TrimPrefix(r.URL.Path, "/api/v1/blobs/")
+	if digest, ok := strings.CutSuffix(digest, "/pin"); ok {
+		h.handlePin(w, r, cache.PinBlob, digest)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !cache.ValidDigest(digest) {
+		h.writeError(w, fmt.Errorf("invalid digest %q", digest), http.StatusBadRequest)
+		return
+	}
+
+	// Large blobs can take longer than the server's write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
 
-	h.writeJSON(w, map[string]string{"status": "cleanup completed"})
+	file, err := h.svc.OpenBlob(digest)
+	if err != nil {
+		h.writeError(w, err, snapshotStatus(err))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		h.writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("ETag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), file)
 }
 
 func (h *Handlers) HandleRoot(w http.ResponseWriter, r *http.Request) {
@@ -156,7 +581,7 @@ func (h *Handlers) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	
+
 	html := `<!DOCTYPE html>
 <html>
 <head><title>Image Store</title></head>
@@ -168,12 +593,26 @@ func (h *Handlers) HandleRoot(w http.ResponseWriter, r *http.Request) {
 <li>POST /api/v1/images - Create new image</li>
 <li>GET /api/v1/images/{name} - Get image status</li>
 <li>DELETE /api/v1/images/{name} - Remove image</li>
+<li>POST /api/v1/images/{name}/activate - Mount a stored image</li>
+<li>POST /api/v1/images/{name}/deactivate - Unmount an image, {"discard":true} drops its changes</li>
+<li>POST /api/v1/images/{name}/pin - Pin an image's blob, {"reason":"...","ttl":"72h"}; DELETE unpins</li>
+<li>GET /api/v1/images/{name}/files?prefix= - List extracted files</li>
+<li>GET /api/v1/images/{name}/snapshots - List snapshots</li>
+<li>POST /api/v1/images/{name}/snapshots - Create a named snapshot</li>
+<li>GET /api/v1/images/{name}/snapshots/{id} - Get a snapshot</li>
+<li>DELETE /api/v1/images/{name}/snapshots/{id} - Remove a snapshot</li>
+<li>POST /api/v1/images/{name}/commit - Commit a snapshot into a new image</li>
+<li>GET /api/v1/images/{name}/export?snapshot=&amp;compression= - Export as a tar stream</li>
 <li>GET /api/v1/status - System status</li>
-<li>POST /api/v1/cleanup - Cleanup unused blobs</li>
+<li>POST /api/v1/cleanup?dry_run=true&amp;grace=1h - Garbage-collect unreferenced blobs</li>
+<li>GET /api/v1/cache - Blob cache statistics and contents</li>
+<li>GET /api/v1/blobs/{digest} - Download a cached blob (for peer stores)</li>
+<li>POST /api/v1/blobs/{digest}/pin - Pin a blob; DELETE unpins</li>
+<li>GET /api/v1/pins - List pins</li>
 </ul>
 </body>
 </html>`
-	
+
 	w.Header().Set("Content-Type", "text/html")
 	fmt.Fprint(w, html)
 }
@@ -187,4 +626,4 @@ func (h *Handlers) writeError(w http.ResponseWriter, err error, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
-}
\ No newline at end of file
+}
@@ -0,0 +1,94 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"imgstore/internal/api"
+	"imgstore/internal/manifest"
+)
+
+// imageService records the images enqueued through the API.
+type imageService struct {
+	api.ServiceInterface
+	enqueued *[]string
+}
+
+func (s imageService) EnqueueImage(ctx context.Context, name, url, checksum, policy string) error {
+	*s.enqueued = append(*s.enqueued, name)
+	return nil
+}
+
+func (s imageService) ListFiles(name, prefix string) ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+	for _, p := range []string{"etc", "etc/hostname", "usr", "usr/bin", "usr/bin/env"} {
+		entries = append(entries, manifest.Entry{Path: p})
+	}
+	return manifest.Filter(entries, prefix), nil
+}
+
+func TestListFilesPrefix(t *testing.T) {
+	srv := httptest.NewServer(api.NewServer(nil, imageService{}, "").Handler())
+	t.Cleanup(srv.Close)
+
+	for query, want := range map[string]string{
+		"":                `["etc","etc/hostname","usr","usr/bin","usr/bin/env"]`,
+		"?prefix=usr/bin": `["usr/bin","usr/bin/env"]`,
+		"?prefix=etc/":    `["etc","etc/hostname"]`,
+		"?prefix=..":      `["etc","etc/hostname","usr","usr/bin","usr/bin/env"]`,
+		"?prefix=var":     `[]`,
+	} {
+		resp, err := http.Get(srv.URL + "/api/v1/images/a/files" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: status %d, %v", query, resp.StatusCode, err)
+		}
+		var files []manifest.Entry
+		if err := json.Unmarshal(body, &files); err != nil || files == nil {
+			t.Fatalf("files%s = %s, %v", query, body, err)
+		}
+		paths := []string{}
+		for _, f := range files {
+			paths = append(paths, f.Path)
+		}
+		if got, _ := json.Marshal(paths); string(got) != want {
+			t.Errorf("files%s = %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestCreateImageValidatesChecksum(t *testing.T) {
+	var enqueued []string
+	srv := httptest.NewServer(api.NewServer(nil, imageService{enqueued: &enqueued}, "").Handler())
+	t.Cleanup(srv.Close)
+
+	post := func(checksum string) int {
+		body := `{"name": "a", "url": "http://example.com/a.tar", "checksum": "` + checksum + `"}`
+		resp, err := http.Post(srv.URL+"/api/v1/images", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, checksum := range []string{"abc", strings.Repeat("A", 64), "../" + strings.Repeat("a", 61)} {
+		if status := post(checksum); status != http.StatusBadRequest {
+			t.Errorf("checksum %q: status %d, want 400", checksum, status)
+		}
+	}
+	if len(enqueued) != 0 {
+		t.Fatalf("enqueued %q", enqueued)
+	}
+	if status := post(strings.Repeat("a", 64)); status != http.StatusCreated || len(enqueued) != 1 {
+		t.Fatalf("valid checksum: status %d, enqueued %q", status, enqueued)
+	}
+}
@@ -0,0 +1,160 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"imgstore/internal/api"
+	"imgstore/internal/cache"
+	"imgstore/internal/downloader"
+)
+
+// blobService serves blobs from a real cache; the peer endpoint needs
+// nothing else from the service.
+type blobService struct {
+	api.ServiceInterface
+	cache *cache.BlobCache
+}
+
+func (s blobService) OpenBlob(checksum string) (*os.File, error) {
+	return s.cache.Open(checksum)
+}
+
+// peerStore starts an API server whose cache holds blobs, keyed by the
+// checksum they are stored under.
+func peerStore(t *testing.T, blobs map[string][]byte) *httptest.Server {
+	t.Helper()
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for checksum, data := range blobs {
+		if err := os.WriteFile(filepath.Join(root, "blobs", checksum+".tar"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := api.NewServer(nil, blobService{cache: cache.NewBlobCache(nil, root)}, "")
+	peer := httptest.NewServer(server.Handler())
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+// origin starts a plain file server for data and counts its requests.
+func origin(t *testing.T, data []byte) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestDownloadFromPeer(t *testing.T) {
+	data := bytes.Repeat([]byte("layer"), 10000)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	tests := []struct {
+		name       string
+		peerBlobs  map[string][]byte
+		originHits int32
+	}{
+		{"served by peer", map[string][]byte{checksum: data}, 0},
+		{"missing on peer", map[string][]byte{}, 1},
+		{"corrupt on peer", map[string][]byte{checksum: []byte("not the layer")}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := peerStore(t, tt.peerBlobs)
+			src, hits := origin(t, data)
+
+			dest := filepath.Join(t.TempDir(), checksum+".tar")
+			d := downloader.NewWithPeers([]string{peer.URL})
+			if err := d.Download(context.Background(), src.URL, dest, checksum, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("downloaded %d bytes that differ from the blob", len(got))
+			}
+			if n := atomic.LoadInt32(hits); n != tt.originHits {
+				t.Fatalf("origin hit %d times, want %d", n, tt.originHits)
+			}
+		})
+	}
+}
+
+func TestDownloadStreamFromPeer(t *testing.T) {
+	data := bytes.Repeat([]byte("stream"), 10000)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	peer := peerStore(t, map[string][]byte{checksum: data})
+	src, hits := origin(t, data)
+
+	var consumed bytes.Buffer
+	consume := func(r io.Reader) error {
+		consumed.Reset()
+		_, err := io.Copy(&consumed, r)
+		return err
+	}
+	dest := filepath.Join(t.TempDir(), checksum+".tar")
+	d := downloader.NewWithPeers([]string{peer.URL})
+	if err := d.DownloadStream(context.Background(), src.URL, dest, checksum, nil, consume); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(consumed.Bytes(), data) {
+		t.Fatalf("consumed %d bytes that differ from the blob", consumed.Len())
+	}
+	if n := atomic.LoadInt32(hits); n != 0 {
+		t.Fatalf("origin hit %d times, want 0", n)
+	}
+}
+
+func TestServeBlob(t *testing.T) {
+	data := []byte("blob")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	peer := peerStore(t, map[string][]byte{checksum: data})
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, checksum, http.StatusOK},
+		{http.MethodHead, checksum, http.StatusOK},
+		{http.MethodGet, fmt.Sprintf("%x", sha256.Sum256([]byte("other"))), http.StatusNotFound},
+		{http.MethodGet, checksum[:63] + "g", http.StatusBadRequest},
+		{http.MethodGet, "ABC", http.StatusBadRequest},
+		{http.MethodPut, checksum, http.StatusMethodNotAllowed},
+		{http.MethodDelete, checksum, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, peer.URL+"/api/v1/blobs/"+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
@@ -2,49 +2,74 @@ package api
 
 import (
 	"context"
-	"database/sql"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"imgstore/internal/api/handlers"
 	"imgstore/internal/api/middleware"
+	"imgstore/internal/export"
+	"imgstore/internal/manifest"
+	"imgstore/internal/metadata"
 	"imgstore/internal/types"
 )
 
 type Server struct {
-	db     *sql.DB
+	meta   metadata.Store
 	svc    ServiceInterface
 	server *http.Server
 }
 
 type ServiceInterface interface {
-	EnqueueImage(ctx context.Context, name, url, checksum string) error
+	EnqueueImage(ctx context.Context, name, url, checksum, policy string) error
 	GetImageStatus(name string) (string, error)
 	GetAllImages() ([]types.ImageInfo, error)
+	ListFiles(name, prefix string) ([]manifest.Entry, error)
+	CreateSnapshot(image, name string, quota int64) (types.SnapshotInfo, error)
+	GetImageUsage(name string) (types.ImageUsage, error)
+	ListSnapshots(image string) ([]types.SnapshotInfo, error)
+	GetSnapshot(image, name string) (types.SnapshotInfo, error)
+	RemoveSnapshot(image, name string) error
+	CommitSnapshot(image, snapshot, newImage string) (string, error)
+	Export(w io.Writer, image, snapshot, compression string) error
+	ExportFile(image, snapshot, compression string, resume bool) (*export.File, error)
+	ActivateImage(name string) error
+	DeactivateImage(name string, discard bool) error
 	RemoveImage(name string) error
-	Cleanup() error
+	GC(dryRun bool, grace time.Duration) (types.GCReport, error)
+	OpenBlob(checksum string) (*os.File, error)
+	CacheStats() (types.CacheStats, error)
+	DedupStats() (types.DedupStats, error)
+	Pin(kind, target, reason string, ttl time.Duration) (types.Pin, error)
+	Unpin(kind, target string) error
+	ListPins() ([]types.Pin, error)
 }
 
 
 
-func NewServer(db *sql.DB, svc ServiceInterface, addr string) *Server {
+func NewServer(meta metadata.Store, svc ServiceInterface, addr string) *Server {
 	mux := http.NewServeMux()
 	
-	h := handlers.New(db, svc)
+	h := handlers.New(meta, svc)
 	
 	// API routes
 	mux.HandleFunc("/api/v1/images", middleware.CORS(h.HandleImages))
 	mux.HandleFunc("/api/v1/images/", middleware.CORS(h.HandleImageByName))
 	mux.HandleFunc("/api/v1/status", middleware.CORS(h.HandleStatus))
 	mux.HandleFunc("/api/v1/cleanup", middleware.CORS(h.HandleCleanup))
+	mux.HandleFunc("/api/v1/cache", middleware.CORS(h.HandleCache))
+	mux.HandleFunc("/api/v1/dedup", middleware.CORS(h.HandleDedup))
+	mux.HandleFunc("/api/v1/pins", middleware.CORS(h.HandlePins))
+	mux.HandleFunc("/api/v1/blobs/", middleware.CORS(h.HandleBlob))
 	
 	// Static files (future web UI)
 	mux.HandleFunc("/", h.HandleRoot)
 	
 	return &Server{
-		db:  db,
-		svc: svc,
+		meta: meta,
+		svc:  svc,
 		server: &http.Server{
 			Addr:         addr,
 			Handler:      mux,
@@ -54,6 +79,11 @@ func NewServer(db *sql.DB, svc ServiceInterface, addr string) *Server {
 	}
 }
 
+// Handler returns the server's routes, for serving them elsewhere.
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
 func (s *Server) Start() error {
 	log.Printf("Starting API server on %s", s.server.Addr)
 	return s.server.ListenAndServe()
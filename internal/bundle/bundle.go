@@ -0,0 +1,177 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A bundle is a tar of index.json, its signature in index.json.sig and one
+// blobs/<digest>.tar per blob the index lists, in that order, so that the
+// signature is checked before any blob is read.
+const (
+	indexName     = "index.json"
+	signatureName = "index.json.sig"
+	blobDir       = "blobs/"
+	version       = 1
+)
+
+var ErrUntrusted = errors.New("bundle is not signed by a trusted key")
+
+// Image is what a bundle records about an image. Parents are listed before
+// the images derived from them.
+type Image struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	Policy   string `json:"policy,omitempty"`
+	Parent   string `json:"parent,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+type Blob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+type Index struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Images  []Image   `json:"images"`
+	Blobs   []Blob    `json:"blobs"`
+}
+
+// Write signs the index with key and writes the bundle, reading each blob
+// through open.
+func Write(w io.Writer, index Index, key ed25519.PrivateKey, open func(digest string) (*os.File, error)) error {
+	index.Version = version
+	encoded, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(key, encoded)
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{indexName, encoded}, {signatureName, signature}} {
+		hdr := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+
+	for _, blob := range index.Blobs {
+		if err := writeBlob(tw, blob, open, now); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeBlob(tw *tar.Writer, blob Blob, open func(digest string) (*os.File, error), now time.Time) error {
+	file, err := open(blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hdr := &tar.Header{Name: blobDir + blob.Digest + ".tar", Mode: 0644, Size: blob.Size, ModTime: now}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, file, blob.Size); err != nil {
+		return fmt.Errorf("blob %s: %v", blob.Digest, err)
+	}
+	return nil
+}
+
+// Read checks the index signature against the trusted keys, hands the index
+// to accept and then each blob to put, which must verify the digest. It
+// fails unless every blob in the index was present.
+func Read(r io.Reader, trusted []ed25519.PublicKey, accept func(Index) error, put func(digest string, r io.Reader) error) (Index, error) {
+	var index Index
+	tr := tar.NewReader(r)
+
+	encoded, err := readSmall(tr, indexName)
+	if err != nil {
+		return index, err
+	}
+	signature, err := readSmall(tr, signatureName)
+	if err != nil {
+		return index, err
+	}
+	if !verify(trusted, encoded, signature) {
+		return index, ErrUntrusted
+	}
+	if err := json.Unmarshal(encoded, &index); err != nil {
+		return index, fmt.Errorf("%s: %v", indexName, err)
+	}
+	if index.Version != version {
+		return index, fmt.Errorf("unsupported bundle version %d", index.Version)
+	}
+	if err := accept(index); err != nil {
+		return index, err
+	}
+
+	pending := make(map[string]bool)
+	for _, blob := range index.Blobs {
+		pending[blob.Digest] = true
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return index, err
+		}
+		name := path.Clean(hdr.Name)
+		digest, ok := strings.CutSuffix(strings.TrimPrefix(name, blobDir), ".tar")
+		if !strings.HasPrefix(name, blobDir) || !ok || !pending[digest] {
+			return index, fmt.Errorf("unexpected bundle entry %s", hdr.Name)
+		}
+		if err := put(digest, tr); err != nil {
+			return index, fmt.Errorf("blob %s: %v", digest, err)
+		}
+		delete(pending, digest)
+	}
+	for digest := range pending {
+		return index, fmt.Errorf("blob %s is missing from the bundle", digest)
+	}
+	return index, nil
+}
+
+func readSmall(tr *tar.Reader, name string) ([]byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+	if hdr.Name != name {
+		return nil, fmt.Errorf("expected %s, found %s", name, hdr.Name)
+	}
+	if hdr.Size > 64<<20 {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	return io.ReadAll(tr)
+}
+
+func verify(trusted []ed25519.PublicKey, message, signature []byte) bool {
+	for _, key := range trusted {
+		if ed25519.Verify(key, message, signature) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,18 +1,37 @@
 package cache
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"imgstore/internal/metadata"
+	"imgstore/internal/types"
 )
 
+var ErrNotFound = metadata.ErrNotFound
+
 type BlobCache struct {
-	db   *sql.DB
-	root string
+	meta   metadata.Store
+	root   string
+	pinned map[string]bool
+}
+
+func NewBlobCache(meta metadata.Store, root string) *BlobCache {
+	return &BlobCache{meta: meta, root: root, pinned: make(map[string]bool)}
 }
 
-func NewBlobCache(db *sql.DB, root string) *BlobCache {
-	return &BlobCache{db: db, root: root}
+// Pin keeps blobs from ever being evicted or collected, as the
+// pinned_blobs setting does; AddPin records pins in the database instead.
+func (c *BlobCache) Pin(checksums ...string) {
+	for _, checksum := range checksums {
+		c.pinned[checksum] = true
+	}
 }
 
 func (c *BlobCache) Exists(checksum string) bool {
@@ -25,48 +44,344 @@ func (c *BlobCache) GetPath(checksum string) string {
 	return c.getBlobPath(checksum)
 }
 
+// Open opens a cached blob for reading.
+func (c *BlobCache) Open(checksum string) (*os.File, error) {
+	if !ValidDigest(checksum) {
+		return nil, fmt.Errorf("blob %q: %w", checksum, ErrNotFound)
+	}
+	file, err := os.Open(c.getBlobPath(checksum))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("blob %s: %w", checksum, ErrNotFound)
+	}
+	return file, err
+}
+
+// ValidDigest reports whether s is a lowercase hex SHA-256 digest.
+func ValidDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *BlobCache) getBlobPath(checksum string) string {
 	return filepath.Join(c.root, "blobs", checksum+".tar")
 }
 
-func (c *BlobCache) MarkUsed(checksum string, imageID int) error {
-	_, err := c.db.Exec("INSERT OR IGNORE INTO blobs(image_id, path, checksum) VALUES (?,?,?)",
-		imageID, c.getBlobPath(checksum), checksum)
+// Store saves the blob produced by write under its SHA-256 digest and
+// returns the digest. A blob with the same digest is simply replaced.
+func (c *BlobCache) Store(write func(w io.Writer) error) (string, error) {
+	return c.store(write, "")
+}
+
+// Put stores the blob read from r, failing unless it has the given checksum.
+func (c *BlobCache) Put(checksum string, r io.Reader) error {
+	_, err := c.store(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}, checksum)
 	return err
 }
 
-func (c *BlobCache) GetUnusedBlobs() ([]string, error) {
-	rows, err := c.db.Query(`
-		SELECT DISTINCT b.checksum 
-		FROM blobs b 
-		LEFT JOIN images i ON b.image_id = i.id 
-		WHERE i.id IS NULL OR i.state = 'FAILED'`)
+func (c *BlobCache) store(write func(w io.Writer) error, expected string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.root, "blobs"), ".store-*")
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	hash := sha256.New()
+	if err := write(io.MultiWriter(tmp, hash)); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	checksum := fmt.Sprintf("%x", hash.Sum(nil))
+	if expected != "" && checksum != expected {
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", expected, checksum)
+	}
+	if err := os.Rename(tmp.Name(), c.getBlobPath(checksum)); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+func (c *BlobCache) MarkUsed(checksum string, imageID int) error {
+	var size int64
+	if fi, err := os.Stat(c.getBlobPath(checksum)); err == nil {
+		size = fi.Size()
+	}
+	return c.meta.MarkBlobUsed(imageID, c.getBlobPath(checksum), checksum, size, time.Now())
+}
+
+// Touch records a cache hit on a blob.
+func (c *BlobCache) Touch(checksum string) error {
+	return c.meta.TouchBlob(checksum, time.Now())
+}
+
+// Evict removes blobs, least recently used first, until blobs/ fits within
+// budget bytes. Only blobs whose images have all been extracted, and that
+// can be downloaded again, are candidates; pinned blobs are never evicted.
+// It returns the evicted checksums and the bytes freed.
+func (c *BlobCache) Evict(budget int64) ([]string, int64, error) {
+	type candidate struct {
+		checksum string
+		size     int64
+		lastUsed int64
 	}
-	defer rows.Close()
 
-	var checksums []string
-	for rows.Next() {
-		var checksum string
-		if err := rows.Scan(&checksum); err != nil {
+	entries, err := os.ReadDir(filepath.Join(c.root, "blobs"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int64
+	var candidates []candidate
+	for _, entry := range entries {
+		checksum, ok := strings.CutSuffix(entry.Name(), ".tar")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
 			continue
 		}
-		checksums = append(checksums, checksum)
+		total += info.Size()
+		candidates = append(candidates, candidate{checksum, info.Size(), info.ModTime().Unix()})
 	}
-	return checksums, nil
+	if budget <= 0 || total <= budget {
+		return nil, 0, nil
+	}
+	pinned, err := c.pinnedDigests()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range candidates {
+		lastUsed, err := c.meta.BlobLastUsed(candidates[i].checksum)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !lastUsed.IsZero() {
+			candidates[i].lastUsed = lastUsed.Unix()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed < candidates[j].lastUsed })
+
+	var evicted []string
+	var freed int64
+	for _, cand := range candidates {
+		if total <= budget {
+			break
+		}
+		if pinned[cand.checksum] {
+			continue
+		}
+		ok, err := c.evictable(cand.checksum)
+		if err != nil {
+			return evicted, freed, err
+		}
+		if !ok {
+			continue
+		}
+		if err := os.Remove(c.getBlobPath(cand.checksum)); err != nil && !os.IsNotExist(err) {
+			return evicted, freed, err
+		}
+		if err := c.count(statEvictions, 1); err != nil {
+			return evicted, freed, err
+		}
+		if err := c.count(statEvictedBytes, cand.size); err != nil {
+			return evicted, freed, err
+		}
+		total -= cand.size
+		freed += cand.size
+		evicted = append(evicted, cand.checksum)
+	}
+	return evicted, freed, nil
 }
 
-func (c *BlobCache) Cleanup() error {
-	unused, err := c.GetUnusedBlobs()
+// evictable reports whether every image with the checksum has been
+// extracted, and at least one has. Blobs that no image can download again,
+// such as committed layers, are never evictable.
+func (c *BlobCache) evictable(checksum string) (bool, error) {
+	images, err := c.meta.ImagesWithChecksum(checksum)
 	if err != nil {
+		return false, err
+	}
+	var extracted, pending, origins int
+	for _, img := range images {
+		switch img.State {
+		case "UNPACKED", "STORED", "ACTIVATING", "ACTIVE":
+			extracted++
+		case "NEW", "DOWNLOADING", "DOWNLOADED", "UNPACKING":
+			pending++
+		}
+		if img.BlobKey != "" {
+			origins++
+		}
+	}
+	return extracted > 0 && pending == 0 && origins > 0, nil
+}
+
+// Release drops an image's references to its blobs and deletes the blob
+// file once no other image refers to it and it is not pinned.
+func (c *BlobCache) Release(checksum string, imageID int) error {
+	if err := c.meta.ReleaseBlobs(imageID); err != nil {
 		return err
 	}
 
-	for _, checksum := range unused {
-		path := c.getBlobPath(checksum)
-		os.Remove(path)
-		c.db.Exec("DELETE FROM blobs WHERE checksum = ?", checksum)
+	refs, err := c.meta.BlobRefs(checksum)
+	if err != nil || refs > 0 {
+		return err
+	}
+	images, err := c.meta.ImagesWithChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if img.ID != imageID {
+			return nil
+		}
+	}
+	if pinned, err := c.isPinned(checksum); err != nil || pinned {
+		return err
+	}
+	if err := os.Remove(c.getBlobPath(checksum)); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// GC removes blob files that no image, layer or pin refers to, and temp files
+// left by interrupted downloads and stores. It marks the live digests first,
+// then sweeps blobs/; anything modified within grace is kept, as it may
+// still be being written or about to be referenced. With dryRun nothing is
+// removed, but the report lists what would be.
+func (c *BlobCache) GC(dryRun bool, grace time.Duration) (types.GCReport, error) {
+	report := types.GCReport{DryRun: dryRun, Removed: []string{}}
+
+	live, err := c.liveDigests()
+	if err != nil {
+		return report, err
+	}
+	report.Live = len(live)
+
+	dir := filepath.Join(c.root, "blobs")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+	cutoff := time.Now().Add(-grace)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		checksum, isBlob := strings.CutSuffix(name, ".tar")
+		temp := strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, ".store-")
+		if !isBlob && !temp || isBlob && live[checksum] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		// An image may have been added since marking.
+		if isBlob {
+			referenced, err := c.referenced(checksum)
+			if err != nil {
+				return report, err
+			}
+			if referenced {
+				continue
+			}
+		}
+
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+			if isBlob {
+				if err := c.meta.DeleteBlob(checksum); err != nil {
+					return report, err
+				}
+			}
+		}
+		report.Removed = append(report.Removed, name)
+		report.Bytes += info.Size()
+	}
+
+	if !dryRun {
+		// Rows of images that no longer exist.
+		if err := c.meta.PruneBlobs(); err != nil {
+			return report, err
+		}
+		if err := c.meta.PrunePins(time.Now()); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// liveDigests collects the checksums of every image that is not failed or
+// being deleted, of every extracted layer and of every pin.
+func (c *BlobCache) liveDigests() (map[string]bool, error) {
+	live, err := c.pinnedDigests()
+	if err != nil {
+		return nil, err
+	}
+	images, err := c.meta.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		if img.State != "FAILED" && img.State != "DELETING" {
+			live[img.Checksum] = true
+		}
+	}
+	layers, err := c.meta.ListLayers()
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		live[layer.Checksum] = true
+	}
+	return live, nil
+}
+
+func (c *BlobCache) referenced(checksum string) (bool, error) {
+	images, err := c.meta.ImagesWithChecksum(checksum)
+	if err != nil {
+		return false, err
+	}
+	for _, img := range images {
+		if img.State != "FAILED" && img.State != "DELETING" {
+			return true, nil
+		}
+	}
+	layers, err := c.meta.ListLayers()
+	if err != nil {
+		return false, err
+	}
+	for _, layer := range layers {
+		if layer.Checksum == checksum {
+			return true, nil
+		}
+	}
+	return c.isPinned(checksum)
+}
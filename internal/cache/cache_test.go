@@ -0,0 +1,314 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imgstore/internal/metadata"
+)
+
+// newCache returns a cache on an empty store in a temp dir.
+func newCache(t *testing.T) (*BlobCache, metadata.Store) {
+	t.Helper()
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := metadata.OpenSQLite(filepath.Join(root, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { meta.Close() })
+	if err := meta.Migrate("../../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	return NewBlobCache(meta, root), meta
+}
+
+// addBlob stores a blob of size bytes for a new image in state, downloaded
+// from url unless that is empty, and last used at the given time.
+func addBlob(t *testing.T, c *BlobCache, meta metadata.Store, name, state, url string, size int, used time.Time) string {
+	t.Helper()
+
+	data := make([]byte, size)
+	copy(data, name)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	if err := c.Put(checksum, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := meta.CreateImages(metadata.Image{Name: name, BlobKey: url, Checksum: checksum, State: state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.MarkBlobUsed(ids[0], c.GetPath(checksum), checksum, int64(len(data)), used); err != nil {
+		t.Fatal(err)
+	}
+	return checksum
+}
+
+func TestEvict(t *testing.T) {
+	c, meta := newCache(t)
+	now := time.Now()
+
+	// Oldest first: a committed layer, two fetched images and one still
+	// waiting to be extracted.
+	committed := addBlob(t, c, meta, "committed", "STORED", "", 1000, now.Add(-4*time.Hour))
+	oldest := addBlob(t, c, meta, "oldest", "ACTIVE", "http://origin/a.tar", 1000, now.Add(-3*time.Hour))
+	older := addBlob(t, c, meta, "older", "STORED", "http://origin/b.tar", 1000, now.Add(-2*time.Hour))
+	pending := addBlob(t, c, meta, "pending", "DOWNLOADED", "http://origin/c.tar", 1000, now.Add(-time.Hour))
+	recent := addBlob(t, c, meta, "recent", "ACTIVE", "http://origin/d.tar", 1000, now)
+
+	// Room for three blobs: the two least recently used evictable ones go.
+	evicted, freed, err := c.Evict(3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 2 || evicted[0] != oldest || evicted[1] != older || freed != 2000 {
+		t.Fatalf("Evict = %v, %d", evicted, freed)
+	}
+	for _, checksum := range []string{committed, pending, recent} {
+		if !c.Exists(checksum) {
+			t.Errorf("blob %s was evicted", checksum[:12])
+		}
+	}
+
+	// However small the budget, the committed layer stays: nothing can
+	// download it again.
+	if _, _, err := c.Evict(1); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Exists(committed) {
+		t.Fatal("the committed layer was evicted")
+	}
+	if c.Exists(recent) {
+		t.Fatal("the last fetched blob was kept over budget")
+	}
+}
+
+func TestScrub(t *testing.T) {
+	c, meta := newCache(t)
+	now := time.Now()
+
+	fetched := addBlob(t, c, meta, "fetched", "ACTIVE", "http://origin/a.tar", 1000, now)
+	committed := addBlob(t, c, meta, "committed", "STORED", "", 1000, now)
+	if _, err := meta.CreateImages(metadata.Image{Name: "waiting", Checksum: committed, State: "DOWNLOADED"}); err != nil {
+		t.Fatal(err)
+	}
+	intact := addBlob(t, c, meta, "intact", "ACTIVE", "http://origin/b.tar", 1000, now)
+	for _, checksum := range []string{fetched, committed} {
+		if err := os.WriteFile(c.GetPath(checksum), []byte("corrupt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := c.Scrub(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || !equal(report.Quarantined, fetched, committed) || !equal(report.Unrecoverable, committed) {
+		t.Fatalf("Scrub = %+v", report)
+	}
+	for _, checksum := range []string{fetched, committed} {
+		if c.Exists(checksum) {
+			t.Errorf("corrupt blob %s is still in the cache", checksum[:12])
+		}
+		if _, err := os.Stat(filepath.Join(c.root, "blobs", "quarantine", checksum+".tar")); err != nil {
+			t.Errorf("blob %s was not quarantined: %v", checksum[:12], err)
+		}
+	}
+	if !c.Exists(intact) {
+		t.Error("the intact blob was quarantined")
+	}
+
+	// The fetched image is downloaded again when needed; of the committed
+	// layer's images, the one still waiting for it cannot go on.
+	want := map[string]struct {
+		state       string
+		quarantined bool
+	}{
+		"fetched":   {"ACTIVE", true},
+		"committed": {"STORED", true},
+		"waiting":   {"FAILED", true},
+		"intact":    {"ACTIVE", false},
+	}
+	for name, w := range want {
+		img, err := meta.GetImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.State != w.state || img.BlobQuarantined != w.quarantined {
+			t.Errorf("image %s is %s, quarantined %v; want %s, %v", name, img.State, img.BlobQuarantined, w.state, w.quarantined)
+		}
+	}
+	if stats, _ := c.Stats(); stats.Quarantined != 2 {
+		t.Errorf("quarantined counter = %d", stats.Quarantined)
+	}
+}
+
+// equal reports whether got holds the checksums in want, in any order.
+func equal(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, s := range got {
+		seen[s] = true
+	}
+	for _, s := range want {
+		if !seen[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGC(t *testing.T) {
+	c, meta := newCache(t)
+	old := time.Now().Add(-2 * time.Hour)
+
+	pending := addBlob(t, c, meta, "pending", "DOWNLOADED", "http://origin/a.tar", 100, old)
+	pinned := addBlob(t, c, meta, "pinned", "FAILED", "http://origin/b.tar", 100, old)
+	if _, err := c.AddPin(PinBlob, pinned, "test", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	committed := addBlob(t, c, meta, "committed", "DELETING", "", 100, old)
+	if err := meta.PutLayer(metadata.Layer{ID: "layer", Checksum: committed}); err != nil {
+		t.Fatal(err)
+	}
+	unreferenced := addBlob(t, c, meta, "unreferenced", "FAILED", "http://origin/c.tar", 100, old)
+
+	blobs := filepath.Dir(c.GetPath(pending))
+	stale := filepath.Join(blobs, unreferenced+".tar.tmp")
+	fresh := filepath.Join(blobs, "upload.tmp")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, checksum := range []string{pending, pinned, committed, unreferenced} {
+		if err := os.Chtimes(c.GetPath(checksum), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.GC(true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{unreferenced + ".tar", unreferenced + ".tar.tmp"}
+	if !report.DryRun || !equal(report.Removed, want...) || report.Bytes != 107 {
+		t.Fatalf("dry run = %+v", report)
+	}
+	if !c.Exists(unreferenced) || !exists(stale) {
+		t.Fatal("a dry run removed files")
+	}
+
+	report, err = c.GC(false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(report.Removed, want...) {
+		t.Fatalf("GC = %+v", report)
+	}
+	for _, checksum := range []string{pending, pinned, committed} {
+		if !c.Exists(checksum) {
+			t.Errorf("live blob %s was swept", checksum[:12])
+		}
+	}
+	if c.Exists(unreferenced) || exists(stale) {
+		t.Error("the unreferenced blob or the stale temp file survived")
+	}
+	if !exists(fresh) {
+		t.Error("a temp file within the grace period was swept")
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestPins(t *testing.T) {
+	c, meta := newCache(t)
+	old := time.Now().Add(-2 * time.Hour)
+
+	// Blobs of failed images, which GC sweeps unless they are pinned.
+	pinned := addBlob(t, c, meta, "pinned", "FAILED", "http://origin/a.tar", 100, old)
+	expired := addBlob(t, c, meta, "expired", "FAILED", "http://origin/b.tar", 100, old)
+	unpinned := addBlob(t, c, meta, "unpinned", "FAILED", "http://origin/c.tar", 100, old)
+	first := addBlob(t, c, meta, "image", "FAILED", "http://origin/d.tar", 100, old)
+	for _, pin := range []struct {
+		kind, target string
+		expires      time.Time
+	}{
+		{PinBlob, pinned, time.Time{}},
+		{PinBlob, expired, time.Now().Add(-time.Minute)},
+		{PinBlob, unpinned, time.Time{}},
+		{PinImage, "image", time.Time{}},
+	} {
+		if _, err := c.AddPin(pin.kind, pin.target, "test", pin.expires); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.RemovePin(PinBlob, unpinned); err != nil {
+		t.Fatal(err)
+	}
+	if pins, err := c.Pins(); err != nil || len(pins) != 2 {
+		t.Fatalf("Pins = %+v, %v", pins, err)
+	}
+
+	// The image pin follows the name to whatever blob the image has now.
+	img, err := meta.GetImage("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.MarkDeleting("image"); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.DeleteImage(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	second := addBlob(t, c, meta, "image", "FAILED", "http://origin/e.tar", 200, old)
+	for _, checksum := range []string{pinned, expired, unpinned, first, second} {
+		if err := os.Chtimes(c.GetPath(checksum), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := c.GC(false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(report.Removed, expired+".tar", unpinned+".tar") {
+		t.Fatalf("GC = %+v", report)
+	}
+	for _, checksum := range []string{pinned, first, second} {
+		if !c.Exists(checksum) {
+			t.Errorf("pinned blob %s was swept", checksum[:12])
+		}
+	}
+
+	// Eviction passes over pinned blobs however small the budget.
+	active := addBlob(t, c, meta, "active", "ACTIVE", "http://origin/f.tar", 100, old)
+	kept := addBlob(t, c, meta, "kept", "ACTIVE", "http://origin/g.tar", 100, old)
+	if _, err := c.AddPin(PinImage, "kept", "test", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	evicted, _, err := c.Evict(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(evicted, active) || !c.Exists(kept) {
+		t.Fatalf("Evict = %v", evicted)
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+
+	"imgstore/internal/types"
+)
+
+const (
+	PinImage = "image"
+	PinBlob  = "blob"
+)
+
+// AddPin protects a blob, or the blob of an image, from garbage collection
+// and eviction until it expires; a zero expiry never does. An image pin also
+// covers whatever blob an image of that name has later, so it survives the
+// image being deleted and fetched again. Pinning the same target again
+// replaces the reason and expiry.
+func (c *BlobCache) AddPin(kind, target, reason string, expires time.Time) (types.Pin, error) {
+	pin := types.Pin{Kind: kind, Target: target, Reason: reason}
+	switch kind {
+	case PinImage:
+		img, err := c.meta.GetImage(target)
+		if err != nil {
+			return pin, err
+		}
+		pin.Checksum = img.Checksum
+	case PinBlob:
+		if !ValidDigest(target) {
+			return pin, fmt.Errorf("blob %q: %w", target, ErrNotFound)
+		}
+		pin.Checksum = target
+	default:
+		return pin, fmt.Errorf("unknown pin kind %q", kind)
+	}
+
+	if !expires.IsZero() {
+		pin.Expires = &expires
+	}
+	return c.meta.AddPin(pin)
+}
+
+func (c *BlobCache) RemovePin(kind, target string) error {
+	return c.meta.RemovePin(kind, target)
+}
+
+// Pins lists the pins that have not expired.
+func (c *BlobCache) Pins() ([]types.Pin, error) {
+	return c.meta.ListPins(time.Now())
+}
+
+// pinnedDigests collects the checksums protected by pinned_blobs and by
+// pins that have not expired.
+func (c *BlobCache) pinnedDigests() (map[string]bool, error) {
+	checksums, err := c.meta.PinnedChecksums(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := make(map[string]bool)
+	for checksum := range c.pinned {
+		pinned[checksum] = true
+	}
+	for _, checksum := range checksums {
+		pinned[checksum] = true
+	}
+	return pinned, nil
+}
+
+func (c *BlobCache) isPinned(checksum string) (bool, error) {
+	pinned, err := c.pinnedDigests()
+	return pinned[checksum], err
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imgstore/internal/types"
+)
+
+// Verify re-hashes a blob and reports whether it still matches its checksum.
+// A rate above 0 limits reading to that many bytes per second.
+func (c *BlobCache) Verify(ctx context.Context, checksum string, rate int64) (bool, error) {
+	file, err := os.Open(c.getBlobPath(checksum))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if rate > 0 {
+		r = &throttle{ctx: ctx, r: file, rate: rate, start: time.Now()}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return false, err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)) == checksum, nil
+}
+
+// ErrNoOrigin is returned for a blob quarantined although no image can
+// download it again, such as a committed layer.
+var ErrNoOrigin = errors.New("no origin to refetch it from")
+
+// Quarantine moves a corrupt blob into blobs/quarantine/ and flags the
+// images built from it. The blob no longer exists in the cache, so the next
+// image that needs it downloads it again. If no image has a URL for it, the
+// images still waiting for it are marked FAILED and ErrNoOrigin returned.
+func (c *BlobCache) Quarantine(checksum string) error {
+	dir := filepath.Join(c.root, "blobs", "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, checksum+".tar")
+	if err := os.Rename(c.getBlobPath(checksum), target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := c.count(statQuarantined, 1); err != nil {
+		return err
+	}
+	if err := c.meta.SetQuarantined(checksum, true); err != nil {
+		return err
+	}
+
+	images, err := c.meta.ImagesWithChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if img.BlobKey != "" {
+			return nil
+		}
+	}
+	for _, img := range images {
+		switch img.State {
+		case "NEW", "DOWNLOADING", "DOWNLOADED", "UNPACKING":
+			if _, err := c.meta.SetState(img.ID, img.State, "FAILED"); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("blob %s is corrupt: %w", checksum, ErrNoOrigin)
+}
+
+// Scrub verifies every blob at up to rate bytes per second and quarantines
+// those that no longer match their checksum.
+func (c *BlobCache) Scrub(ctx context.Context, rate int64) (types.ScrubReport, error) {
+	report := types.ScrubReport{Quarantined: []string{}, Unrecoverable: []string{}}
+
+	entries, err := os.ReadDir(filepath.Join(c.root, "blobs"))
+	if err != nil {
+		return report, err
+	}
+	for _, entry := range entries {
+		checksum, ok := strings.CutSuffix(entry.Name(), ".tar")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		valid, err := c.Verify(ctx, checksum, rate)
+		if os.IsNotExist(err) {
+			continue // Evicted or collected meanwhile
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Checked++
+		if info, err := entry.Info(); err == nil {
+			report.Bytes += info.Size()
+		}
+		if valid {
+			continue
+		}
+		err = c.Quarantine(checksum)
+		if errors.Is(err, ErrNoOrigin) {
+			report.Unrecoverable = append(report.Unrecoverable, checksum)
+		} else if err != nil {
+			return report, err
+		}
+		report.Quarantined = append(report.Quarantined, checksum)
+	}
+	return report, nil
+}
+
+// throttle limits reads to rate bytes per second on average.
+type throttle struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttle) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
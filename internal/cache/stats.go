@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"imgstore/internal/types"
+)
+
+// Counters kept in cache_stats. They live in the database so that the
+// worker and the server add up to the same figures.
+const (
+	statHits         = "hits"
+	statMisses       = "misses"
+	statCachedBytes  = "cached_bytes"
+	statDownloaded   = "downloaded_bytes"
+	statEvictions    = "evictions"
+	statEvictedBytes = "evicted_bytes"
+	statQuarantined  = "quarantined"
+)
+
+func (c *BlobCache) count(name string, delta int64) error {
+	return c.meta.AddCounter(name, delta)
+}
+
+// Hit records a download served from the cache.
+func (c *BlobCache) Hit(checksum string) error {
+	if err := c.Touch(checksum); err != nil {
+		return err
+	}
+	if err := c.count(statHits, 1); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(c.getBlobPath(checksum)); err == nil {
+		return c.count(statCachedBytes, fi.Size())
+	}
+	return nil
+}
+
+// Miss records a blob that had to be downloaded.
+func (c *BlobCache) Miss() error {
+	return c.count(statMisses, 1)
+}
+
+// Downloaded records the bytes of a blob once its download completed.
+func (c *BlobCache) Downloaded(checksum string) error {
+	fi, err := os.Stat(c.getBlobPath(checksum))
+	if err != nil {
+		return err
+	}
+	return c.count(statDownloaded, fi.Size())
+}
+
+// Stats reports the cache counters, its current size and every blob in it.
+func (c *BlobCache) Stats() (types.CacheStats, error) {
+	stats := types.CacheStats{Blobs: []types.BlobInfo{}}
+
+	counters, err := c.meta.Counters()
+	if err != nil {
+		return stats, err
+	}
+	for name, value := range counters {
+		switch name {
+		case statHits:
+			stats.Hits = value
+		case statMisses:
+			stats.Misses = value
+		case statCachedBytes:
+			stats.CachedBytes = value
+		case statDownloaded:
+			stats.DownloadedBytes = value
+		case statEvictions:
+			stats.Evictions = value
+		case statEvictedBytes:
+			stats.EvictedBytes = value
+		case statQuarantined:
+			stats.Quarantined = value
+		}
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+
+	pinned, err := c.pinnedDigests()
+	if err != nil {
+		return stats, err
+	}
+	entries, err := os.ReadDir(filepath.Join(c.root, "blobs"))
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		checksum, ok := strings.CutSuffix(entry.Name(), ".tar")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		blob := types.BlobInfo{
+			Digest:   checksum,
+			Size:     info.Size(),
+			LastUsed: info.ModTime(),
+			Pinned:   pinned[checksum],
+		}
+		images, err := c.meta.ImagesWithChecksum(checksum)
+		if err != nil {
+			return stats, err
+		}
+		for _, img := range images {
+			if img.State != "DELETING" {
+				blob.Refs++
+			}
+		}
+		lastUsed, err := c.meta.BlobLastUsed(checksum)
+		if err != nil {
+			return stats, err
+		}
+		if !lastUsed.IsZero() {
+			blob.LastUsed = lastUsed
+		}
+		stats.Size += blob.Size
+		stats.Blobs = append(stats.Blobs, blob)
+	}
+	sort.Slice(stats.Blobs, func(i, j int) bool { return stats.Blobs[i].LastUsed.After(stats.Blobs[j].LastUsed) })
+	return stats, nil
+}
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"imgstore/internal/extractor"
+	"imgstore/internal/storage"
+)
+
+const (
+	DefaultPolicyName  = "default"
+	FaithfulPolicyName = "faithful"
+)
+
+type Config struct {
+	DefaultPolicy string                                `json:"default_policy"`
+	Policies      map[string]extractor.ExtractionPolicy `json:"policies"`
+
+	// Streaming extracts blobs while they download instead of reading
+	// them back from blobs/ afterwards.
+	Streaming bool `json:"streaming"`
+
+	// Snapshotter selects the snapshot backend: overlay (default), copy or
+	// reflink.
+	Snapshotter string `json:"snapshotter"`
+
+	// UnmountOnShutdown unmounts all snapshots when the worker or server
+	// stops; they are mounted again on the next start.
+	UnmountOnShutdown bool `json:"unmount_on_shutdown"`
+
+	// UsageInterval is how often, in seconds, the upper dirs of mounted
+	// snapshots are measured and their quotas enforced. Default 60.
+	UsageInterval int `json:"usage_interval"`
+
+	// GCGrace is how long, in seconds, an unreferenced blob or temp file is
+	// kept before garbage collection removes it. Default 3600.
+	GCGrace int `json:"gc_grace"`
+
+	// CacheBudget caps the size of blobs/, either in bytes with an optional
+	// K, M, G or T suffix ("20G") or as a percentage of the filesystem
+	// ("25%"). Blobs of extracted images are evicted, least recently used
+	// first, once it is exceeded. Empty means no limit.
+	CacheBudget string `json:"cache_budget"`
+
+	// PinnedBlobs lists checksums that are never evicted.
+	PinnedBlobs []string `json:"pinned_blobs"`
+
+	// ScrubInterval is how often, in seconds, every blob is re-hashed and
+	// corrupt ones quarantined. Default a day; negative disables it.
+	ScrubInterval int `json:"scrub_interval"`
+
+	// ScrubRate limits scrubbing to this many bytes per second, with the
+	// same suffixes as CacheBudget. Default 32M.
+	ScrubRate string `json:"scrub_rate"`
+
+	// VerifyCacheHits re-hashes a cached blob before it is extracted.
+	VerifyCacheHits bool `json:"verify_cache_hits"`
+
+	// Peers are base URLs of other imgstore servers that are asked for a
+	// blob before its origin URL.
+	Peers []string `json:"peers"`
+
+	// BundleKey is the private key bundles are signed with, and
+	// TrustedKeys the public keys whose bundles are loaded.
+	BundleKey   string   `json:"bundle_key"`
+	TrustedKeys []string `json:"trusted_keys"`
+
+	// Dedup links identical files of extracted trees to a shared object
+	// under objects/: "hardlink", "reflink" or empty for none. Hardlinked
+	// files are extracted read-only whatever the policy says.
+	Dedup string `json:"dedup"`
+
+	// Database is where the catalog is kept: the path of a SQLite
+	// database, or a postgres:// URL so that several hosts share one.
+	// Default ./store.db.
+	Database string `json:"database"`
+}
+
+func Default() *Config {
+	return &Config{
+		Policies: map[string]extractor.ExtractionPolicy{
+			DefaultPolicyName:  extractor.DefaultPolicy(),
+			FaithfulPolicyName: extractor.FaithfulPolicy(),
+		},
+	}
+}
+
+// Load reads a JSON config file. A missing file yields the defaults so the
+// store keeps working without any configuration.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// UsageEvery returns the usage refresh interval.
+func (c *Config) UsageEvery() time.Duration {
+	if c.UsageInterval <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.UsageInterval) * time.Second
+}
+
+// GCGracePeriod returns the garbage collection grace period.
+func (c *Config) GCGracePeriod() time.Duration {
+	if c.GCGrace <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.GCGrace) * time.Second
+}
+
+// DatabaseDSN returns the catalog to open.
+func (c *Config) DatabaseDSN() string {
+	if c.Database == "" {
+		return "./store.db"
+	}
+	return c.Database
+}
+
+// CacheBudgetBytes resolves the cache budget for a cache in dir; 0 means
+// no limit.
+func (c *Config) CacheBudgetBytes(dir string) (int64, error) {
+	budget := strings.TrimSpace(c.CacheBudget)
+	if budget == "" {
+		return 0, nil
+	}
+	if percent, ok := strings.CutSuffix(budget, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid cache budget %q", c.CacheBudget)
+		}
+		if dir == "" {
+			return 0, nil
+		}
+		size, err := storage.FilesystemSize(dir)
+		if err != nil {
+			return 0, err
+		}
+		return int64(float64(size) * p / 100), nil
+	}
+
+	size, err := ParseSize(budget)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache budget %q", c.CacheBudget)
+	}
+	return size, nil
+}
+
+// ScrubEvery returns how often blobs are verified, or 0 if never.
+func (c *Config) ScrubEvery() time.Duration {
+	if c.ScrubInterval < 0 {
+		return 0
+	}
+	if c.ScrubInterval == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.ScrubInterval) * time.Second
+}
+
+// ScrubBytesPerSecond returns the scrub read rate.
+func (c *Config) ScrubBytesPerSecond() (int64, error) {
+	if c.ScrubRate == "" {
+		return 32 << 20, nil
+	}
+	rate, err := ParseSize(c.ScrubRate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scrub rate %q", c.ScrubRate)
+	}
+	return rate, nil
+}
+
+// ParseSize parses a positive byte count with an optional K, M, G or T
+// suffix.
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	multiplier := int64(1)
+	if i := strings.IndexAny(size, "KMGTkmgt"); i >= 0 {
+		switch strings.ToUpper(size[i:]) {
+		case "K", "KB", "KIB":
+			multiplier = 1 << 10
+		case "M", "MB", "MIB":
+			multiplier = 1 << 20
+		case "G", "GB", "GIB":
+			multiplier = 1 << 30
+		case "T", "TB", "TIB":
+			multiplier = 1 << 40
+		default:
+			return 0, fmt.Errorf("invalid size %q", size)
+		}
+		size = size[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+func (c *Config) Validate() error {
+	for name, policy := range c.Policies {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("policy %s: %v", name, err)
+		}
+	}
+	if _, err := storage.New(c.Snapshotter, ""); err != nil {
+		return err
+	}
+	if _, err := storage.NewObjectStore(c.Dedup, ""); err != nil {
+		return err
+	}
+	if _, err := c.CacheBudgetBytes(""); err != nil {
+		return err
+	}
+	if _, err := c.ScrubBytesPerSecond(); err != nil {
+		return err
+	}
+	if c.DefaultPolicy == "" {
+		return nil
+	}
+	if _, ok := c.Policies[c.DefaultPolicy]; !ok {
+		return fmt.Errorf("default policy %q is not defined", c.DefaultPolicy)
+	}
+	return nil
+}
+
+// Policy resolves a policy profile by name; an empty name selects the
+// default profile. Without an explicit default_policy, privileged runs
+// restore archives faithfully and unprivileged runs stay sanitised.
+func (c *Config) Policy(name string) (extractor.ExtractionPolicy, error) {
+	if name == "" {
+		name = c.DefaultPolicy
+	}
+	if name == "" {
+		name = DefaultPolicyName
+		if extractor.DetectPrivileges().Root {
+			name = FaithfulPolicyName
+		}
+	}
+	policy, ok := c.Policies[name]
+	if !ok {
+		return extractor.ExtractionPolicy{}, fmt.Errorf("unknown extraction policy %q", name)
+	}
+	if c.Dedup == storage.DedupHardlink {
+		policy.ReadOnly = true
+	}
+	return policy, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"imgstore/internal/extractor"
+)
+
+func TestPolicyDefaultFollowsPrivileges(t *testing.T) {
+	c := Default()
+	want, name := extractor.DefaultPolicy(), DefaultPolicyName
+	if extractor.DetectPrivileges().Root {
+		want, name = extractor.FaithfulPolicy(), FaithfulPolicyName
+	}
+	policy, err := c.Policy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Fatalf("Policy(\"\") = %+v, want the %s profile", policy, name)
+	}
+
+	// An explicit default_policy wins either way.
+	for _, name := range []string{DefaultPolicyName, FaithfulPolicyName} {
+		c.DefaultPolicy = name
+		if policy, err = c.Policy(""); err != nil || !reflect.DeepEqual(policy, c.Policies[name]) {
+			t.Fatalf("with default_policy %s, Policy(\"\") = %+v, %v", name, policy, err)
+		}
+	}
+}
@@ -3,30 +3,124 @@ package downloader
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 type Downloader struct {
 	client     *http.Client
 	maxRetries int
+	peers      []string
 }
 
 type ProgressCallback func(downloaded, total int64)
 
 func New() *Downloader {
+	return NewWithPeers(nil)
+}
+
+// NewWithPeers returns a Downloader that asks each peer store, given by its
+// base URL, for a blob before falling back to the origin.
+func NewWithPeers(peers []string) *Downloader {
 	return &Downloader{
 		client: &http.Client{
 			Timeout: 30 * time.Minute,
 		},
 		maxRetries: 3,
+		peers:      peers,
 	}
 }
 
+// PeerURL is where a peer store serves the blob with the given checksum.
+func PeerURL(peer, checksum string) string {
+	return strings.TrimSuffix(peer, "/") + "/api/v1/blobs/" + checksum
+}
+
+// ConsumeFunc receives the body of a download while it is being written to
+// disk. It is called once per attempt with a fresh reader.
+type ConsumeFunc func(r io.Reader) error
+
+// permanentError stops the retry loop; retrying cannot fix it.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks a ConsumeFunc error that retrying cannot fix, such as an
+// archive the extractor refuses. Other consume errors are retried.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
 func (d *Downloader) Download(ctx context.Context, url, destPath, expectedChecksum string, progress ProgressCallback) error {
+	return d.fetch(ctx, url, expectedChecksum, func(url string) error {
+		return d.downloadAttempt(ctx, url, destPath, expectedChecksum, progress, nil)
+	})
+}
+
+// DownloadStream downloads like Download while teeing the body into consume.
+// It only returns nil once both the checksum has been verified and consume
+// has succeeded. A consume error fails the attempt, and the download too if
+// it is marked Permanent.
+func (d *Downloader) DownloadStream(ctx context.Context, url, destPath, expectedChecksum string, progress ProgressCallback, consume ConsumeFunc) error {
+	return d.fetch(ctx, url, expectedChecksum, func(url string) error {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := consume(pr)
+			if err == nil {
+				// Drain trailing padding so the writer never blocks.
+				_, err = io.Copy(io.Discard, pr)
+			}
+			if err != nil {
+				// Surfaces to the writer, ending the attempt.
+				pr.CloseWithError(err)
+			} else {
+				pr.Close()
+			}
+			done <- err
+		}()
+
+		err := d.downloadAttempt(ctx, url, destPath, expectedChecksum, progress, pw)
+		pw.CloseWithError(err)
+		consumeErr := <-done
+
+		if err != nil {
+			return err
+		}
+		return consumeErr
+	})
+}
+
+// fetch tries each peer once, then the origin with retries. Any peer failure,
+// including data that fails the checksum or the consumer, moves on to the
+// next source, so a bad peer can delay a download but never corrupt it.
+func (d *Downloader) fetch(ctx context.Context, origin, checksum string, try func(url string) error) error {
+	for _, peer := range d.peers {
+		err := try(PeerURL(peer, checksum))
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Peer %s: blob %s: %v", peer, checksum[:12], err)
+	}
+	return d.withRetry(ctx, func() error {
+		return try(origin)
+	})
+}
+
+func (d *Downloader) withRetry(ctx context.Context, try func() error) error {
 	var lastErr error
 	
 	for attempt := 0; attempt <= d.maxRetries; attempt++ {
@@ -38,7 +132,11 @@ func (d *Downloader) Download(ctx context.Context, url, destPath, expectedChecks
 			}
 		}
 		
-		if err := d.downloadAttempt(ctx, url, destPath, expectedChecksum, progress); err != nil {
+		if err := try(); err != nil {
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				return perm.err
+			}
 			lastErr = err
 			continue
 		}
@@ -48,7 +146,7 @@ func (d *Downloader) Download(ctx context.Context, url, destPath, expectedChecks
 	return fmt.Errorf("download failed after %d attempts: %v", d.maxRetries+1, lastErr)
 }
 
-func (d *Downloader) downloadAttempt(ctx context.Context, url, destPath, expectedChecksum string, progress ProgressCallback) error {
+func (d *Downloader) downloadAttempt(ctx context.Context, url, destPath, expectedChecksum string, progress ProgressCallback, sink io.Writer) error {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
@@ -73,6 +171,9 @@ func (d *Downloader) downloadAttempt(ctx context.Context, url, destPath, expecte
 	
 	hash := sha256.New()
 	writer := io.MultiWriter(file, hash)
+	if sink != nil {
+		writer = io.MultiWriter(file, hash, sink)
+	}
 	
 	var downloaded int64
 	total := resp.ContentLength
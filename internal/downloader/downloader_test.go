@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// layer returns a gzipped tar holding one file of incompressible-looking
+// content, so that corrupting it breaks decoding.
+func layer(t *testing.T) []byte {
+	t.Helper()
+
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "data", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// flaky serves a corrupted copy of data to the first bad requests, then data.
+func flaky(t *testing.T, data []byte, bad int32) (*httptest.Server, *int32) {
+	t.Helper()
+
+	corrupt := append([]byte(nil), data...)
+	for i := len(corrupt) / 3; i < len(corrupt)/2; i++ {
+		corrupt[i] ^= 0xff
+	}
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= bad {
+			w.Write(corrupt)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// untar reads a gzipped tar to the end, as the extractor does.
+func untar(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func TestDownloadStreamRetriesDecodeErrors(t *testing.T) {
+	data := layer(t)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	srv, hits := flaky(t, data, 1)
+	dest := filepath.Join(t.TempDir(), "blob.tar")
+
+	var attempts int
+	consume := func(r io.Reader) error {
+		attempts++
+		return untar(r)
+	}
+	if err := New().DownloadStream(context.Background(), srv.URL, dest, checksum, nil, consume); err != nil {
+		t.Fatal(err)
+	}
+	if *hits != 2 || attempts != 2 {
+		t.Fatalf("%d requests and %d attempts, want 2 of each", *hits, attempts)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded blob differs: %v", err)
+	}
+}
+
+func TestDownloadStreamPermanentError(t *testing.T) {
+	data := layer(t)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	srv, hits := flaky(t, data, 0)
+	dest := filepath.Join(t.TempDir(), "blob.tar")
+
+	rejected := errors.New("rejected")
+	consume := func(r io.Reader) error {
+		return Permanent(rejected)
+	}
+	err := New().DownloadStream(context.Background(), srv.URL, dest, checksum, nil, consume)
+	if !errors.Is(err, rejected) {
+		t.Fatalf("DownloadStream = %v, want the consumer's error", err)
+	}
+	if *hits != 1 {
+		t.Fatalf("%d requests for a permanent error", *hits)
+	}
+}
@@ -0,0 +1,265 @@
+package export
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"imgstore/internal/storage"
+)
+
+const (
+	None = ""
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// Epoch is the modification time given to every exported entry, so that
+// exporting the same tree twice yields identical bytes.
+var Epoch = time.Unix(0, 0)
+
+// Extension returns the file extension for a compression.
+func Extension(compression string) (string, error) {
+	switch compression {
+	case None:
+		return ".tar", nil
+	case Gzip:
+		return ".tar.gz", nil
+	case Zstd:
+		return ".tar.zst", nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownCompression, compression)
+}
+
+// Write streams dir to w as a deterministic tar: entries sorted, times set
+// to Epoch, numeric ownership only. gzip and zstd output is deterministic
+// too, as neither records a name or timestamp.
+func Write(w io.Writer, dir, compression string) error {
+	if _, err := Extension(compression); err != nil {
+		return err
+	}
+
+	var out io.WriteCloser
+	switch compression {
+	case Gzip:
+		out = gzip.NewWriter(w)
+	case Zstd:
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		out = enc
+	default:
+		return storage.WriteTar(w, dir, storage.TarOptions{ModTime: Epoch})
+	}
+
+	if err := storage.WriteTar(out, dir, storage.TarOptions{ModTime: Epoch}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// File is an open, finished export. ETag is the quoted SHA-256 of its
+// content, which stays the same for as long as the exported tree does.
+type File struct {
+	*os.File
+	ETag    string
+	ModTime time.Time
+}
+
+// Cache keeps finished exports so that they can be served with Range
+// requests and resumed. Each key is built by one request at a time, and a
+// file and its digest are always replaced together; exports of other keys,
+// and hits on the same key, do not wait for a build.
+type Cache struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock serialises the builds of one key. swap is held for writing only
+// while a finished build replaces the file and its digest, and for reading
+// while they are opened.
+type keyLock struct {
+	build sync.Mutex
+	swap  sync.RWMutex
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir, locks: make(map[string]*keyLock)}
+}
+
+func (c *Cache) lock(key string) *keyLock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &keyLock{}
+		c.locks[key] = l
+	}
+	return l
+}
+
+// Get opens the export of src stored under key, writing it first when there
+// is none or it is older than since. The caller closes the file.
+func (c *Cache) Get(key, src, compression string, since time.Time) (*File, error) {
+	ext, err := Extension(compression)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(c.dir, key+ext)
+	l := c.lock(key)
+
+	if file := l.fresh(path, since); file != nil {
+		return file, nil
+	}
+	l.build.Lock()
+	defer l.build.Unlock()
+	// Another request may have built it meanwhile.
+	if file := l.fresh(path, since); file != nil {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".export-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if err := Write(io.MultiWriter(tmp, hash), src, compression); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	l.swap.Lock()
+	defer l.swap.Unlock()
+	digest := fmt.Sprintf("%x", hash.Sum(nil))
+	if err := os.WriteFile(path+".sha256", []byte(digest), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return open(path)
+}
+
+// fresh opens the export at path if it exists and is not older than since.
+func (l *keyLock) fresh(path string, since time.Time) *File {
+	l.swap.RLock()
+	defer l.swap.RUnlock()
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().Before(since) {
+		return nil
+	}
+	file, err := open(path)
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// GC removes the exports, and the files of interrupted builds, that were
+// written more than grace ago; they are built again when next requested.
+// It returns the number of exports removed and the bytes they took.
+func (c *Cache) GC(dryRun bool, grace time.Duration) (int, int64, error) {
+	entries, err := os.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := time.Now().Add(-grace)
+	var removed int
+	var freed int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".sha256") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(c.dir, name)
+		if strings.HasPrefix(name, ".export-") {
+			if !dryRun {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return removed, freed, err
+				}
+			}
+			removed++
+			freed += info.Size()
+			continue
+		}
+		key := name
+		for _, compression := range []string{Gzip, Zstd, None} {
+			ext, _ := Extension(compression)
+			if k, ok := strings.CutSuffix(name, ext); ok {
+				key = k
+				break
+			}
+		}
+		if !dryRun {
+			if err := c.remove(key, path, cutoff); err != nil {
+				return removed, freed, err
+			}
+		}
+		removed++
+		freed += info.Size()
+	}
+	return removed, freed, nil
+}
+
+// remove deletes an export and its digest unless it has been replaced
+// since cutoff.
+func (c *Cache) remove(key, path string, cutoff time.Time) error {
+	l := c.lock(key)
+	l.swap.Lock()
+	defer l.swap.Unlock()
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().After(cutoff) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + ".sha256"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func open(path string) (*File, error) {
+	digest, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{File: f, ETag: `"` + string(digest) + `"`, ModTime: fi.ModTime()}, nil
+}
@@ -0,0 +1,135 @@
+package export
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tree writes a dir holding one file with content.
+func tree(t *testing.T, content string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// check reads f and fails unless it is the export of dir with its digest.
+func check(t *testing.T, f *File, dir string) {
+	t.Helper()
+
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := Write(&want, dir, None); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("export of %s differs from the tree", dir)
+	}
+	if etag := fmt.Sprintf(`"%x"`, sha256.Sum256(got)); f.ETag != etag {
+		t.Fatalf("ETag %s, want %s", f.ETag, etag)
+	}
+}
+
+func TestCacheExportsKeysConcurrently(t *testing.T) {
+	c := NewCache(t.TempDir())
+	a, b := tree(t, "a"), tree(t, "b")
+
+	var wg sync.WaitGroup
+	files := make([]*File, 2)
+	errs := make([]error, 2)
+	for i, src := range []string{a, b} {
+		wg.Add(1)
+		go func(i int, src string) {
+			defer wg.Done()
+			files[i], errs[i] = c.Get(fmt.Sprint(i), src, None, time.Time{})
+		}(i, src)
+	}
+	wg.Wait()
+	for i, src := range []string{a, b} {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		check(t, files[i], src)
+	}
+
+	// While a build of key 0 is in progress, key 1 is built and key 0's
+	// finished export is still served.
+	l := c.lock("0")
+	l.build.Lock()
+	defer l.build.Unlock()
+	done := make(chan *File)
+	go func() {
+		f, err := c.Get("1", b, Gzip, time.Time{})
+		if err == nil {
+			f.Close()
+			f, err = c.Get("0", a, None, time.Time{})
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		done <- f
+	}()
+	select {
+	case f := <-done:
+		if f != nil {
+			check(t, f, a)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("exports waited for the build of another key")
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir)
+	src := tree(t, "a")
+	for _, key := range []string{"old", "new"} {
+		f, err := c.Get(key, src, Gzip, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	partial := filepath.Join(dir, ".export-1")
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "old.tar.gz"), partial} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, _, err := c.GC(true, time.Hour); err != nil || n != 2 {
+		t.Fatalf("dry run removed %d, %v", n, err)
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Fatal("a dry run removed files")
+	}
+	if n, _, err := c.GC(false, time.Hour); err != nil || n != 2 {
+		t.Fatalf("GC removed %d, %v", n, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != "new.tar.gz" || names[1] != "new.tar.gz.sha256" {
+		t.Fatalf("left %q", names)
+	}
+}
@@ -3,29 +3,79 @@ package extractor
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+
+	"imgstore/internal/manifest"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
 )
 
+// ErrRejected matches the errors of archives refused by the policy or for
+// reaching outside the destination. Extracting them again fails the same
+// way, unlike read and decompression errors.
+var ErrRejected = errors.New("archive rejected")
+
+type rejection struct {
+	msg string
+}
+
+func (r *rejection) Error() string {
+	return r.msg
+}
+
+func (r *rejection) Is(target error) bool {
+	return target == ErrRejected
+}
+
+func reject(format string, args ...interface{}) error {
+	return &rejection{msg: fmt.Sprintf(format, args...)}
+}
+
 type Extractor struct {
-	maxFileSize int64
-	maxFiles    int
+	policy ExtractionPolicy
+	priv   Privileges
 }
 
 func New() *Extractor {
-	return &Extractor{
-		maxFileSize: 100 * 1024 * 1024, // 100MB per file
-		maxFiles:    10000,              // Max files per archive
-	}
+	return NewWithPolicy(DefaultPolicy())
+}
+
+func NewWithPolicy(policy ExtractionPolicy) *Extractor {
+	priv := DetectPrivileges()
+	return &Extractor{policy: policy.Effective(priv), priv: priv}
 }
 
-func (e *Extractor) Extract(archivePath, destDir string) error {
+func (e *Extractor) Policy() ExtractionPolicy {
+	return e.policy
+}
+
+// Extract unpacks archivePath into destDir and returns a manifest of every
+// entry written, sorted by path.
+func (e *Extractor) Extract(archivePath, destDir string) ([]manifest.Entry, error) {
+	return e.extractArchive(archivePath, destDir, nil, false)
+}
+
+// ExtractLayer applies an OCI layer on top of the rootfs already in destDir.
+// A .wh.<name> entry deletes <name>, and .wh..wh..opq empties its directory
+// of everything that came from lower layers. base is the manifest of destDir
+// before the layer; the returned manifest describes the merged tree.
+func (e *Extractor) ExtractLayer(archivePath, destDir string, base []manifest.Entry) ([]manifest.Entry, error) {
+	return e.extractArchive(archivePath, destDir, base, true)
+}
+
+func (e *Extractor) extractArchive(archivePath, destDir string, base []manifest.Entry, layer bool) ([]manifest.Entry, error) {
 	file, err := os.Open(archivePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
@@ -33,14 +83,35 @@ func (e *Extractor) Extract(archivePath, destDir string) error {
 	if strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz") {
 		gzReader, err := gzip.NewReader(file)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer gzReader.Close()
 		reader = gzReader
 	}
 
+	return e.extract(reader, destDir, base, layer)
+}
+
+// ExtractReader extracts an uncompressed tar stream into destDir.
+func (e *Extractor) ExtractReader(reader io.Reader, destDir string) ([]manifest.Entry, error) {
+	return e.extract(reader, destDir, nil, false)
+}
+
+func (e *Extractor) extract(reader io.Reader, destDir string, base []manifest.Entry, layer bool) ([]manifest.Entry, error) {
+	dest, err := openRoot(destDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+
 	tarReader := tar.NewReader(reader)
+	files := manifest.NewBuilder()
+	for _, entry := range base {
+		files.Add(entry)
+	}
+	written := make(map[string]bool)
 	fileCount := 0
+	var dirs []*tar.Header
 
 	for {
 		header, err := tarReader.Next()
@@ -48,137 +119,291 @@ func (e *Extractor) Extract(archivePath, destDir string) error {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		fileCount++
-		if fileCount > e.maxFiles {
-			return fmt.Errorf("too many files in archive (max %d)", e.maxFiles)
+		if fileCount > e.policy.MaxFiles {
+			return nil, reject("too many files in archive (max %d)", e.policy.MaxFiles)
 		}
 
-		if err := e.extractFile(tarReader, header, destDir); err != nil {
-			return err
+		if layer {
+			handled, err := applyWhiteout(header, dest, files, written)
+			if err != nil {
+				return nil, err
+			}
+			if handled {
+				continue
+			}
 		}
-	}
 
-	return nil
-}
-
-func (e *Extractor) extractFile(tarReader *tar.Reader, header *tar.Header, destDir string) error {
-	// Security checks
-	if err := e.validatePath(header.Name, destDir); err != nil {
-		return err
+		if err := e.extractFile(tarReader, header, dest, files); err != nil {
+			return nil, err
+		}
+		if parts, err := splitName(header.Name); err == nil {
+			for i := range parts {
+				written[strings.Join(parts[:i+1], "/")] = true
+			}
+		}
+		if header.Typeflag == tar.TypeDir && e.policy.allows(TypeDir) {
+			dirs = append(dirs, header)
+		}
 	}
 
-	if header.Size > e.maxFileSize {
-		return fmt.Errorf("file %s too large: %d bytes (max %d)", header.Name, header.Size, e.maxFileSize)
+	// Directory metadata is applied last so that restrictive modes do not
+	// prevent the entries inside them from being written.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := e.applyMetadata(dirs[i], dest); err != nil {
+			return nil, err
+		}
 	}
 
-	target := filepath.Join(destDir, header.Name)
-
-	switch header.Typeflag {
-	case tar.TypeDir:
-		return os.MkdirAll(target, 0755)
+	return files.Entries(), nil
+}
 
-	case tar.TypeReg:
-		return e.extractRegularFile(tarReader, target, header)
+// applyWhiteout handles the OCI whiteout entries of a layer and reports
+// whether header was one. written holds the paths the layer itself created,
+// which an opaque whiteout must leave alone.
+func applyWhiteout(header *tar.Header, dest root, files *manifest.Builder, written map[string]bool) (bool, error) {
+	parts, err := splitName(header.Name)
+	if err != nil || len(parts) == 0 {
+		return false, err
+	}
+	dir := strings.Join(parts[:len(parts)-1], "/")
+	base := parts[len(parts)-1]
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return false, nil
+	}
 
-	case tar.TypeSymlink:
-		return e.extractSymlink(header, target, destDir)
+	if base == whiteoutOpaque {
+		names, err := dest.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, name := range names {
+			child := path.Join(dir, name)
+			if written[child] {
+				continue
+			}
+			if err := dest.RemoveAll(child); err != nil {
+				return false, err
+			}
+			files.Remove(child)
+		}
+		return true, nil
+	}
 
-	case tar.TypeLink:
-		return e.extractHardlink(header, target, destDir)
+	target := strings.TrimPrefix(base, whiteoutPrefix)
+	if target == "" || target == "." || target == ".." {
+		return false, reject("invalid whiteout: %s", header.Name)
+	}
+	target = path.Join(dir, target)
+	if err := dest.RemoveAll(target); err != nil {
+		return false, err
+	}
+	files.Remove(target)
+	return true, nil
+}
 
-	default:
-		// Skip unsupported file types
+func (e *Extractor) extractFile(tarReader *tar.Reader, header *tar.Header, dest root, files *manifest.Builder) error {
+	if header.Typeflag == tar.TypeXGlobalHeader {
 		return nil
 	}
-}
 
-func (e *Extractor) validatePath(name, destDir string) error {
-	// Skip current directory entries
-	if name == "." || name == "./" {
+	typ, known := entryType(header.Typeflag)
+	if !known || !e.policy.allows(typ) {
+		if e.policy.RejectDisallowed {
+			return reject("entry type not allowed: %s (type %q)", header.Name, header.Typeflag)
+		}
 		return nil
 	}
 
-	// Prevent path traversal
-	if strings.Contains(name, "..") {
-		return fmt.Errorf("path traversal attempt: %s", name)
+	// Security checks
+	parts, err := splitName(header.Name)
+	if err != nil {
+		return err
+	}
+
+	if header.Size > e.policy.MaxFileSize {
+		return reject("file %s too large: %d bytes (max %d)", header.Name, header.Size, e.policy.MaxFileSize)
 	}
 
-	// Prevent absolute paths
-	if filepath.IsAbs(name) {
-		return fmt.Errorf("absolute path not allowed: %s", name)
+	mode, err := e.fileMode(header)
+	if err != nil {
+		return err
 	}
 
-	// Clean and check final path is within destination
-	target := filepath.Clean(filepath.Join(destDir, name))
-	destClean := filepath.Clean(destDir)
-	if !strings.HasPrefix(target, destClean) {
-		return fmt.Errorf("path outside destination: %s", name)
+	entry := manifest.Entry{
+		Path: strings.Join(parts, "/"),
+		Type: string(typ),
+		Mode: fmt.Sprintf("%04o", modeBits(mode)),
+	}
+	if entry.Path == "" {
+		entry.Path = "."
 	}
 
-	return nil
-}
+	switch typ {
+	case TypeDir:
+		if err := dest.Mkdir(header.Name); err != nil {
+			return err
+		}
+		files.Add(entry)
+		return nil
+
+	case TypeFile:
+		size, digest, err := e.extractRegularFile(tarReader, header, dest)
+		if err != nil {
+			return err
+		}
+		entry.Size = size
+		entry.SHA256 = digest
+
+	case TypeSymlink:
+		if err := validateSymlink(header.Name, header.Linkname); err != nil {
+			return err
+		}
+		if err := dest.Symlink(header.Linkname, header.Name); err != nil {
+			return err
+		}
+		entry.Linkname = header.Linkname
+
+	case TypeHardlink:
+		linkParts, err := splitName(header.Linkname)
+		if err != nil {
+			return reject("hardlink outside destination: %s -> %s", header.Name, header.Linkname)
+		}
+		if err := dest.Link(header.Linkname, header.Name); err != nil {
+			return err
+		}
+		// A hardlink shares the target's inode, so it reports its content.
+		entry.Linkname = strings.Join(linkParts, "/")
+		if target, ok := files.Get(entry.Linkname); ok {
+			entry.Mode, entry.Size, entry.SHA256 = target.Mode, target.Size, target.SHA256
+		}
+		files.Add(entry)
+		return nil
+
+	case TypeChar, TypeBlock, TypeFIFO:
+		if err := dest.Mknod(header.Name, header); err != nil {
+			return err
+		}
+	}
 
-func (e *Extractor) extractRegularFile(tarReader *tar.Reader, target string, header *tar.Header) error {
-	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+	if err := e.applyMetadata(header, dest); err != nil {
 		return err
 	}
+	files.Add(entry)
+	return nil
+}
 
-	file, err := os.Create(target)
+func (e *Extractor) extractRegularFile(tarReader *tar.Reader, header *tar.Header, dest root) (int64, string, error) {
+	file, err := dest.Create(header.Name)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 	defer file.Close()
 
 	// Limit copy to prevent zip bombs
-	limited := io.LimitReader(tarReader, e.maxFileSize)
-	if _, err := io.Copy(file, limited); err != nil {
-		return err
+	limited := io.LimitReader(tarReader, e.policy.MaxFileSize)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), limited)
+	if err != nil {
+		return 0, "", err
 	}
+	return size, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
 
-	// Set file permissions (but limit them)
-	mode := header.FileInfo().Mode() & 0777
-	if mode&0111 != 0 {
-		mode = 0755 // Executable
-	} else {
-		mode = 0644 // Regular file
+// modeBits converts a FileMode into the octal permission bits used by tar
+// and chmod(1), including setuid, setgid and sticky.
+func modeBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
 	}
-	return os.Chmod(target, mode)
+	return bits
 }
 
-func (e *Extractor) extractSymlink(header *tar.Header, target, destDir string) error {
-	// Validate symlink target
-	linkTarget := header.Linkname
-	if filepath.IsAbs(linkTarget) {
-		return fmt.Errorf("absolute symlink not allowed: %s -> %s", header.Name, linkTarget)
+// fileMode returns the permission bits to apply to an entry, honouring the
+// policy's mode preservation and setuid/setgid rules.
+func (e *Extractor) fileMode(header *tar.Header) (os.FileMode, error) {
+	mode := header.FileInfo().Mode()
+	perm := mode.Perm()
+	special := mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	if !e.policy.PreserveMode {
+		if header.Typeflag == tar.TypeDir || perm&0111 != 0 {
+			perm = 0755 // Executable
+		} else {
+			perm = 0644 // Regular file
+		}
+		special &^= os.ModeSticky
 	}
-
-	// Resolve symlink and check it's within destDir
-	resolved := filepath.Join(filepath.Dir(target), linkTarget)
-	if !strings.HasPrefix(resolved, destDir) {
-		return fmt.Errorf("symlink outside destination: %s -> %s", header.Name, linkTarget)
+	if e.policy.ReadOnly && header.Typeflag != tar.TypeDir {
+		perm &^= 0222
 	}
 
-	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-		return err
+	if setid := special & (os.ModeSetuid | os.ModeSetgid); setid != 0 {
+		switch e.policy.Setid {
+		case SetidReject:
+			return 0, reject("setuid/setgid entry not allowed: %s", header.Name)
+		case SetidStrip:
+			special &^= setid
+		}
 	}
 
-	return os.Symlink(linkTarget, target)
+	return perm | special, nil
 }
 
-func (e *Extractor) extractHardlink(header *tar.Header, target, destDir string) error {
-	linkTarget := filepath.Join(destDir, header.Linkname)
-	
-	// Validate hardlink target is within destDir
-	if !strings.HasPrefix(linkTarget, destDir) {
-		return fmt.Errorf("hardlink outside destination: %s -> %s", header.Name, header.Linkname)
+// applyMetadata restores ownership, mode, xattrs and times in that order:
+// chown clears setuid bits and file capabilities, so it has to come first.
+func (e *Extractor) applyMetadata(header *tar.Header, dest root) error {
+	symlink := header.Typeflag == tar.TypeSymlink
+
+	if e.policy.PreserveOwner {
+		if err := dest.Lchown(header.Name, header.Uid, header.Gid); err != nil {
+			return err
+		}
+	}
+
+	if !symlink {
+		mode, err := e.fileMode(header)
+		if err != nil {
+			return err
+		}
+		if err := dest.Chmod(header.Name, mode); err != nil {
+			return err
+		}
 	}
 
-	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-		return err
+	if e.policy.Xattrs {
+		for key, value := range header.PAXRecords {
+			name := strings.TrimPrefix(key, "SCHILY.xattr.")
+			if name == key || !e.priv.canSetXattr(name, symlink) {
+				continue
+			}
+			if err := dest.Lsetxattr(header.Name, name, value); err != nil {
+				return fmt.Errorf("xattr %s on %s: %v", name, header.Name, err)
+			}
+		}
 	}
 
-	return os.Link(linkTarget, target)
-}
\ No newline at end of file
+	if e.policy.PreserveTimes {
+		atime := header.AccessTime
+		if atime.IsZero() {
+			atime = header.ModTime
+		}
+		if err := dest.Lchtimes(header.Name, atime, header.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
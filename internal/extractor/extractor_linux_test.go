@@ -0,0 +1,48 @@
+package extractor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// stat returns the owner and device numbers of path, without following a
+// symlink.
+func stat(t *testing.T, path string) (uid, gid int, major, minor uint32) {
+	t.Helper()
+
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return int(st.Uid), int(st.Gid), unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+}
+
+func getxattr(t *testing.T, path, name string) string {
+	t.Helper()
+
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		t.Fatalf("xattr %s on %s: %v", name, path, err)
+	}
+	return string(buf[:n])
+}
+
+// skipWithoutXattrs skips the test when dir's filesystem has no user
+// xattrs.
+func skipWithoutXattrs(t *testing.T, dir string) {
+	t.Helper()
+
+	probe := filepath.Join(dir, ".xattr-probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe)
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); errors.Is(err, unix.ENOTSUP) {
+		t.Skip("no xattrs on", dir)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package extractor
+
+import "testing"
+
+func stat(t *testing.T, path string) (uid, gid int, major, minor uint32) {
+	t.Skip("faithful restore is only tested on Linux")
+	return
+}
+
+func getxattr(t *testing.T, path, name string) string {
+	t.Skip("faithful restore is only tested on Linux")
+	return ""
+}
+
+func skipWithoutXattrs(t *testing.T, dir string) {
+	t.Skip("faithful restore is only tested on Linux")
+}
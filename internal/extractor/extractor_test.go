@@ -0,0 +1,464 @@
+package extractor
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imgstore/internal/manifest"
+)
+
+type entry struct {
+	name     string
+	typ      byte
+	linkname string
+	body     string
+	mode     int64
+	size     int64 // overrides len(body) in the header when set
+}
+
+func writeArchive(t *testing.T, entries []entry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:     ent.name,
+			Typeflag: ent.typ,
+			Linkname: ent.linkname,
+			Mode:     ent.mode,
+			Size:     int64(len(ent.body)),
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if ent.typ != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if ent.size > 0 {
+			hdr.Size = ent.size
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			body := []byte(ent.body)
+			if ent.size > 0 {
+				body = make([]byte, ent.size)
+			}
+			if _, err := tw.Write(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "archive.tar")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sandbox lays out <tmp>/store/img as the destination, next to a sibling
+// <tmp>/store/img2 and an <tmp>/outside directory that must stay untouched.
+func sandbox(t *testing.T) (dest, outside string) {
+	t.Helper()
+
+	base := t.TempDir()
+	dest = filepath.Join(base, "store", "img")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{dest, filepath.Join(base, "store", "img2"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dest, outside
+}
+
+func assertUntouched(t *testing.T, dest, outside string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(outside, "passwd"))
+	if err != nil || string(data) != "original" {
+		t.Errorf("outside/passwd modified: %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("outside has %d entries, want 1", len(entries))
+	}
+	sibling, err := os.ReadDir(filepath.Join(filepath.Dir(dest), "img2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sibling) != 0 {
+		t.Errorf("sibling img2 has %d entries, want 0", len(sibling))
+	}
+}
+
+func TestExtractRejectsAdversarialArchives(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []entry
+	}{
+		{"parent traversal", []entry{
+			{name: "../../outside/passwd", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"nested traversal", []entry{
+			{name: "etc/../../../outside/passwd", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"absolute path", []entry{
+			{name: "/etc/passwd", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"sibling prefix", []entry{
+			{name: "../img2/file", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"absolute symlink", []entry{
+			{name: "symlink-attack", typ: tar.TypeSymlink, linkname: "/etc/passwd"},
+		}},
+		{"relative symlink escape", []entry{
+			{name: "a/b/link", typ: tar.TypeSymlink, linkname: "../../../outside"},
+		}},
+		{"symlink to sibling prefix", []entry{
+			{name: "link", typ: tar.TypeSymlink, linkname: "../img2"},
+		}},
+		{"write through earlier symlink", []entry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "link", typ: tar.TypeSymlink, linkname: "sub"},
+			{name: "link/file", typ: tar.TypeReg, body: "through"},
+		}},
+		{"directory over symlink", []entry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "link", typ: tar.TypeSymlink, linkname: "sub"},
+			{name: "link/", typ: tar.TypeDir, mode: 0755},
+		}},
+		{"hardlink traversal", []entry{
+			{name: "hard", typ: tar.TypeLink, linkname: "../outside/passwd"},
+		}},
+		{"hardlink absolute", []entry{
+			{name: "hard", typ: tar.TypeLink, linkname: "/etc/passwd"},
+		}},
+		{"hardlink through symlink", []entry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "sub/file", typ: tar.TypeReg, body: "data"},
+			{name: "link", typ: tar.TypeSymlink, linkname: "sub"},
+			{name: "hard", typ: tar.TypeLink, linkname: "link/file"},
+		}},
+		{"hardlink to missing", []entry{
+			{name: "hard", typ: tar.TypeLink, linkname: "nope"},
+		}},
+		{"file replacing directory", []entry{
+			{name: "dir/", typ: tar.TypeDir, mode: 0755},
+			{name: "dir", typ: tar.TypeReg, body: "x"},
+		}},
+		{"large file", []entry{
+			{name: "largefile", typ: tar.TypeReg, size: 2048},
+		}},
+	}
+
+	policy := DefaultPolicy()
+	policy.MaxFileSize = 1024
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dest, outside := sandbox(t)
+			archive := writeArchive(t, tc.entries)
+
+			if _, err := NewWithPolicy(policy).Extract(archive, dest); err == nil {
+				t.Error("Extract succeeded, want error")
+			}
+			assertUntouched(t, dest, outside)
+		})
+	}
+}
+
+func TestExtractTooManyFiles(t *testing.T) {
+	dest, outside := sandbox(t)
+	archive := writeArchive(t, []entry{
+		{name: "a", typ: tar.TypeReg, body: "1"},
+		{name: "b", typ: tar.TypeReg, body: "2"},
+		{name: "c", typ: tar.TypeReg, body: "3"},
+	})
+
+	policy := DefaultPolicy()
+	policy.MaxFiles = 2
+	if _, err := NewWithPolicy(policy).Extract(archive, dest); err == nil || !strings.Contains(err.Error(), "too many files") {
+		t.Errorf("Extract error = %v, want too many files", err)
+	}
+	assertUntouched(t, dest, outside)
+}
+
+func TestExtractReplacesSymlinkInsteadOfWritingThrough(t *testing.T) {
+	dest, outside := sandbox(t)
+	archive := writeArchive(t, []entry{
+		{name: "target", typ: tar.TypeReg, body: "keep"},
+		{name: "link", typ: tar.TypeSymlink, linkname: "target"},
+		{name: "link", typ: tar.TypeReg, body: "replaced"},
+	})
+
+	if _, err := New().Extract(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	assertUntouched(t, dest, outside)
+
+	if data, _ := os.ReadFile(filepath.Join(dest, "target")); string(data) != "keep" {
+		t.Errorf("target = %q, want keep", data)
+	}
+	fi, err := os.Lstat(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("link mode = %v, want regular file", fi.Mode())
+	}
+}
+
+func TestExtractAcceptsBenignArchive(t *testing.T) {
+	dest, outside := sandbox(t)
+	archive := writeArchive(t, []entry{
+		{name: "./", typ: tar.TypeDir, mode: 0755},
+		{name: "./bin/", typ: tar.TypeDir, mode: 0755},
+		{name: "./bin/hello", typ: tar.TypeReg, body: "#!/bin/sh\n", mode: 04755},
+		{name: "./etc/passwd", typ: tar.TypeReg, body: "test:x:1000:1000::/:/bin/sh\n"},
+		{name: "./etc/foo..bar", typ: tar.TypeReg, body: "dots are fine"},
+		{name: "./bin/sh", typ: tar.TypeSymlink, linkname: "hello"},
+		{name: "./usr/bin/up", typ: tar.TypeSymlink, linkname: "../../bin/hello"},
+		{name: "./bin/hello2", typ: tar.TypeLink, linkname: "./bin/hello"},
+		{name: "./dev/null", typ: tar.TypeChar},
+	})
+
+	files, err := New().Extract(archive, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUntouched(t, dest, outside)
+
+	byPath := make(map[string]manifest.Entry)
+	for _, f := range files {
+		byPath[f.Path] = f
+	}
+	hello := byPath["bin/hello"]
+	if hello.Type != "file" || hello.Mode != "0755" || hello.Size != 10 || hello.SHA256 == "" {
+		t.Errorf("manifest bin/hello = %+v", hello)
+	}
+	if hello2 := byPath["bin/hello2"]; hello2.Type != "hardlink" || hello2.Linkname != "bin/hello" || hello2.SHA256 != hello.SHA256 {
+		t.Errorf("manifest bin/hello2 = %+v", hello2)
+	}
+	if up := byPath["usr/bin/up"]; up.Type != "symlink" || up.Linkname != "../../bin/hello" {
+		t.Errorf("manifest usr/bin/up = %+v", up)
+	}
+	if _, ok := byPath["dev/null"]; ok {
+		t.Error("skipped device node listed in manifest")
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "bin", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0755 {
+		t.Errorf("bin/hello mode = %v, want setuid stripped to 0755", fi.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etc", "foo..bar")); err != nil {
+		t.Error(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "usr", "bin", "up")); err != nil || link != "../../bin/hello" {
+		t.Errorf("usr/bin/up -> %q, %v", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "dev", "null")); !os.IsNotExist(err) {
+		t.Errorf("device node extracted under default policy: %v", err)
+	}
+}
+
+func TestExtractPolicy(t *testing.T) {
+	archive := writeArchive(t, []entry{
+		{name: "fifo", typ: tar.TypeFifo},
+		{name: "suid", typ: tar.TypeReg, body: "x", mode: 04755},
+	})
+
+	reject := DefaultPolicy()
+	reject.RejectDisallowed = true
+	dest, _ := sandbox(t)
+	if _, err := NewWithPolicy(reject).Extract(archive, dest); err == nil {
+		t.Error("disallowed fifo accepted with reject_disallowed")
+	}
+
+	setid := DefaultPolicy()
+	setid.AllowedTypes = append(setid.AllowedTypes, TypeFIFO)
+	setid.Setid = SetidReject
+	dest, _ = sandbox(t)
+	if _, err := NewWithPolicy(setid).Extract(archive, dest); err == nil {
+		t.Error("setuid entry accepted with setid=reject")
+	}
+
+	preserve := setid
+	preserve.Setid = SetidPreserve
+	preserve.PreserveMode = true
+	dest, _ = sandbox(t)
+	if _, err := NewWithPolicy(preserve).Extract(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dest, "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo not created: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "suid")); err != nil || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("setuid bit not preserved: %v", err)
+	}
+}
+
+// capability is a VFS_CAP_REVISION_2 security.capability value granting an
+// effective CAP_NET_RAW.
+var capability = string([]byte{0x01, 0, 0, 0x02, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+func TestExtractFaithful(t *testing.T) {
+	priv := DetectPrivileges()
+	if !priv.Root {
+		t.Skip("faithful restore needs root")
+	}
+	dest, _ := sandbox(t)
+	skipWithoutXattrs(t, dest)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 04711, Size: 4, Uid: 1234, Gid: 5678, ModTime: mtime, Format: tar.FormatPAX,
+			PAXRecords: map[string]string{"SCHILY.xattr.security.capability": capability, "SCHILY.xattr.user.note": "ping"}},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime},
+		{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0, Gid: 6, ModTime: mtime},
+		{Name: "dev/initctl", Typeflag: tar.TypeFifo, Mode: 0600, Uid: 42, Gid: 42, ModTime: mtime},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWithPolicy(FaithfulPolicy()).ExtractReader(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := filepath.Join(dest, "bin", "ping")
+	fi, err := os.Lstat(ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSetuid == 0 || fi.Mode().Perm() != 0711 {
+		t.Errorf("bin/ping mode %v, want setuid 0711", fi.Mode())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("bin/ping mtime %v, want %v", fi.ModTime(), mtime)
+	}
+	if uid, gid, _, _ := stat(t, ping); uid != 1234 || gid != 5678 {
+		t.Errorf("bin/ping owned by %d:%d, want 1234:5678", uid, gid)
+	}
+	if got := getxattr(t, ping, "user.note"); got != "ping" {
+		t.Errorf("user.note = %q", got)
+	}
+	// Inside a user namespace the kernel rewrites capabilities for its root.
+	if !priv.UserNS {
+		if got := getxattr(t, ping, "security.capability"); got != capability {
+			t.Errorf("security.capability = %x, want %x", got, capability)
+		}
+	}
+
+	fifo := filepath.Join(dest, "dev", "initctl")
+	if fi, err := os.Lstat(fifo); err != nil || fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("dev/initctl = %v, %v", fi, err)
+	}
+	if uid, gid, _, _ := stat(t, fifo); uid != 42 || gid != 42 {
+		t.Errorf("dev/initctl owned by %d:%d, want 42:42", uid, gid)
+	}
+	if priv.UserNS {
+		return
+	}
+	for _, dev := range []struct {
+		name         string
+		mode         os.FileMode
+		major, minor uint32
+		gid          int
+	}{
+		{"null", os.ModeDevice | os.ModeCharDevice | 0666, 1, 3, 0},
+		{"loop0", os.ModeDevice | 0660, 7, 0, 6},
+	} {
+		path := filepath.Join(dest, "dev", dev.name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != dev.mode || !fi.ModTime().Equal(mtime) {
+			t.Errorf("dev/%s mode %v mtime %v, want %v", dev.name, fi.Mode(), fi.ModTime(), dev.mode)
+		}
+		if _, gid, major, minor := stat(t, path); major != dev.major || minor != dev.minor || gid != dev.gid {
+			t.Errorf("dev/%s is %d:%d group %d, want %d:%d group %d", dev.name, major, minor, gid, dev.major, dev.minor, dev.gid)
+		}
+	}
+}
+
+func TestExtractLayerAppliesWhiteouts(t *testing.T) {
+	dest, outside := sandbox(t)
+	base, err := New().Extract(writeArchive(t, []entry{
+		{name: "keep", typ: tar.TypeReg, body: "keep"},
+		{name: "gone", typ: tar.TypeReg, body: "gone"},
+		{name: "dir/old", typ: tar.TypeReg, body: "old"},
+		{name: "tree/a/b", typ: tar.TypeReg, body: "b"},
+	}), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer := writeArchive(t, []entry{
+		{name: ".wh.gone", typ: tar.TypeReg},
+		{name: "dir/", typ: tar.TypeDir, mode: 0755},
+		{name: "dir/.wh..wh..opq", typ: tar.TypeReg},
+		{name: "dir/new", typ: tar.TypeReg, body: "new"},
+		{name: ".wh.tree", typ: tar.TypeReg},
+	})
+	files, err := New().ExtractLayer(layer, dest, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUntouched(t, dest, outside)
+
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	if got, want := strings.Join(paths, " "), "dir dir/new keep"; got != want {
+		t.Errorf("manifest paths = %q, want %q", got, want)
+	}
+	for _, gone := range []string{"gone", "dir/old", "tree"} {
+		if _, err := os.Lstat(filepath.Join(dest, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s still present: %v", gone, err)
+		}
+	}
+
+	for _, bad := range []string{".wh..", "../.wh.outside", ".wh."} {
+		archive := writeArchive(t, []entry{{name: bad, typ: tar.TypeReg}})
+		if _, err := New().ExtractLayer(archive, dest, nil); err == nil {
+			t.Errorf("whiteout %q accepted", bad)
+		}
+	}
+	assertUntouched(t, dest, outside)
+}
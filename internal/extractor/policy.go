@@ -0,0 +1,124 @@
+package extractor
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+)
+
+type EntryType string
+
+const (
+	TypeFile     EntryType = "file"
+	TypeDir      EntryType = "dir"
+	TypeSymlink  EntryType = "symlink"
+	TypeHardlink EntryType = "hardlink"
+	TypeChar     EntryType = "char"
+	TypeBlock    EntryType = "block"
+	TypeFIFO     EntryType = "fifo"
+)
+
+type SetidMode string
+
+const (
+	SetidStrip    SetidMode = "strip"    // clear setuid/setgid bits
+	SetidPreserve SetidMode = "preserve" // keep them as recorded in the archive
+	SetidReject   SetidMode = "reject"   // fail the extraction
+)
+
+type ExtractionPolicy struct {
+	MaxFileSize      int64       `json:"max_file_size"`
+	MaxFiles         int         `json:"max_files"`
+	AllowedTypes     []EntryType `json:"allowed_types"`
+	RejectDisallowed bool        `json:"reject_disallowed"`
+	Setid            SetidMode   `json:"setid"`
+	PreserveMode     bool        `json:"preserve_mode"`
+	PreserveOwner    bool        `json:"preserve_owner"`
+	PreserveTimes    bool        `json:"preserve_times"`
+	Xattrs           bool        `json:"xattrs"`
+
+	// ReadOnly clears the write bits of every file that is not a dir, so
+	// that files hardlinked between trees cannot be changed through one.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+func DefaultPolicy() ExtractionPolicy {
+	return ExtractionPolicy{
+		MaxFileSize:  100 * 1024 * 1024, // 100MB per file
+		MaxFiles:     10000,             // Max files per archive
+		AllowedTypes: []EntryType{TypeFile, TypeDir, TypeSymlink, TypeHardlink},
+		Setid:        SetidStrip,
+	}
+}
+
+// FaithfulPolicy restores everything recorded in the archive, which is what
+// a usable container root needs when the store runs privileged.
+func FaithfulPolicy() ExtractionPolicy {
+	p := DefaultPolicy()
+	p.AllowedTypes = []EntryType{TypeFile, TypeDir, TypeSymlink, TypeHardlink, TypeChar, TypeBlock, TypeFIFO}
+	p.Setid = SetidPreserve
+	p.PreserveMode = true
+	p.PreserveOwner = true
+	p.PreserveTimes = true
+	p.Xattrs = true
+	return p
+}
+
+// UnmarshalJSON starts from DefaultPolicy so that profiles in the config
+// file only need to list the settings they change.
+func (p *ExtractionPolicy) UnmarshalJSON(data []byte) error {
+	type plain ExtractionPolicy
+	*p = DefaultPolicy()
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+func (p ExtractionPolicy) Validate() error {
+	if p.MaxFileSize <= 0 {
+		return fmt.Errorf("max_file_size must be positive")
+	}
+	if p.MaxFiles <= 0 {
+		return fmt.Errorf("max_files must be positive")
+	}
+	for _, t := range p.AllowedTypes {
+		switch t {
+		case TypeFile, TypeDir, TypeSymlink, TypeHardlink, TypeChar, TypeBlock, TypeFIFO:
+		default:
+			return fmt.Errorf("unknown entry type %q", t)
+		}
+	}
+	switch p.Setid {
+	case SetidStrip, SetidPreserve, SetidReject:
+	default:
+		return fmt.Errorf("unknown setid mode %q", p.Setid)
+	}
+	return nil
+}
+
+func (p ExtractionPolicy) allows(t EntryType) bool {
+	for _, allowed := range p.AllowedTypes {
+		if allowed == t {
+			return true
+		}
+	}
+	return false
+}
+
+func entryType(flag byte) (EntryType, bool) {
+	switch flag {
+	case tar.TypeReg:
+		return TypeFile, true
+	case tar.TypeDir:
+		return TypeDir, true
+	case tar.TypeSymlink:
+		return TypeSymlink, true
+	case tar.TypeLink:
+		return TypeHardlink, true
+	case tar.TypeChar:
+		return TypeChar, true
+	case tar.TypeBlock:
+		return TypeBlock, true
+	case tar.TypeFifo:
+		return TypeFIFO, true
+	}
+	return "", false
+}
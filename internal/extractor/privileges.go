@@ -0,0 +1,39 @@
+package extractor
+
+import "strings"
+
+type Privileges struct {
+	Root   bool // effective uid 0, possibly inside a user namespace
+	UserNS bool // running in a non-initial user namespace
+}
+
+// Effective strips the parts of a policy that cannot be honoured with the
+// given privileges, falling back to the sanitised behaviour for them.
+func (p ExtractionPolicy) Effective(priv Privileges) ExtractionPolicy {
+	if !priv.Root {
+		p.PreserveOwner = false
+	}
+
+	allowed := make([]EntryType, 0, len(p.AllowedTypes))
+	for _, t := range p.AllowedTypes {
+		if (t == TypeChar || t == TypeBlock) && (!priv.Root || priv.UserNS) {
+			continue
+		}
+		allowed = append(allowed, t)
+	}
+	p.AllowedTypes = allowed
+	return p
+}
+
+func (priv Privileges) canSetXattr(name string, symlink bool) bool {
+	switch {
+	case strings.HasPrefix(name, "user."):
+		// The kernel only allows user.* attributes on regular files and directories.
+		return !symlink
+	case strings.HasPrefix(name, "trusted."):
+		return priv.Root && !priv.UserNS
+	case strings.HasPrefix(name, "security."):
+		return priv.Root
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+package extractor
+
+import (
+	"os"
+	"strings"
+)
+
+func DetectPrivileges() Privileges {
+	priv := Privileges{Root: os.Geteuid() == 0}
+
+	// The initial user namespace maps the whole uid range onto itself.
+	if data, err := os.ReadFile("/proc/self/uid_map"); err == nil {
+		fields := strings.Fields(string(data))
+		priv.UserNS = len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+	}
+	return priv
+}
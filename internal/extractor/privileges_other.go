@@ -0,0 +1,9 @@
+//go:build !linux
+
+package extractor
+
+import "os"
+
+func DetectPrivileges() Privileges {
+	return Privileges{Root: os.Geteuid() == 0}
+}
@@ -0,0 +1,67 @@
+package extractor
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// root performs every filesystem operation of an extraction relative to the
+// destination directory. Names are archive paths; implementations create
+// missing parent directories and never follow symlinks while resolving them,
+// so no entry can be written outside the destination.
+type root interface {
+	Mkdir(name string) error
+	Create(name string) (*os.File, error)
+	Symlink(linkname, name string) error
+	Link(oldname, name string) error
+	Mknod(name string, header *tar.Header) error
+	Lchown(name string, uid, gid int) error
+	Chmod(name string, mode os.FileMode) error
+	Lsetxattr(name, attr, value string) error
+	Lchtimes(name string, atime, mtime time.Time) error
+	ReadDir(name string) ([]string, error)
+	RemoveAll(name string) error
+	Close() error
+}
+
+// splitName turns an archive path into its components. Absolute paths and
+// ".." components are rejected; "." and empty components are dropped.
+func splitName(name string) ([]string, error) {
+	if strings.HasPrefix(name, "/") {
+		return nil, reject("absolute path not allowed: %s", name)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return nil, reject("path traversal attempt: %s", name)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// validateSymlink checks that a symlink target, interpreted relative to the
+// directory holding the link, stays inside the extraction root.
+func validateSymlink(name, linkname string) error {
+	if path.IsAbs(linkname) {
+		return reject("absolute symlink not allowed: %s -> %s", name, linkname)
+	}
+
+	parts, err := splitName(name)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(append([]string{"."}, parts...)...)
+	resolved := path.Join(path.Dir(dir), linkname)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return reject("symlink outside destination: %s -> %s", name, linkname)
+	}
+	return nil
+}
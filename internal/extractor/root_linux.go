@@ -0,0 +1,337 @@
+package extractor
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdRoot resolves every name from a directory file descriptor one component
+// at a time with openat2(RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS), and then
+// operates on the final component with the *at syscalls. Nothing is ever
+// resolved through a host path, so symlinks created by earlier entries, or
+// swapped in concurrently, cannot redirect a write.
+type fdRoot struct {
+	fd int
+}
+
+// openat2Missing is set once the kernel reports ENOSYS (before 5.6); single
+// component lookups with O_NOFOLLOW give the same guarantees there.
+var openat2Missing atomic.Bool
+
+func openRoot(dir string) (root, error) {
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return &fdRoot{fd: fd}, nil
+}
+
+func (r *fdRoot) Close() error {
+	return unix.Close(r.fd)
+}
+
+func openDirBeneath(dirfd int, name string) (int, error) {
+	if !openat2Missing.Load() {
+		fd, err := unix.Openat2(dirfd, name, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		if err != unix.ENOSYS {
+			return fd, err
+		}
+		openat2Missing.Store(true)
+	}
+	return unix.Openat(dirfd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// parent returns an fd for the directory holding name and the final path
+// component. Missing directories are created when create is set. The
+// caller must close the returned fd.
+func (r *fdRoot) parent(name string, create bool) (int, string, error) {
+	parts, err := splitName(name)
+	if err != nil {
+		return -1, "", err
+	}
+
+	dirfd, err := unix.Dup(r.fd)
+	if err != nil {
+		return -1, "", err
+	}
+	if len(parts) == 0 {
+		return dirfd, ".", nil
+	}
+
+	for _, part := range parts[:len(parts)-1] {
+		if create {
+			if err := unix.Mkdirat(dirfd, part, 0755); err != nil && err != unix.EEXIST {
+				unix.Close(dirfd)
+				return -1, "", &os.PathError{Op: "mkdir", Path: name, Err: err}
+			}
+		}
+		next, err := openDirBeneath(dirfd, part)
+		unix.Close(dirfd)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		dirfd = next
+	}
+	return dirfd, parts[len(parts)-1], nil
+}
+
+// removeExisting removes a non-directory entry that a later archive entry replaces,
+// so that the new entry is created rather than written through.
+func removeExisting(dirfd int, base, name string) error {
+	err := unix.Unlinkat(dirfd, base, 0)
+	switch err {
+	case nil, unix.ENOENT:
+		return nil
+	case unix.EISDIR:
+		return reject("cannot replace directory: %s", name)
+	}
+	return &os.PathError{Op: "unlink", Path: name, Err: err}
+}
+
+func (r *fdRoot) Mkdir(name string) error {
+	dirfd, base, err := r.parent(name, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if base == "." {
+		return nil
+	}
+	if err := unix.Mkdirat(dirfd, base, 0755); err != unix.EEXIST {
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		return nil
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return reject("not a directory: %s", name)
+	}
+	return nil
+}
+
+func (r *fdRoot) Create(name string) (*os.File, error) {
+	dirfd, base, err := r.parent(name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+
+	if err := removeExisting(dirfd, base, name); err != nil {
+		return nil, err
+	}
+	fd, err := unix.Openat(dirfd, base, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (r *fdRoot) Symlink(linkname, name string) error {
+	dirfd, base, err := r.parent(name, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if err := removeExisting(dirfd, base, name); err != nil {
+		return err
+	}
+	if err := unix.Symlinkat(linkname, dirfd, base); err != nil {
+		return &os.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) Link(oldname, name string) error {
+	olddirfd, oldbase, err := r.parent(oldname, false)
+	if err != nil {
+		return reject("hardlink outside destination: %s -> %s: %v", name, oldname, err)
+	}
+	defer unix.Close(olddirfd)
+
+	dirfd, base, err := r.parent(name, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if err := removeExisting(dirfd, base, name); err != nil {
+		return err
+	}
+	// Flags 0: a symlink target is linked itself, never followed.
+	if err := unix.Linkat(olddirfd, oldbase, dirfd, base, 0); err != nil {
+		return &os.PathError{Op: "link", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) Mknod(name string, header *tar.Header) error {
+	dirfd, base, err := r.parent(name, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if err := removeExisting(dirfd, base, name); err != nil {
+		return err
+	}
+
+	mode := uint32(header.Mode & 0777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	if err := unix.Mknodat(dirfd, base, mode, int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) Lchown(name string, uid, gid int) error {
+	dirfd, base, err := r.parent(name, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if err := unix.Fchownat(dirfd, base, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lchown", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) Chmod(name string, mode os.FileMode) error {
+	dirfd, base, err := r.parent(name, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	// fchmodat cannot refuse to follow a final symlink on Linux, so check
+	// the entry type on the same directory fd first.
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return nil
+	}
+
+	if err := unix.Fchmodat(dirfd, base, modeBits(mode), 0); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) Lsetxattr(name, attr, value string) error {
+	dirfd, base, err := r.parent(name, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	// There is no lsetxattrat; go through the fd's magic link so the parent
+	// is never resolved by path again.
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, base)
+	return unix.Lsetxattr(procPath, attr, []byte(value), 0)
+}
+
+func (r *fdRoot) Lchtimes(name string, atime, mtime time.Time) error {
+	dirfd, base, err := r.parent(name, false)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(dirfd, base, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (r *fdRoot) ReadDir(name string) ([]string, error) {
+	dirfd, base, err := r.parent(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+
+	fd, err := unix.Openat(dirfd, base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+func (r *fdRoot) RemoveAll(name string) error {
+	dirfd, base, err := r.parent(name, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+
+	if base == "." {
+		return reject("cannot remove extraction root")
+	}
+	if err := removeAllAt(dirfd, base); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// removeAllAt deletes base below dirfd recursively without following
+// symlinks: directories are opened with O_NOFOLLOW and emptied through their
+// own fd.
+func removeAllAt(dirfd int, base string) error {
+	err := unix.Unlinkat(dirfd, base, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR {
+		return err
+	}
+
+	fd, err := unix.Openat(dirfd, base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), base)
+	names, err := dir.Readdirnames(-1)
+	if err == nil {
+		for _, name := range names {
+			if err = removeAllAt(fd, name); err != nil {
+				break
+			}
+		}
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	return unix.Unlinkat(dirfd, base, unix.AT_REMOVEDIR)
+}
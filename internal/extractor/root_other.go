@@ -0,0 +1,221 @@
+//go:build !linux
+
+package extractor
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pathRoot is the portable fallback for platforms without openat2. It walks
+// every parent component with Lstat and refuses to pass through symlinks,
+// which confines writes to the destination as long as nothing else modifies
+// the tree during extraction.
+type pathRoot struct {
+	dir string
+}
+
+func openRoot(dir string) (root, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	return &pathRoot{dir: dir}, nil
+}
+
+func (r *pathRoot) Close() error {
+	return nil
+}
+
+func (r *pathRoot) resolve(name string, create bool) (string, error) {
+	parts, err := splitName(name)
+	if err != nil {
+		return "", err
+	}
+
+	current := r.dir
+	for i, part := range parts {
+		if strings.ContainsRune(part, filepath.Separator) || filepath.VolumeName(part) != "" {
+			return "", reject("invalid path component in %s", name)
+		}
+		current = filepath.Join(current, part)
+		if i == len(parts)-1 {
+			break
+		}
+
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(current, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", reject("path component is not a directory: %s", name)
+		}
+	}
+	return current, nil
+}
+
+func removeExisting(target, name string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return reject("cannot replace directory: %s", name)
+	}
+	return os.Remove(target)
+}
+
+func (r *pathRoot) Mkdir(name string) error {
+	target, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return reject("not a directory: %s", name)
+	}
+	return nil
+}
+
+func (r *pathRoot) Create(name string) (*os.File, error) {
+	target, err := r.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeExisting(target, name); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (r *pathRoot) Symlink(linkname, name string) error {
+	target, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if err := removeExisting(target, name); err != nil {
+		return err
+	}
+	return os.Symlink(linkname, target)
+}
+
+func (r *pathRoot) Link(oldname, name string) error {
+	source, err := r.resolve(oldname, false)
+	if err != nil {
+		return reject("hardlink outside destination: %s -> %s: %v", name, oldname, err)
+	}
+	target, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if err := removeExisting(target, name); err != nil {
+		return err
+	}
+	return os.Link(source, target)
+}
+
+func (r *pathRoot) Mknod(name string, header *tar.Header) error {
+	target, err := r.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if err := removeExisting(target, name); err != nil {
+		return err
+	}
+	return mknod(target, header)
+}
+
+func (r *pathRoot) Lchown(name string, uid, gid int) error {
+	target, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(target, uid, gid)
+}
+
+func (r *pathRoot) Chmod(name string, mode os.FileMode) error {
+	target, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+func (r *pathRoot) Lsetxattr(name, attr, value string) error {
+	target, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return setXattr(target, attr, value)
+}
+
+func (r *pathRoot) Lchtimes(name string, atime, mtime time.Time) error {
+	target, err := r.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return lchtimes(target, atime, mtime)
+}
+
+func (r *pathRoot) ReadDir(name string) ([]string, error) {
+	target, err := r.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", name)
+	}
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (r *pathRoot) RemoveAll(name string) error {
+	target, err := r.resolve(name, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if target == r.dir {
+		return reject("cannot remove extraction root")
+	}
+	// os.RemoveAll removes symlinks themselves rather than following them.
+	return os.RemoveAll(target)
+}
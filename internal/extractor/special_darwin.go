@@ -0,0 +1,20 @@
+package extractor
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+func mknod(target string, header *tar.Header) error {
+	mode := uint32(header.Mode & 0777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+	return unix.Mknod(target, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package extractor
+
+import (
+	"archive/tar"
+)
+
+func mknod(target string, header *tar.Header) error {
+	return reject("special files are not supported on this platform: %s", header.Name)
+}
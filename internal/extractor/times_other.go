@@ -0,0 +1,15 @@
+//go:build !unix
+
+package extractor
+
+import (
+	"os"
+	"time"
+)
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,14 @@
+//go:build unix && !linux
+
+package extractor
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package extractor
+
+import "fmt"
+
+func setXattr(path, name, value string) error {
+	return fmt.Errorf("extended attributes are not supported on this platform")
+}
@@ -12,6 +12,10 @@ const (
 	StateActivating  State = "ACTIVATING"
 	StateActive      State = "ACTIVE"
 	StateFailed      State = "FAILED"
+
+	// StateDeleting marks an image for removal by the worker. Any other
+	// state can move to it; the row disappears once cleanup is done.
+	StateDeleting State = "DELETING"
 )
 
 type Transition struct {
@@ -27,6 +31,7 @@ var validTransitions = map[Transition]bool{
 	{StateUnpacked, StateStored}:         true,
 	{StateStored, StateActivating}:       true,
 	{StateActivating, StateActive}:       true,
+	{StateActive, StateStored}:           true,
 	{StateNew, StateFailed}:              true,
 	{StateDownloading, StateFailed}:      true,
 	{StateDownloaded, StateFailed}:       true,
@@ -37,6 +42,9 @@ var validTransitions = map[Transition]bool{
 }
 
 func CanTransition(from, to State) bool {
+	if to == StateDeleting {
+		return from != StateDeleting
+	}
 	return validTransitions[Transition{from, to}]
 }
 
@@ -59,4 +67,14 @@ func NextState(current State) State {
 	default:
 		return current
 	}
-}
\ No newline at end of file
+}
+
+// Valid reports whether s is one of the states above.
+func Valid(s State) bool {
+	switch s {
+	case StateNew, StateDownloading, StateDownloaded, StateUnpacking, StateUnpacked,
+		StateStored, StateActivating, StateActive, StateFailed, StateDeleting:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package layers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"imgstore/internal/extractor"
+	"imgstore/internal/manifest"
+	"imgstore/internal/metadata"
+	"imgstore/internal/storage"
+)
+
+var ErrNotFound = metadata.ErrNotFound
+
+// Store keeps extracted rootfs trees in layers/<id>, shared by every image
+// with the same content. An image refers to its layer through images.layer,
+// and a layer is deleted when the last image referring to it is.
+type Store struct {
+	meta   metadata.Store
+	layout *storage.Layout
+}
+
+func NewStore(meta metadata.Store, layout *storage.Layout) *Store {
+	return &Store{meta: meta, layout: layout}
+}
+
+// ID derives the layer ID of the tree built by extracting the blob checksum
+// with policy on top of the layer parent, or onto an empty dir when parent
+// is empty. The policy is part of it because it changes what is extracted.
+func ID(parent, checksum string, policy extractor.ExtractionPolicy) string {
+	encoded, _ := json.Marshal(policy)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(parent+"\n"+checksum+"\n"+string(encoded))))
+}
+
+// Has reports whether the layer has been extracted.
+func (s *Store) Has(id string) bool {
+	if _, err := s.meta.GetLayer(id); err != nil {
+		return false
+	}
+	_, err := os.Stat(s.layout.GetLayerManifestPath(id))
+	return err == nil
+}
+
+// Add moves a fully extracted staging dir into place as the layer and
+// records its manifest. If the layer appeared in the meantime, staging is
+// dropped and the existing layer kept.
+func (s *Store) Add(id, parent, checksum, staging string, files []manifest.Entry) error {
+	if s.Has(id) {
+		return os.RemoveAll(staging)
+	}
+
+	rootfs := s.layout.GetLayerPath(id)
+	if err := os.RemoveAll(filepath.Dir(rootfs)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rootfs), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, rootfs); err != nil {
+		return err
+	}
+	if err := manifest.Save(s.layout.GetLayerManifestPath(id), files); err != nil {
+		return err
+	}
+
+	var size int64
+	for _, entry := range files {
+		size += entry.Size
+	}
+	return s.meta.PutLayer(metadata.Layer{ID: id, Checksum: checksum, Parent: parent, Size: size})
+}
+
+// Link points an image at a layer.
+func (s *Store) Link(image, id string) error {
+	return s.meta.SetLayer(image, id)
+}
+
+// Layer returns the layer of an image, or "" for an image that has not been
+// unpacked or was extracted before layers were shared.
+func (s *Store) Layer(image string) (string, error) {
+	img, err := s.meta.GetImage(image)
+	return img.Layer, err
+}
+
+// Rootfs returns where the extracted tree of an image is, falling back to
+// images/<name>/rootfs for images extracted before layers were shared.
+func (s *Store) Rootfs(image string) (string, error) {
+	id, err := s.Layer(image)
+	if err != nil || id == "" {
+		return s.layout.GetImagePath(image), err
+	}
+	return s.layout.GetLayerPath(id), nil
+}
+
+// ManifestPath returns the file manifest of an image's tree.
+func (s *Store) ManifestPath(image string) (string, error) {
+	id, err := s.Layer(image)
+	if err != nil || id == "" {
+		return s.layout.GetManifestPath(image), err
+	}
+	return s.layout.GetLayerManifestPath(id), nil
+}
+
+// Refs counts the images that use a layer.
+func (s *Store) Refs(id string) (int, error) {
+	images, err := s.meta.ImagesWithLayer(id)
+	return len(images), err
+}
+
+// Release drops an image's reference to its layer and deletes the layer once
+// no other image uses it. The reference goes last, so a release that fails
+// part way is simply retried.
+func (s *Store) Release(image string) error {
+	id, err := s.Layer(image)
+	if err != nil || id == "" {
+		return err
+	}
+
+	images, err := s.meta.ImagesWithLayer(id)
+	if err != nil {
+		return err
+	}
+	refs := 0
+	for _, img := range images {
+		if img.Name != image {
+			refs++
+		}
+	}
+	if refs == 0 {
+		if err := os.RemoveAll(filepath.Dir(s.layout.GetLayerPath(id))); err != nil {
+			return err
+		}
+		if err := s.meta.DeleteLayer(id); err != nil {
+			return err
+		}
+	}
+	return s.Link(image, "")
+}
+
+// Contents counts the regular files of every layer by checksum.
+func (s *Store) Contents() (map[string]int, error) {
+	layers, err := s.meta.ListLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]int)
+	for _, layer := range layers {
+		files, err := manifest.Load(s.layout.GetLayerManifestPath(layer.ID))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range files {
+			if entry.Type == string(extractor.TypeFile) && entry.SHA256 != "" {
+				refs[entry.SHA256]++
+			}
+		}
+	}
+	return refs, nil
+}
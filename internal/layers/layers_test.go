@@ -0,0 +1,123 @@
+package layers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imgstore/internal/extractor"
+	"imgstore/internal/manifest"
+	"imgstore/internal/metadata"
+	"imgstore/internal/storage"
+)
+
+func TestID(t *testing.T) {
+	policy := extractor.DefaultPolicy()
+	id := ID("", "aaa", policy)
+	if id != ID("", "aaa", extractor.DefaultPolicy()) {
+		t.Fatal("ID is not stable")
+	}
+	for name, other := range map[string]string{
+		"parent":   ID("parent", "aaa", policy),
+		"checksum": ID("", "bbb", policy),
+		"policy":   ID("", "aaa", extractor.FaithfulPolicy()),
+	} {
+		if other == id {
+			t.Errorf("a different %s gives the same ID", name)
+		}
+	}
+	// The separator keeps parent and checksum apart.
+	if ID("a", "aa", policy) == ID("aa", "a", policy) {
+		t.Error("moving a character between parent and checksum gives the same ID")
+	}
+}
+
+func newStore(t *testing.T) (*Store, metadata.Store, *storage.Layout) {
+	t.Helper()
+
+	dir := t.TempDir()
+	meta, err := metadata.OpenSQLite(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { meta.Close() })
+	if err := meta.Migrate("../../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	layout := storage.NewLayout(filepath.Join(dir, "store"))
+	if err := layout.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(meta, layout), meta, layout
+}
+
+// staging returns an extracted tree holding one file.
+func staging(t *testing.T) (string, []manifest.Entry) {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "staging")
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc", "hostname"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, []manifest.Entry{{Path: "etc/hostname", Size: 2}}
+}
+
+func TestRelease(t *testing.T) {
+	s, meta, layout := newStore(t)
+	if _, err := meta.CreateImages(metadata.Image{Name: "a", Checksum: "aaa", State: "STORED"},
+		metadata.Image{Name: "b", Checksum: "aaa", State: "STORED"}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := ID("", "aaa", extractor.DefaultPolicy())
+	dir, files := staging(t)
+	if err := s.Add(id, "", "aaa", dir, files); err != nil {
+		t.Fatal(err)
+	}
+	// A second extraction of the same layer is dropped.
+	again, files := staging(t)
+	if err := s.Add(id, "", "aaa", again, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(again); !os.IsNotExist(err) {
+		t.Fatalf("the second staging dir was kept: %v", err)
+	}
+	for _, image := range []string{"a", "b"} {
+		if err := s.Link(image, id); err != nil {
+			t.Fatal(err)
+		}
+		if rootfs, err := s.Rootfs(image); err != nil || rootfs != layout.GetLayerPath(id) {
+			t.Fatalf("Rootfs(%s) = %s, %v", image, rootfs, err)
+		}
+	}
+	if n, err := s.Refs(id); err != nil || n != 2 {
+		t.Fatalf("Refs = %d, %v", n, err)
+	}
+
+	if err := s.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Refs(id); n != 1 || !s.Has(id) {
+		t.Fatalf("after releasing a: %d refs, layer kept %v", n, s.Has(id))
+	}
+	if layer, _ := s.Layer("a"); layer != "" {
+		t.Fatalf("a still refers to layer %s", layer)
+	}
+
+	if err := s.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(layout.GetLayerPath(id))); !os.IsNotExist(err) {
+		t.Fatalf("the layer dir outlived its last image: %v", err)
+	}
+	if _, err := meta.GetLayer(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetLayer after the last release = %v", err)
+	}
+	if err := s.Release("b"); err != nil {
+		t.Fatalf("releasing twice = %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package manifest
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+type Entry struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Mode     string `json:"mode"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"link_target,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// Builder collects entries during an extraction. An entry recorded for a
+// path that already exists replaces it, matching how the tar was applied.
+type Builder struct {
+	entries []Entry
+	index   map[string]int
+}
+
+func NewBuilder() *Builder {
+	return &Builder{index: make(map[string]int)}
+}
+
+func (b *Builder) Add(entry Entry) {
+	if i, ok := b.index[entry.Path]; ok {
+		b.entries[i] = entry
+		return
+	}
+	b.index[entry.Path] = len(b.entries)
+	b.entries = append(b.entries, entry)
+}
+
+func (b *Builder) Get(path string) (Entry, bool) {
+	i, ok := b.index[path]
+	if !ok {
+		return Entry{}, false
+	}
+	return b.entries[i], true
+}
+
+// Remove drops the entry at path and everything below it.
+func (b *Builder) Remove(path string) {
+	kept := b.entries[:0]
+	for _, entry := range b.entries {
+		if entry.Path == path || strings.HasPrefix(entry.Path, path+"/") {
+			delete(b.index, entry.Path)
+			continue
+		}
+		b.index[entry.Path] = len(kept)
+		kept = append(kept, entry)
+	}
+	b.entries = kept
+}
+
+// Entries returns the collected entries sorted by path.
+func (b *Builder) Entries() []Entry {
+	entries := make([]Entry, len(b.entries))
+	copy(entries, b.entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+func Save(path string, entries []Entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func Load(path string) ([]Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Filter keeps the entries at or below prefix, which is matched on whole
+// path components: "usr/bin" matches "usr/bin/env" but not "usr/binx".
+func Filter(entries []Entry, prefix string) []Entry {
+	prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+	if prefix == "" {
+		return entries
+	}
+
+	filtered := []Entry{}
+	for _, entry := range entries {
+		if entry.Path == prefix || strings.HasPrefix(entry.Path, prefix+"/") {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
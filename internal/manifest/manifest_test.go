@@ -0,0 +1,42 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	var entries []Entry
+	for _, p := range []string{".", "etc", "etc/hostname", "usr", "usr/bin", "usr/bin/env", "usr/binx"} {
+		entries = append(entries, Entry{Path: p})
+	}
+	all := []string{".", "etc", "etc/hostname", "usr", "usr/bin", "usr/bin/env", "usr/binx"}
+
+	for _, tt := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", all},
+		{"/", all},
+		{"etc/hostname", []string{"etc/hostname"}},
+		{"usr/bin", []string{"usr/bin", "usr/bin/env"}},
+		{"usr/bin/", []string{"usr/bin", "usr/bin/env"}},
+		{"/usr/bin", []string{"usr/bin", "usr/bin/env"}},
+		{"usr/bi", []string{}},
+		{"var", []string{}},
+		{"..", all},
+		{"../etc", []string{"etc", "etc/hostname"}},
+		{"usr/../etc", []string{"etc", "etc/hostname"}},
+	} {
+		got := []string{}
+		for _, entry := range Filter(entries, tt.prefix) {
+			got = append(got, entry.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Filter(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+	if filtered := Filter(entries, "var"); filtered == nil {
+		t.Error("Filter returned nil, which encodes as null")
+	}
+}
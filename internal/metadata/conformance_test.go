@@ -0,0 +1,460 @@
+package metadata
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"imgstore/internal/types"
+)
+
+// testStore runs the behaviour every backend has to share. open returns an
+// empty, migrated store, a new one for each subtest.
+func testStore(t *testing.T, open func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Store)
+	}{
+		{"Images", testImages},
+		{"States", testStates},
+		{"Blobs", testBlobs},
+		{"Counters", testCounters},
+		{"Layers", testLayers},
+		{"Snapshots", testSnapshots},
+		{"Pins", testPins},
+		{"Migrate", testMigrate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+func enqueue(t *testing.T, s Store, name, checksum, state string) Image {
+	t.Helper()
+	if err := s.EnqueueImage(Image{Name: name, BlobKey: "http://example/" + name, Checksum: checksum, State: state}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := s.GetImage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func names(images []Image) []string {
+	var names []string
+	for _, img := range images {
+		names = append(names, img.Name)
+	}
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testImages(t *testing.T, s Store) {
+	a := enqueue(t, s, "a", "aaa", "NEW")
+	if a.BlobKey != "http://example/a" || a.Checksum != "aaa" || a.State != "NEW" || a.Created == "" {
+		t.Fatalf("GetImage = %+v", a)
+	}
+
+	// Enqueueing an existing name leaves it alone.
+	if err := s.EnqueueImage(Image{Name: "a", Checksum: "other", State: "NEW"}); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := s.GetImage("a"); img.Checksum != "aaa" {
+		t.Fatalf("enqueue replaced the image: %+v", img)
+	}
+
+	ids, err := s.CreateImages(
+		Image{Name: "b", Checksum: "bbb", State: "DOWNLOADED", Policy: "faithful"},
+		Image{Name: "c", Checksum: "aaa", State: "DOWNLOADED", Parent: "b"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] == ids[1] || ids[0] == a.ID {
+		t.Fatalf("CreateImages = %v", ids)
+	}
+	b, err := s.GetImage("b")
+	if err != nil || b.ID != ids[0] || b.Policy != "faithful" {
+		t.Fatalf("GetImage(b) = %+v, %v", b, err)
+	}
+
+	// A taken name fails the whole batch.
+	if _, err := s.CreateImages(Image{Name: "d", State: "NEW"}, Image{Name: "a", State: "NEW"}); !errors.Is(err, ErrExists) {
+		t.Fatalf("CreateImages with a taken name: %v", err)
+	}
+	if _, err := s.GetImage("d"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetImage(d) after a failed batch: %v", err)
+	}
+
+	if n, err := s.CountImages(); err != nil || n != 3 {
+		t.Fatalf("CountImages = %d, %v", n, err)
+	}
+	all, err := s.ListImages()
+	if err != nil || !equal(names(all), []string{"a", "b", "c"}) {
+		t.Fatalf("ListImages = %v, %v", names(all), err)
+	}
+	if got, _ := s.ImagesInState("DOWNLOADED", "ACTIVE"); !equal(names(got), []string{"b", "c"}) {
+		t.Fatalf("ImagesInState = %v", names(got))
+	}
+	if got, _ := s.ImagesInState(); len(got) != 0 {
+		t.Fatalf("ImagesInState() = %v", names(got))
+	}
+	if got, _ := s.ImagesWithChecksum("aaa"); !equal(names(got), []string{"a", "c"}) {
+		t.Fatalf("ImagesWithChecksum = %v", names(got))
+	}
+	if got, _ := s.Children("b"); !equal(names(got), []string{"c"}) {
+		t.Fatalf("Children = %v", names(got))
+	}
+
+	if err := s.SetLayer("a", "l1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.ImagesWithLayer("l1"); !equal(names(got), []string{"a"}) {
+		t.Fatalf("ImagesWithLayer = %v", names(got))
+	}
+	if err := s.SetUsage("a", 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUpperSize("a", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetQuarantined("aaa", true); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = s.GetImage("a")
+	if a.Layer != "l1" || a.BlobSize != 10 || a.RootfsSize != 20 || a.UpperSize != 30 || !a.BlobQuarantined {
+		t.Fatalf("GetImage after updates = %+v", a)
+	}
+	if c, _ := s.GetImage("c"); !c.BlobQuarantined {
+		t.Fatal("quarantine did not cover every image with the checksum")
+	}
+}
+
+func testStates(t *testing.T, s Store) {
+	img := enqueue(t, s, "a", "aaa", "NEW")
+
+	if ok, err := s.SetState(img.ID, "NEW", "DOWNLOADING"); err != nil || !ok {
+		t.Fatalf("SetState = %v, %v", ok, err)
+	}
+	// A stale transition does nothing.
+	if ok, err := s.SetState(img.ID, "NEW", "FAILED"); err != nil || ok {
+		t.Fatalf("stale SetState = %v, %v", ok, err)
+	}
+	if ok, err := s.SetDeactivated(img.ID, "DOWNLOADING", "STORED", true); err != nil || !ok {
+		t.Fatalf("SetDeactivated = %v, %v", ok, err)
+	}
+	got, _ := s.GetImage("a")
+	if got.State != "STORED" || !got.Deactivated {
+		t.Fatalf("GetImage = %+v", got)
+	}
+	if _, err := s.SetDeactivated(img.ID, "STORED", "ACTIVE", false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetImage("a"); got.State != "ACTIVE" || got.Deactivated {
+		t.Fatalf("GetImage = %+v", got)
+	}
+
+	// Only a DELETING image is deleted.
+	if err := s.DeleteImage(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetImage("a"); err != nil {
+		t.Fatalf("DeleteImage removed an ACTIVE image: %v", err)
+	}
+	if err := s.MarkDeleting("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteImage(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetImage("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetImage after delete: %v", err)
+	}
+	if err := s.MarkDeleting("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("MarkDeleting a missing image: %v", err)
+	}
+}
+
+func testBlobs(t *testing.T, s Store) {
+	a := enqueue(t, s, "a", "aaa", "NEW")
+	b := enqueue(t, s, "b", "aaa", "NEW")
+
+	if last, err := s.BlobLastUsed("aaa"); err != nil || !last.IsZero() {
+		t.Fatalf("BlobLastUsed of an unused blob = %v, %v", last, err)
+	}
+	if err := s.SetQuarantined("aaa", true); err != nil {
+		t.Fatal(err)
+	}
+	used := time.Unix(1700000000, 0)
+	if err := s.MarkBlobUsed(a.ID, "/blobs/aaa.tar", "aaa", 100, used); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkBlobUsed(b.ID, "/blobs/aaa.tar", "aaa", 100, used); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetImage("a"); got.BlobQuarantined {
+		t.Fatal("MarkBlobUsed left the image quarantined")
+	}
+	if n, err := s.BlobRefs("aaa"); err != nil || n != 2 {
+		t.Fatalf("BlobRefs = %d, %v", n, err)
+	}
+	if got, err := s.BlobChecksums(); err != nil || !equal(got, []string{"aaa"}) {
+		t.Fatalf("BlobChecksums = %v, %v", got, err)
+	}
+	if last, _ := s.BlobLastUsed("aaa"); !last.Equal(used) {
+		t.Fatalf("BlobLastUsed = %v", last)
+	}
+	if err := s.TouchBlob("aaa", used.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := s.BlobLastUsed("aaa"); !last.Equal(used.Add(time.Hour)) {
+		t.Fatalf("BlobLastUsed after touch = %v", last)
+	}
+
+	if err := s.ReleaseBlobs(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.BlobRefs("aaa"); n != 1 {
+		t.Fatalf("BlobRefs after release = %d", n)
+	}
+
+	// Records of deleted images are pruned.
+	if err := s.MarkDeleting("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteImage(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.OrphanBlobs(); err != nil || n != 1 {
+		t.Fatalf("OrphanBlobs = %d, %v", n, err)
+	}
+	if err := s.PruneBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.BlobRefs("aaa"); n != 0 {
+		t.Fatalf("BlobRefs after prune = %d", n)
+	}
+	if n, _ := s.OrphanBlobs(); n != 0 {
+		t.Fatalf("OrphanBlobs after prune = %d", n)
+	}
+
+	if err := s.MarkBlobUsed(a.ID, "/blobs/aaa.tar", "aaa", 100, used); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBlob("aaa"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.BlobRefs("aaa"); n != 0 {
+		t.Fatalf("BlobRefs after DeleteBlob = %d", n)
+	}
+}
+
+func testCounters(t *testing.T, s Store) {
+	if counters, err := s.Counters(); err != nil || len(counters) != 0 {
+		t.Fatalf("Counters = %v, %v", counters, err)
+	}
+	for _, delta := range []int64{1, 2, 3} {
+		if err := s.AddCounter("hits", delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddCounter("bytes", 1<<40); err != nil {
+		t.Fatal(err)
+	}
+	counters, err := s.Counters()
+	if err != nil || counters["hits"] != 6 || counters["bytes"] != 1<<40 {
+		t.Fatalf("Counters = %v, %v", counters, err)
+	}
+}
+
+func testLayers(t *testing.T, s Store) {
+	if _, err := s.GetLayer("l1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetLayer of a missing layer: %v", err)
+	}
+	if err := s.PutLayer(Layer{ID: "l1", Checksum: "aaa", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutLayer(Layer{ID: "l2", Checksum: "bbb", Parent: "l1", Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutLayer(Layer{ID: "l1", Checksum: "aaa", Size: 11}); err != nil {
+		t.Fatal(err)
+	}
+	if layer, err := s.GetLayer("l1"); err != nil || layer.Size != 11 {
+		t.Fatalf("GetLayer = %+v, %v", layer, err)
+	}
+	layers, err := s.ListLayers()
+	if err != nil || len(layers) != 2 || layers[1] != (Layer{ID: "l2", Checksum: "bbb", Parent: "l1", Size: 20}) {
+		t.Fatalf("ListLayers = %+v, %v", layers, err)
+	}
+	if err := s.DeleteLayer("l1"); err != nil {
+		t.Fatal(err)
+	}
+	if layers, _ := s.ListLayers(); len(layers) != 1 {
+		t.Fatalf("ListLayers after delete = %+v", layers)
+	}
+}
+
+func testSnapshots(t *testing.T, s Store) {
+	img := enqueue(t, s, "a", "aaa", "ACTIVE")
+
+	id, err := s.CreateSnapshot(img.ID, "one", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSnapshot(img.ID, "one", 0); !errors.Is(err, ErrExists) {
+		t.Fatalf("CreateSnapshot with a taken name: %v", err)
+	}
+	if _, err := s.CreateSnapshot(img.ID, "two", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := s.GetSnapshot("a", "one")
+	if err != nil || snap.ID != id || snap.Image != "a" || snap.Active || snap.Quota != 1024 || snap.Created == "" {
+		t.Fatalf("GetSnapshot = %+v, %v", snap, err)
+	}
+	if _, err := s.GetSnapshot("a", "three"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetSnapshot of a missing snapshot: %v", err)
+	}
+
+	if err := s.SetSnapshotMounted(id, "periodic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSnapshotUpperSize(id, 512); err != nil {
+		t.Fatal(err)
+	}
+	active, err := s.ActiveSnapshots()
+	if err != nil || len(active) != 1 || active[0].Name != "one" || active[0].QuotaMode != "periodic" || active[0].UpperSize != 512 {
+		t.Fatalf("ActiveSnapshots = %+v, %v", active, err)
+	}
+	if err := s.SetSnapshotUnmounted(id); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := s.ActiveSnapshots(); len(active) != 0 {
+		t.Fatalf("ActiveSnapshots after unmount = %+v", active)
+	}
+
+	if err := s.DeleteSnapshot(id); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.ListSnapshots("a")
+	if err != nil || len(list) != 1 || list[0].Name != "two" {
+		t.Fatalf("ListSnapshots = %+v, %v", list, err)
+	}
+
+	// Snapshots outliving their image are orphans.
+	if n, err := s.OrphanSnapshots(); err != nil || n != 0 {
+		t.Fatalf("OrphanSnapshots = %d, %v", n, err)
+	}
+	if err := s.MarkDeleting("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteImage(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.OrphanSnapshots(); err != nil || n != 1 {
+		t.Fatalf("OrphanSnapshots after delete = %d, %v", n, err)
+	}
+	if err := s.PruneSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.OrphanSnapshots(); n != 0 {
+		t.Fatalf("OrphanSnapshots after prune = %d", n)
+	}
+}
+
+func testPins(t *testing.T, s Store) {
+	enqueue(t, s, "a", "aaa", "ACTIVE")
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(time.Hour)
+
+	pin, err := s.AddPin(types.Pin{Kind: "image", Target: "a", Checksum: "aaa", Reason: "release"})
+	if err != nil || pin.Created == "" {
+		t.Fatalf("AddPin = %+v, %v", pin, err)
+	}
+	if _, err := s.AddPin(types.Pin{Kind: "blob", Target: "bbb", Checksum: "bbb", Expires: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	// Pinning again replaces the pin.
+	if _, err := s.AddPin(types.Pin{Kind: "image", Target: "a", Checksum: "aaa", Reason: "audit"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pins, err := s.ListPins(now)
+	if err != nil || len(pins) != 2 {
+		t.Fatalf("ListPins = %+v, %v", pins, err)
+	}
+	for _, pin := range pins {
+		switch pin.Kind {
+		case "image":
+			if pin.Reason != "audit" || pin.Expires != nil {
+				t.Fatalf("image pin = %+v", pin)
+			}
+		case "blob":
+			if pin.Expires == nil || !pin.Expires.Equal(expires) {
+				t.Fatalf("blob pin = %+v", pin)
+			}
+		}
+	}
+
+	// An image pin follows the image's current checksum.
+	img, _ := s.GetImage("a")
+	if err := s.MarkDeleting("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteImage(img.ID); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, s, "a", "ccc", "NEW")
+	checksums, err := s.PinnedChecksums(now)
+	sort.Strings(checksums)
+	if err != nil || !equal(checksums, []string{"aaa", "bbb", "ccc"}) {
+		t.Fatalf("PinnedChecksums = %v, %v", checksums, err)
+	}
+
+	later := expires.Add(time.Second)
+	if pins, _ := s.ListPins(later); len(pins) != 1 {
+		t.Fatalf("ListPins after expiry = %+v", pins)
+	}
+	if checksums, _ := s.PinnedChecksums(later); len(checksums) != 2 {
+		t.Fatalf("PinnedChecksums after expiry = %v", checksums)
+	}
+	if err := s.PrunePins(later); err != nil {
+		t.Fatal(err)
+	}
+	if pins, _ := s.ListPins(now); len(pins) != 1 {
+		t.Fatalf("ListPins after prune = %+v", pins)
+	}
+
+	if err := s.RemovePin("image", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemovePin("image", "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RemovePin of a missing pin: %v", err)
+	}
+}
+
+func testMigrate(t *testing.T, s Store) {
+	enqueue(t, s, "a", "aaa", "NEW")
+	if err := s.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.CountImages(); err != nil || n != 1 {
+		t.Fatalf("CountImages after migrating again = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func (s *sqlStore) Migrate(dir string) error {
+	dir = filepath.Join(dir, s.d.name)
+	if _, err := s.db.Exec(s.d.migrations); err != nil {
+		return err
+	}
+
+	if s.d.legacy != nil {
+		if err := s.adoptLegacy(); err != nil {
+			return err
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no migrations found in %s", dir)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		version := strings.TrimSuffix(filepath.Base(file), ".sql")
+		if err := s.apply(version, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) apply(version, file string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.d.lock != "" {
+		if _, err := tx.Exec(s.d.lock); err != nil {
+			return err
+		}
+	}
+	var applied int
+	if err := tx.QueryRow(s.d.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version=?"), version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	script, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(string(script)); err != nil {
+		return fmt.Errorf("migration %s: %v", version, err)
+	}
+	if _, err := tx.Exec(s.d.rebind("INSERT INTO schema_migrations(version) VALUES (?)"), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adoptLegacy records 001_init as applied for databases created before
+// migrations were tracked, so the initial schema is not executed twice.
+func (s *sqlStore) adoptLegacy() error {
+	var tracked int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&tracked); err != nil {
+		return err
+	}
+	if tracked > 0 {
+		return nil
+	}
+
+	legacy, err := s.d.legacy(s.db)
+	if err != nil || !legacy {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT INTO schema_migrations(version) VALUES ('001_init')")
+	return err
+}
@@ -0,0 +1,48 @@
+package metadata
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+var postgresDialect = dialect{
+	name:   "postgres",
+	rebind: rebindDollar,
+	migrations: `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version TEXT PRIMARY KEY,
+  applied_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP
+)`,
+	lock: "SELECT pg_advisory_xact_lock(7238941)",
+}
+
+// rebindDollar numbers the ? placeholders of a query as $1, $2, ...
+// None of the queries have a ? inside a string literal.
+func rebindDollar(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// OpenPostgres connects to the Postgres database at dsn, a postgres:// URL.
+func OpenPostgres(dsn string) (Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, d: postgresDialect}, nil
+}
@@ -0,0 +1,54 @@
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPostgres runs against the database in IMGSTORE_TEST_POSTGRES, or a
+// local default, and is skipped when there is none. Each subtest gets a
+// schema of its own, dropped afterwards.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("IMGSTORE_TEST_POSTGRES")
+	if dsn == "" {
+		dsn = "postgres://postgres@localhost:5432/postgres?sslmode=disable"
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Skipf("postgres: %v", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Skipf("no postgres at %s: %v", dsn, err)
+	}
+
+	testStore(t, func(t *testing.T) Store {
+		schema := fmt.Sprintf("imgstore_test_%d", time.Now().UnixNano())
+		if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+
+		s, err := OpenPostgres(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		if err := s.Migrate(migrations); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,527 @@
+package metadata
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"imgstore/internal/types"
+)
+
+// dialect is what differs between the backends. The queries themselves are
+// written once, in SQL that SQLite and Postgres both accept, with ?
+// placeholders that rebind rewrites where needed.
+type dialect struct {
+	name   string
+	rebind func(query string) string
+	// migrations creates the table recording applied migrations.
+	migrations string
+	// lock, if set, runs first in each migration's transaction so that
+	// hosts starting at once do not apply the same migration twice.
+	lock string
+	// legacy reports a database created before migrations were tracked.
+	legacy func(db *sql.DB) (bool, error)
+	// backup copies the live database to path.
+	backup func(db *sql.DB, path string) error
+}
+
+type sqlStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) Backup(path string) error {
+	if s.d.backup == nil {
+		return fmt.Errorf("backup of a %s catalog: %w; use the database's own tools", s.d.name, errors.ErrUnsupported)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("backup %s: %w", path, os.ErrExist)
+	}
+	// Written next to path first, so that an interrupted backup never
+	// looks complete.
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := s.d.backup(s.db, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// placeholders returns n comma-separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+const imageColumns = `id, name, blob_key, checksum, state, policy, parent, layer, deactivated,
+	blob_quarantined, blob_size, rootfs_size, upper_size, created_at, updated_at`
+
+func scanImage(row scanner) (Image, error) {
+	var img Image
+	err := row.Scan(&img.ID, &img.Name, &img.BlobKey, &img.Checksum, &img.State, &img.Policy, &img.Parent, &img.Layer,
+		&img.Deactivated, &img.BlobQuarantined, &img.BlobSize, &img.RootfsSize, &img.UpperSize, &img.Created, &img.Updated)
+	return img, err
+}
+
+func (s *sqlStore) images(query string, args ...interface{}) ([]Image, error) {
+	rows, err := s.query("SELECT "+imageColumns+" FROM images "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+func (s *sqlStore) EnqueueImage(img Image) error {
+	_, err := s.exec(`INSERT INTO images(name, blob_key, checksum, state, policy, parent) VALUES (?,?,?,?,?,?)
+		ON CONFLICT DO NOTHING`, img.Name, img.BlobKey, img.Checksum, img.State, img.Policy, img.Parent)
+	return err
+}
+
+func (s *sqlStore) CreateImages(images ...Image) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(images))
+	for i, img := range images {
+		err := tx.QueryRow(s.d.rebind(`INSERT INTO images(name, blob_key, checksum, state, policy, parent) VALUES (?,?,?,?,?,?)
+			ON CONFLICT DO NOTHING RETURNING id`), img.Name, img.BlobKey, img.Checksum, img.State, img.Policy, img.Parent).Scan(&ids[i])
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("image %s: %w", img.Name, ErrExists)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("image %s: %v", img.Name, err)
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (s *sqlStore) GetImage(name string) (Image, error) {
+	img, err := scanImage(s.queryRow("SELECT "+imageColumns+" FROM images WHERE name=?", name))
+	if err == sql.ErrNoRows {
+		return img, fmt.Errorf("image %s: %w", name, ErrNotFound)
+	}
+	return img, err
+}
+
+func (s *sqlStore) ListImages() ([]Image, error) {
+	return s.images("ORDER BY id")
+}
+
+func (s *sqlStore) CountImages() (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM images").Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) ImagesInState(states ...string) ([]Image, error) {
+	if len(states) == 0 {
+		return []Image{}, nil
+	}
+	args := make([]interface{}, len(states))
+	for i, state := range states {
+		args[i] = state
+	}
+	return s.images("WHERE state IN ("+placeholders(len(states))+") ORDER BY id", args...)
+}
+
+func (s *sqlStore) ImagesWithChecksum(checksum string) ([]Image, error) {
+	return s.images("WHERE checksum=? ORDER BY id", checksum)
+}
+
+func (s *sqlStore) ImagesWithLayer(layer string) ([]Image, error) {
+	return s.images("WHERE layer=? ORDER BY id", layer)
+}
+
+func (s *sqlStore) Children(parent string) ([]Image, error) {
+	return s.images("WHERE parent=? ORDER BY id", parent)
+}
+
+func (s *sqlStore) SetState(id int, from, to string) (bool, error) {
+	res, err := s.exec("UPDATE images SET state=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND state=?", to, id, from)
+	return changed(res, err)
+}
+
+func (s *sqlStore) SetDeactivated(id int, from, to string, deactivated bool) (bool, error) {
+	res, err := s.exec("UPDATE images SET state=?, deactivated=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND state=?",
+		to, boolInt(deactivated), id, from)
+	return changed(res, err)
+}
+
+func changed(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) MarkDeleting(name string) error {
+	ok, err := changed(s.exec("UPDATE images SET state='DELETING', updated_at=CURRENT_TIMESTAMP WHERE name=?", name))
+	if err == nil && !ok {
+		err = fmt.Errorf("image %s: %w", name, ErrNotFound)
+	}
+	return err
+}
+
+func (s *sqlStore) DeleteImage(id int) error {
+	_, err := s.exec("DELETE FROM images WHERE id=? AND state='DELETING'", id)
+	return err
+}
+
+func (s *sqlStore) SetLayer(name, layer string) error {
+	_, err := s.exec("UPDATE images SET layer=? WHERE name=?", layer, name)
+	return err
+}
+
+func (s *sqlStore) SetUsage(name string, blobSize, rootfsSize int64) error {
+	_, err := s.exec("UPDATE images SET blob_size=?, rootfs_size=? WHERE name=?", blobSize, rootfsSize, name)
+	return err
+}
+
+func (s *sqlStore) SetUpperSize(name string, size int64) error {
+	_, err := s.exec("UPDATE images SET upper_size=? WHERE name=?", size, name)
+	return err
+}
+
+func (s *sqlStore) SetQuarantined(checksum string, quarantined bool) error {
+	_, err := s.exec("UPDATE images SET blob_quarantined=? WHERE checksum=?", boolInt(quarantined), checksum)
+	return err
+}
+
+func (s *sqlStore) MarkBlobUsed(imageID int, path, checksum string, size int64, at time.Time) error {
+	if _, err := s.exec("INSERT INTO blobs(image_id, path, checksum) VALUES (?,?,?)", imageID, path, checksum); err != nil {
+		return err
+	}
+	if _, err := s.exec("UPDATE blobs SET size=?, last_used=? WHERE checksum=?", size, at.Unix(), checksum); err != nil {
+		return err
+	}
+	return s.SetQuarantined(checksum, false)
+}
+
+func (s *sqlStore) TouchBlob(checksum string, at time.Time) error {
+	_, err := s.exec("UPDATE blobs SET last_used=? WHERE checksum=?", at.Unix(), checksum)
+	return err
+}
+
+func (s *sqlStore) BlobLastUsed(checksum string) (time.Time, error) {
+	var lastUsed sql.NullInt64
+	if err := s.queryRow("SELECT MAX(last_used) FROM blobs WHERE checksum=?", checksum).Scan(&lastUsed); err != nil {
+		return time.Time{}, err
+	}
+	if lastUsed.Int64 <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(lastUsed.Int64, 0), nil
+}
+
+func (s *sqlStore) BlobRefs(checksum string) (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM blobs WHERE checksum=?", checksum).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) ReleaseBlobs(imageID int) error {
+	_, err := s.exec("DELETE FROM blobs WHERE image_id=?", imageID)
+	return err
+}
+
+func (s *sqlStore) DeleteBlob(checksum string) error {
+	_, err := s.exec("DELETE FROM blobs WHERE checksum=?", checksum)
+	return err
+}
+
+func (s *sqlStore) PruneBlobs() error {
+	_, err := s.exec("DELETE FROM blobs WHERE image_id NOT IN (SELECT id FROM images)")
+	return err
+}
+
+func (s *sqlStore) OrphanBlobs() (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM blobs WHERE image_id NOT IN (SELECT id FROM images)").Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) BlobChecksums() ([]string, error) {
+	rows, err := s.query("SELECT DISTINCT checksum FROM blobs ORDER BY checksum")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, rows.Err()
+}
+
+func (s *sqlStore) AddCounter(name string, delta int64) error {
+	_, err := s.exec(`INSERT INTO cache_stats(name, value) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET value = cache_stats.value + excluded.value`, name, delta)
+	return err
+}
+
+func (s *sqlStore) Counters() (map[string]int64, error) {
+	rows, err := s.query("SELECT name, value FROM cache_stats")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counters := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		counters[name] = value
+	}
+	return counters, rows.Err()
+}
+
+func (s *sqlStore) GetLayer(id string) (Layer, error) {
+	var layer Layer
+	err := s.queryRow("SELECT id, checksum, parent, size FROM layers WHERE id=?", id).
+		Scan(&layer.ID, &layer.Checksum, &layer.Parent, &layer.Size)
+	if err == sql.ErrNoRows {
+		return layer, fmt.Errorf("layer %s: %w", id, ErrNotFound)
+	}
+	return layer, err
+}
+
+func (s *sqlStore) PutLayer(layer Layer) error {
+	_, err := s.exec(`INSERT INTO layers(id, checksum, parent, size) VALUES (?,?,?,?)
+		ON CONFLICT(id) DO UPDATE SET checksum = excluded.checksum, parent = excluded.parent, size = excluded.size`,
+		layer.ID, layer.Checksum, layer.Parent, layer.Size)
+	return err
+}
+
+func (s *sqlStore) DeleteLayer(id string) error {
+	_, err := s.exec("DELETE FROM layers WHERE id=?", id)
+	return err
+}
+
+func (s *sqlStore) ListLayers() ([]Layer, error) {
+	rows, err := s.query("SELECT id, checksum, parent, size FROM layers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	layers := []Layer{}
+	for rows.Next() {
+		var layer Layer
+		if err := rows.Scan(&layer.ID, &layer.Checksum, &layer.Parent, &layer.Size); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, rows.Err()
+}
+
+func (s *sqlStore) CreateSnapshot(imageID int, name string, quota int64) (int, error) {
+	var id int
+	err := s.queryRow(`INSERT INTO snapshots(image_id, snapshot_name, active, quota) VALUES (?,?,0,?)
+		ON CONFLICT DO NOTHING RETURNING id`, imageID, name, quota).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("snapshot %s: %w", name, ErrExists)
+	}
+	return id, err
+}
+
+const snapshotQuery = `
+	SELECT s.id, i.name, s.snapshot_name, s.active, s.upper_size, s.quota, s.quota_mode, s.created_at
+	FROM snapshots s
+	JOIN images i ON s.image_id = i.id `
+
+func scanSnapshot(row scanner) (types.SnapshotInfo, error) {
+	var snap types.SnapshotInfo
+	err := row.Scan(&snap.ID, &snap.Image, &snap.Name, &snap.Active, &snap.UpperSize, &snap.Quota, &snap.QuotaMode, &snap.Created)
+	return snap, err
+}
+
+func (s *sqlStore) snapshots(query string, args ...interface{}) ([]types.SnapshotInfo, error) {
+	rows, err := s.query(snapshotQuery+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []types.SnapshotInfo{}
+	for rows.Next() {
+		snap, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
+func (s *sqlStore) GetSnapshot(image, name string) (types.SnapshotInfo, error) {
+	snap, err := scanSnapshot(s.queryRow(snapshotQuery+"WHERE i.name = ? AND s.snapshot_name = ?", image, name))
+	if err == sql.ErrNoRows {
+		return snap, fmt.Errorf("snapshot %s of %s: %w", name, image, ErrNotFound)
+	}
+	return snap, err
+}
+
+func (s *sqlStore) ListSnapshots(image string) ([]types.SnapshotInfo, error) {
+	return s.snapshots("WHERE i.name = ? ORDER BY s.snapshot_name", image)
+}
+
+func (s *sqlStore) ActiveSnapshots() ([]types.SnapshotInfo, error) {
+	return s.snapshots("WHERE s.active = 1 ORDER BY s.id")
+}
+
+func (s *sqlStore) SetSnapshotMounted(id int, quotaMode string) error {
+	_, err := s.exec("UPDATE snapshots SET active=1, quota_mode=? WHERE id=?", quotaMode, id)
+	return err
+}
+
+func (s *sqlStore) SetSnapshotUnmounted(id int) error {
+	_, err := s.exec("UPDATE snapshots SET active=0 WHERE id=?", id)
+	return err
+}
+
+func (s *sqlStore) SetSnapshotUpperSize(id int, size int64) error {
+	_, err := s.exec("UPDATE snapshots SET upper_size=? WHERE id=?", size, id)
+	return err
+}
+
+func (s *sqlStore) DeleteSnapshot(id int) error {
+	_, err := s.exec("DELETE FROM snapshots WHERE id=?", id)
+	return err
+}
+
+func (s *sqlStore) OrphanSnapshots() (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM snapshots WHERE image_id NOT IN (SELECT id FROM images)").Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) PruneSnapshots() error {
+	_, err := s.exec("DELETE FROM snapshots WHERE image_id NOT IN (SELECT id FROM images)")
+	return err
+}
+
+func (s *sqlStore) AddPin(pin types.Pin) (types.Pin, error) {
+	var expiresAt int64
+	if pin.Expires != nil {
+		expiresAt = pin.Expires.Unix()
+	}
+	err := s.queryRow(`INSERT INTO pins(kind, target, checksum, reason, expires_at) VALUES (?,?,?,?,?)
+		ON CONFLICT(kind, target) DO UPDATE SET checksum = excluded.checksum, reason = excluded.reason,
+			expires_at = excluded.expires_at, created_at = CURRENT_TIMESTAMP
+		RETURNING created_at`,
+		pin.Kind, pin.Target, pin.Checksum, pin.Reason, expiresAt).Scan(&pin.Created)
+	return pin, err
+}
+
+func (s *sqlStore) RemovePin(kind, target string) error {
+	ok, err := changed(s.exec("DELETE FROM pins WHERE kind=? AND target=?", kind, target))
+	if err == nil && !ok {
+		err = fmt.Errorf("%s pin %s: %w", kind, target, ErrNotFound)
+	}
+	return err
+}
+
+func (s *sqlStore) ListPins(now time.Time) ([]types.Pin, error) {
+	rows, err := s.query(`
+		SELECT kind, target, checksum, reason, expires_at, created_at FROM pins
+		WHERE expires_at = 0 OR expires_at > ? ORDER BY created_at, id`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []types.Pin{}
+	for rows.Next() {
+		var pin types.Pin
+		var expiresAt int64
+		if err := rows.Scan(&pin.Kind, &pin.Target, &pin.Checksum, &pin.Reason, &expiresAt, &pin.Created); err != nil {
+			return nil, err
+		}
+		if expiresAt > 0 {
+			expires := time.Unix(expiresAt, 0)
+			pin.Expires = &expires
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+func (s *sqlStore) PinnedChecksums(now time.Time) ([]string, error) {
+	rows, err := s.query(`
+		SELECT checksum FROM pins WHERE expires_at = 0 OR expires_at > ?
+		UNION
+		SELECT i.checksum FROM pins p JOIN images i ON p.kind = 'image' AND i.name = p.target
+		WHERE p.expires_at = 0 OR p.expires_at > ?`, now.Unix(), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, rows.Err()
+}
+
+func (s *sqlStore) PrunePins(now time.Time) error {
+	_, err := s.exec("DELETE FROM pins WHERE expires_at > 0 AND expires_at <= ?", now.Unix())
+	return err
+}
@@ -0,0 +1,146 @@
+package metadata
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = dialect{
+	name:   "sqlite",
+	rebind: func(query string) string { return query },
+	migrations: `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version TEXT PRIMARY KEY,
+  applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`,
+	legacy: func(db *sql.DB) (bool, error) {
+		var tables int
+		err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='images'").Scan(&tables)
+		return tables > 0, err
+	},
+	// VACUUM INTO reads inside one transaction, so the copy is consistent
+	// even while the worker keeps writing to the WAL.
+	backup: func(db *sql.DB, path string) error {
+		_, err := db.Exec("VACUUM INTO ?", path)
+		return err
+	},
+}
+
+// OpenSQLite opens the SQLite database at path in WAL mode, creating it if
+// it does not exist.
+func OpenSQLite(path string) (Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, d: sqliteDialect}, nil
+}
+
+// RestoreSQLite replaces the database at path with backup, after checking
+// that backup is an intact catalog. It refuses with ErrInUse while another
+// process has path open, and holds an exclusive lock on it until the copy
+// is ready to be swapped in.
+func RestoreSQLite(backup, path string) error {
+	if err := checkSQLite(backup); err != nil {
+		return fmt.Errorf("restore %s: %v", backup, err)
+	}
+	unlock, err := lockSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".restore"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Closing checkpoints the old database, which must happen before its
+	// WAL is removed.
+	unlock()
+	// A WAL left over from the old database would be replayed onto the
+	// restored one.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// lockSQLite takes an exclusive lock on the database at path, if there is
+// one. Every connection to a WAL database holds a shared lock while it is
+// open, so this fails at once if any process, even an idle one, uses it.
+// The returned func releases the lock and may be called more than once.
+func lockSQLite(path string) (func(), error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_locking_mode=EXCLUSIVE&_txlock=exclusive&_busy_timeout=0")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w: %v", path, ErrInUse, err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tx.Rollback()
+			db.Close()
+		})
+	}, nil
+}
+
+func checkSQLite(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_migrations'").Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("not an imgstore catalog")
+	}
+	return nil
+}
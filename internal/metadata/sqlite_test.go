@@ -0,0 +1,99 @@
+package metadata
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const migrations = "../../migrations"
+
+func TestSQLite(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		s, err := OpenSQLite(filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		if err := s.Migrate(migrations); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestSQLiteBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.db")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, s, "a", "aaa", "NEW")
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := s.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Backup(backup); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Backup over an existing file: %v", err)
+	}
+	enqueue(t, s, "b", "bbb", "NEW")
+	s.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, "junk.db"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSQLite(filepath.Join(dir, "junk.db"), path); err == nil {
+		t.Fatal("RestoreSQLite accepted a file that is not a database")
+	}
+	if err := RestoreSQLite(backup, path); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	images, err := s.ListImages()
+	if err != nil || !equal(names(images), []string{"a"}) {
+		t.Fatalf("ListImages after restore = %v, %v", names(images), err)
+	}
+}
+
+func TestSQLiteRestoreRefusesOpenDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.db")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, s, "a", "aaa", "NEW")
+	backup := filepath.Join(dir, "backup.db")
+	if err := s.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	enqueue(t, s, "b", "bbb", "NEW")
+
+	// The store is idle but open, as in a running server.
+	if err := RestoreSQLite(backup, path); !errors.Is(err, ErrInUse) {
+		t.Fatalf("RestoreSQLite of an open database = %v, want ErrInUse", err)
+	}
+	images, err := s.ListImages()
+	if err != nil || !equal(names(images), []string{"a", "b"}) {
+		t.Fatalf("ListImages after a refused restore = %v, %v", names(images), err)
+	}
+	if _, err := os.Stat(path + ".restore"); !os.IsNotExist(err) {
+		t.Fatalf("a refused restore left a temp file: %v", err)
+	}
+}
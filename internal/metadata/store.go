@@ -0,0 +1,171 @@
+// Package metadata is the catalog of images, blobs, layers, snapshots and
+// pins. It is kept in SQLite by default, or in Postgres so that several
+// hosts can share one catalog.
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"imgstore/internal/types"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+	ErrInUse    = errors.New("database is in use")
+)
+
+// Image is a row of the images table.
+type Image struct {
+	ID              int
+	Name            string
+	BlobKey         string
+	Checksum        string
+	State           string
+	Policy          string
+	Parent          string
+	Layer           string
+	Deactivated     bool
+	BlobQuarantined bool
+	BlobSize        int64
+	RootfsSize      int64
+	UpperSize       int64
+	Created         string
+	Updated         string
+}
+
+// Layer is an extracted tree shared by the images with the same content.
+type Layer struct {
+	ID       string
+	Checksum string
+	Parent   string
+	Size     int64
+}
+
+type Store interface {
+	Images
+	Blobs
+	Layers
+	Snapshots
+	Pins
+
+	// Migrate applies the migrations in dir/<backend> that have not been
+	// applied yet, in lexical order.
+	Migrate(dir string) error
+	// Backup writes a consistent copy of the catalog to path, which must not
+	// exist, while it stays in use.
+	Backup(path string) error
+	Close() error
+}
+
+type Images interface {
+	// EnqueueImage adds an image unless one with the same name exists.
+	EnqueueImage(img Image) error
+	// CreateImages adds images in one transaction and returns their IDs.
+	// It fails with ErrExists if any name is taken.
+	CreateImages(images ...Image) ([]int, error)
+	GetImage(name string) (Image, error)
+	ListImages() ([]Image, error)
+	CountImages() (int, error)
+	ImagesInState(states ...string) ([]Image, error)
+	ImagesWithChecksum(checksum string) ([]Image, error)
+	ImagesWithLayer(layer string) ([]Image, error)
+	Children(parent string) ([]Image, error)
+
+	// SetState moves an image to state to if it is still in state from,
+	// and reports whether it did.
+	SetState(id int, from, to string) (bool, error)
+	// SetDeactivated is SetState that also sets whether the worker leaves
+	// the image alone in STORED.
+	SetDeactivated(id int, from, to string, deactivated bool) (bool, error)
+	// MarkDeleting moves an image to DELETING whatever its state.
+	MarkDeleting(name string) error
+	// DeleteImage removes an image that is DELETING.
+	DeleteImage(id int) error
+	SetLayer(name, layer string) error
+	SetUsage(name string, blobSize, rootfsSize int64) error
+	SetUpperSize(name string, size int64) error
+	SetQuarantined(checksum string, quarantined bool) error
+}
+
+type Blobs interface {
+	// MarkBlobUsed records that an image uses a blob, sets the blob's size
+	// and last use, and clears the quarantine flag of images built from it.
+	MarkBlobUsed(imageID int, path, checksum string, size int64, at time.Time) error
+	TouchBlob(checksum string, at time.Time) error
+	// BlobLastUsed returns when a blob was last used, or the zero time.
+	BlobLastUsed(checksum string) (time.Time, error)
+	// BlobRefs counts the images recorded as using a blob.
+	BlobRefs(checksum string) (int, error)
+	ReleaseBlobs(imageID int) error
+	DeleteBlob(checksum string) error
+	// PruneBlobs drops the blob records of images that no longer exist.
+	PruneBlobs() error
+	// OrphanBlobs counts the records PruneBlobs would drop.
+	OrphanBlobs() (int, error)
+	// BlobChecksums returns the checksum of every blob with a record,
+	// whether or not the file is still cached.
+	BlobChecksums() ([]string, error)
+
+	AddCounter(name string, delta int64) error
+	Counters() (map[string]int64, error)
+}
+
+type Layers interface {
+	GetLayer(id string) (Layer, error)
+	// PutLayer adds a layer or replaces the one with the same ID.
+	PutLayer(layer Layer) error
+	DeleteLayer(id string) error
+	ListLayers() ([]Layer, error)
+}
+
+type Snapshots interface {
+	// CreateSnapshot adds an unmounted snapshot; it fails with ErrExists
+	// if the image already has one with that name.
+	CreateSnapshot(imageID int, name string, quota int64) (int, error)
+	GetSnapshot(image, name string) (types.SnapshotInfo, error)
+	ListSnapshots(image string) ([]types.SnapshotInfo, error)
+	ActiveSnapshots() ([]types.SnapshotInfo, error)
+	SetSnapshotMounted(id int, quotaMode string) error
+	SetSnapshotUnmounted(id int) error
+	SetSnapshotUpperSize(id int, size int64) error
+	DeleteSnapshot(id int) error
+	// OrphanSnapshots counts the snapshots of images that no longer exist,
+	// and PruneSnapshots drops them.
+	OrphanSnapshots() (int, error)
+	PruneSnapshots() error
+}
+
+type Pins interface {
+	// AddPin adds a pin or replaces the one on the same target, and
+	// returns it with its creation time.
+	AddPin(pin types.Pin) (types.Pin, error)
+	RemovePin(kind, target string) error
+	// ListPins returns the pins that have not expired by now.
+	ListPins(now time.Time) ([]types.Pin, error)
+	// PinnedChecksums returns the checksums of the pins that have not
+	// expired, and of the images that image pins name.
+	PinnedChecksums(now time.Time) ([]string, error)
+	PrunePins(now time.Time) error
+}
+
+// Open opens the catalog at dsn: a postgres:// URL, or the path of a
+// SQLite database.
+func Open(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return OpenPostgres(dsn)
+	}
+	return OpenSQLite(dsn)
+}
+
+// Restore replaces the catalog at dsn with a file written by Backup.
+// Postgres catalogs are restored with the database's own tools.
+func Restore(backup, dsn string) error {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return fmt.Errorf("restore of a postgres catalog: %w; use the database's own tools", errors.ErrUnsupported)
+	}
+	return RestoreSQLite(backup, dsn)
+}
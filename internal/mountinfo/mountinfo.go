@@ -0,0 +1,83 @@
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Mount struct {
+	ID         int
+	Parent     int
+	MountPoint string
+	FSType     string
+	Source     string
+	Options    string
+
+	// SuperOptions are the options of the filesystem rather than the mount,
+	// such as quota settings.
+	SuperOptions string
+}
+
+// parse reads the format of /proc/<pid>/mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parse(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 6 || len(fields) < sep+4 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, Mount{
+			ID:         id,
+			Parent:     parent,
+			MountPoint: unescape(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     unescape(fields[sep+2]),
+
+			SuperOptions: fields[sep+3],
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescape decodes the octal escapes (\040 for a space) the kernel uses for
+// whitespace and backslashes in paths.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,13 @@
+package mountinfo
+
+import "os"
+
+// Read returns the mounts visible to the current process.
+func Read() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
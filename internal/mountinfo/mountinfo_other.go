@@ -0,0 +1,8 @@
+//go:build !linux
+
+package mountinfo
+
+// Read returns no mounts: the store only mounts overlays on Linux.
+func Read() ([]Mount, error) {
+	return nil, nil
+}
@@ -0,0 +1,49 @@
+package mountinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+const sample = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+35 22 0:31 / /var/lib/imgstore/active/alpine rw,relatime shared:12 master:3 - overlay overlay rw,lowerdir=/var/lib/imgstore/layers/abc/rootfs,upperdir=/var/lib/imgstore/overlays/alpine/upper,workdir=/var/lib/imgstore/overlays/alpine/work
+36 22 0:32 / /var/lib/imgstore/active/alpine@job\0401 rw - overlay overlay rw
+37 22 8:2 / /srv rw,noatime - xfs /dev/sdb1 rw,prjquota
+`
+
+func TestParse(t *testing.T) {
+	mounts, err := parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("parsed %d mounts, want 4", len(mounts))
+	}
+
+	// Optional fields before the separator vary in number.
+	m := mounts[1]
+	if m.ID != 35 || m.Parent != 22 || m.MountPoint != "/var/lib/imgstore/active/alpine" || m.FSType != "overlay" || m.Source != "overlay" {
+		t.Errorf("overlay mount = %+v", m)
+	}
+	if m.Options != "rw,relatime" || !strings.HasPrefix(m.SuperOptions, "rw,lowerdir=") {
+		t.Errorf("overlay options %q, super options %q", m.Options, m.SuperOptions)
+	}
+	if got := mounts[2].MountPoint; got != "/var/lib/imgstore/active/alpine@job 1" {
+		t.Errorf("escaped mount point = %q", got)
+	}
+	if got := mounts[3]; got.FSType != "xfs" || got.SuperOptions != "rw,prjquota" {
+		t.Errorf("xfs mount = %+v", got)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, line := range []string{
+		"35 22 0:31 / /mnt rw",
+		"35 22 0:31 / /mnt rw shared:1 overlay overlay rw",
+		"x 22 0:31 / /mnt rw - overlay overlay rw",
+	} {
+		if _, err := parse(strings.NewReader(line + "\n")); err == nil {
+			t.Errorf("parse(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"imgstore/internal/bundle"
+	"imgstore/internal/fsm"
+	"imgstore/internal/metadata"
+	"imgstore/internal/snapshots"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// rewrite copies a bundle, passing each entry through edit.
+func rewrite(t *testing.T, data []byte, edit func(name string, body []byte) []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = edit(hdr.Name, body)
+		hdr.Size = int64(len(body))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBundle(t *testing.T) {
+	src := newTestService(t, nil)
+	img := fetch(t, src, "a", map[string]string{"etc/hostname": "a\n"})
+	public, private := newKey(t)
+	var buf bytes.Buffer
+	if err := src.CreateBundle(&buf, []string{"a"}, private); err != nil {
+		t.Fatal(err)
+	}
+	signed := buf.Bytes()
+
+	other, _ := newKey(t)
+	tests := []struct {
+		name    string
+		data    []byte
+		trusted ed25519.PublicKey
+		err     error
+	}{
+		{"untrusted key", signed, other, bundle.ErrUntrusted},
+		{"tampered index", rewrite(t, signed, func(name string, body []byte) []byte {
+			if name == "index.json" {
+				return bytes.Replace(body, []byte(`"name": "a"`), []byte(`"name": "b"`), 1)
+			}
+			return body
+		}), public, bundle.ErrUntrusted},
+		{"tampered blob", rewrite(t, signed, func(name string, body []byte) []byte {
+			if strings.HasPrefix(name, "blobs/") {
+				body[len(body)/2] ^= 0xff
+			}
+			return body
+		}), public, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := newTestService(t, nil)
+			names, err := dst.LoadBundle(bytes.NewReader(tt.data), []ed25519.PublicKey{tt.trusted})
+			if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("LoadBundle = %v, %v, want %v", names, err, tt.err)
+			}
+			if tt.err == nil && !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatalf("LoadBundle = %v, want a checksum mismatch", err)
+			}
+			if dst.cache.Exists(img.Checksum) {
+				t.Error("the blob was stored")
+			}
+			if n, _ := dst.meta.CountImages(); n != 0 {
+				t.Errorf("%d images were registered", n)
+			}
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		dst := newTestService(t, nil)
+		names, err := dst.LoadBundle(bytes.NewReader(signed), []ed25519.PublicKey{other, public})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != "a" {
+			t.Fatalf("LoadBundle = %v", names)
+		}
+		if state, _ := dst.GetImageStatus("a"); state != string(fsm.StateDownloaded) {
+			t.Fatalf("loaded image is %s", state)
+		}
+		if !dst.cache.Exists(img.Checksum) {
+			t.Fatal("the blob was not stored")
+		}
+		process(t, dst, "a", fsm.StateActive)
+
+		// Loading it again changes nothing.
+		if names, err := dst.LoadBundle(bytes.NewReader(signed), []ed25519.PublicKey{public}); err != nil || len(names) != 0 {
+			t.Fatalf("second LoadBundle = %v, %v", names, err)
+		}
+	})
+}
+
+func TestLoadBundleRejectsInvalidNames(t *testing.T) {
+	public, private := newKey(t)
+	for _, name := range []string{"..", "a/b", "../blobs", "a@b"} {
+		var buf bytes.Buffer
+		index := bundle.Index{Images: []bundle.Image{{Name: name, Checksum: strings.Repeat("a", 64)}}}
+		if err := bundle.Write(&buf, index, private, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newTestService(t, nil)
+		if _, err := s.LoadBundle(&buf, []ed25519.PublicKey{public}); !errors.Is(err, snapshots.ErrInvalidName) {
+			t.Errorf("LoadBundle with image %q = %v, want ErrInvalidName", name, err)
+		}
+		if _, err := s.meta.GetImage(name); !errors.Is(err, metadata.ErrNotFound) {
+			t.Errorf("image %q was registered: %v", name, err)
+		}
+	}
+}
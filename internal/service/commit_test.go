@@ -0,0 +1,135 @@
+package service
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"imgstore/internal/fsm"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
+)
+
+// layerEntries lists the entries of a cached layer blob.
+func layerEntries(t *testing.T, s *Service, checksum string) []string {
+	t.Helper()
+
+	f, err := s.cache.Open(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCommit(t *testing.T) {
+	s := newOverlayService(t, nil)
+	fetch(t, s, "base", map[string]string{"etc/hostname": "base\n", "etc/motd": "hi\n", "var/lib/x/old": "old\n"})
+
+	// Change a file, delete one and replace a directory.
+	active := s.storage.GetActivePath("base")
+	if err := os.WriteFile(filepath.Join(active, "etc", "hostname"), []byte("derived\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(active, "etc", "motd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(active, "var", "lib", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(active, "var", "lib", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(active, "var", "lib", "x", "new"), []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := s.CommitSnapshot("base", "", "derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := s.meta.GetImage("derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsm.State(img.State) != fsm.StateDownloaded || img.Parent != "base" || img.Checksum != checksum || img.BlobKey != "" {
+		t.Fatalf("derived image = %+v", img)
+	}
+	want := []string{"etc/", "etc/.wh.motd", "etc/hostname", "var/", "var/lib/", "var/lib/x/", "var/lib/x/.wh..wh..opq", "var/lib/x/new"}
+	if got := layerEntries(t, s, checksum); !equal(got, want) {
+		t.Fatalf("layer entries %q, want %q", got, want)
+	}
+
+	process(t, s, "derived", fsm.StateActive)
+	derived := s.storage.GetActivePath("derived")
+	if got := read(t, filepath.Join(derived, "etc", "hostname")); got != "derived\n" {
+		t.Errorf("derived etc/hostname = %q", got)
+	}
+	for _, path := range []string{"etc/motd", "var/lib/x/old"} {
+		if exists(filepath.Join(derived, path)) {
+			t.Errorf("derived has %s, which was deleted", path)
+		}
+	}
+
+	// A named snapshot of the derived image commits on top of it.
+	if _, err := s.CreateSnapshot("derived", "job", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.storage.GetActivePath("derived@job"), "etc", "motd"), []byte("back\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CommitSnapshot("derived", "job", "third"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "third", fsm.StateActive)
+	if img, _ := s.meta.GetImage("third"); img.Parent != "derived" {
+		t.Fatalf("third has parent %q", img.Parent)
+	}
+	third := s.storage.GetActivePath("third")
+	if read(t, filepath.Join(third, "etc", "hostname")) != "derived\n" || read(t, filepath.Join(third, "etc", "motd")) != "back\n" {
+		t.Error("third does not have the changes of both commits")
+	}
+
+	for _, tt := range []struct {
+		image, snapshot, name string
+		err                   error
+	}{
+		{"base", "", "derived", snapshots.ErrExists},
+		{"base", "", "../x", snapshots.ErrInvalidName},
+		{"base", "missing", "x", snapshots.ErrNotFound},
+		{"missing", "", "x", snapshots.ErrNotFound},
+	} {
+		if _, err := s.CommitSnapshot(tt.image, tt.snapshot, tt.name); !errors.Is(err, tt.err) {
+			t.Errorf("CommitSnapshot(%q, %q, %q) = %v, want %v", tt.image, tt.snapshot, tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCommitNeedsDiff(t *testing.T) {
+	s := newTestService(t, nil)
+	fetch(t, s, "base", map[string]string{"etc/hostname": "base\n"})
+
+	if _, err := s.CommitSnapshot("base", "", "derived"); !errors.Is(err, storage.ErrNotSupported) {
+		t.Fatalf("CommitSnapshot with the copy snapshotter = %v, want ErrNotSupported", err)
+	}
+	if n, _ := s.meta.CountImages(); n != 1 {
+		t.Fatalf("%d images after a failed commit", n)
+	}
+}
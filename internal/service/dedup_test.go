@@ -0,0 +1,138 @@
+package service
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imgstore/internal/config"
+	"imgstore/internal/storage"
+)
+
+// object returns the object that path is hardlinked to, or "".
+func object(t *testing.T, s *Service, path string) string {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found string
+	err = filepath.WalkDir(s.storage.GetObjectDir(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if oi, err := d.Info(); err == nil && os.SameFile(info, oi) {
+			found = p
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDedupSharesObjects(t *testing.T) {
+	cfg := config.Default()
+	cfg.Dedup = storage.DedupHardlink
+	s := newTestService(t, cfg)
+
+	shared := strings.Repeat("shared", 1000)
+	a := fetch(t, s, "a", map[string]string{"etc/shared": shared, "etc/a": "a\n"})
+	b := fetch(t, s, "b", map[string]string{"etc/shared": shared, "etc/b": "b\n"})
+	inA := filepath.Join(s.storage.GetLayerPath(a.Layer), "etc", "shared")
+	inB := filepath.Join(s.storage.GetLayerPath(b.Layer), "etc", "shared")
+
+	obj := object(t, s, inA)
+	if obj == "" || object(t, s, inB) != obj {
+		t.Fatalf("etc/shared of a and b are not one object: %q and %q", obj, object(t, s, inB))
+	}
+	stats, err := s.DedupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Saved != int64(len(shared)) {
+		t.Fatalf("DedupStats = %+v, want %d bytes saved", stats, len(shared))
+	}
+
+	// A write to the copy in b's snapshot stays there.
+	active := filepath.Join(s.storage.GetActivePath("b"), "etc", "shared")
+	if err := os.Chmod(active, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(active, []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if read(t, obj) != shared || read(t, inB) != shared {
+		t.Fatal("a write to the snapshot reached the shared object")
+	}
+
+	// Deleting a keeps the object for b.
+	if err := s.RemoveImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "a", "")
+	if _, err := s.GC(false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if object(t, s, inB) != obj || read(t, obj) != shared {
+		t.Fatal("the object b uses was collected with a")
+	}
+
+	// Once nothing uses it, GC collects it.
+	if err := s.RemoveImage("b"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "b", "")
+	report, err := s.GC(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(obj) || report.Objects == 0 {
+		t.Fatalf("the unused object survived GC: %+v", report)
+	}
+}
+
+// TestDedupOverlayUpperDir checks that a file copied up into an overlay
+// upper dir is a new inode, leaving the object its lower file links to.
+func TestDedupOverlayUpperDir(t *testing.T) {
+	cfg := config.Default()
+	cfg.Dedup = storage.DedupHardlink
+	s := newOverlayService(t, cfg)
+
+	shared := strings.Repeat("shared", 1000)
+	fetch(t, s, "a", map[string]string{"etc/shared": shared, "etc/a": "a\n"})
+	b := fetch(t, s, "b", map[string]string{"etc/shared": shared, "etc/b": "b\n"})
+	inB := filepath.Join(s.storage.GetLayerPath(b.Layer), "etc", "shared")
+	obj := object(t, s, inB)
+	if obj == "" {
+		t.Fatal("etc/shared of b is not linked to an object")
+	}
+
+	if err := os.WriteFile(filepath.Join(s.storage.GetActivePath("b"), "etc", "shared"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upper := s.storage.Dir(filepath.Join("overlays", "b", "upper", "etc", "shared"))
+	if read(t, upper) != "changed\n" {
+		t.Fatal("the write did not go to the upper dir")
+	}
+	if read(t, obj) != shared || read(t, filepath.Join(s.storage.GetActivePath("a"), "etc", "shared")) != shared {
+		t.Fatal("a write to b's snapshot reached the shared object")
+	}
+	if object(t, s, upper) != "" {
+		t.Fatal("the upper dir file is linked to an object")
+	}
+}
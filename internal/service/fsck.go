@@ -0,0 +1,419 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"imgstore/internal/fsm"
+	"imgstore/internal/metadata"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
+	"imgstore/internal/types"
+)
+
+// fsck collects the problems found by Service.Fsck and repairs them as they
+// are found when asked to.
+type fsck struct {
+	repair bool
+	report types.FsckReport
+}
+
+func (f *fsck) problem(kind, target, detail string, fix func() error) {
+	p := types.FsckProblem{Kind: kind, Target: target, Detail: detail}
+	if f.repair && fix != nil {
+		if err := fix(); err != nil {
+			log.Printf("fsck: cannot repair %s %s: %v", kind, target, err)
+		} else {
+			p.Repaired = true
+			f.report.Repaired++
+		}
+	}
+	f.report.Problems = append(f.report.Problems, p)
+}
+
+// Fsck checks that the catalog and the store directory agree: layers and
+// blobs the catalog relies on exist, rows are in states the files allow,
+// nothing in the store is unknown to the catalog and the mounts are the
+// ones the catalog expects. With repair, images are sent back through the
+// worker to rebuild what is missing, and what nothing refers to is removed.
+// The worker and server should not be running meanwhile; dirs they may be
+// about to record are only reported once older than the GC grace period.
+func (s *Service) Fsck(repair bool) (types.FsckReport, error) {
+	f := &fsck{repair: repair, report: types.FsckReport{Problems: []types.FsckProblem{}}}
+	for _, check := range []func(*fsck) error{s.fsckLayers, s.fsckImages, s.fsckBlobs, s.fsckRows, s.fsckMounts, s.fsckDirs} {
+		if err := check(f); err != nil {
+			return f.report, err
+		}
+	}
+	return f.report, nil
+}
+
+// fsckLayers drops the layers whose tree or manifest is gone; the images
+// using them are caught by fsckImages.
+func (s *Service) fsckLayers(f *fsck) error {
+	layers, err := s.meta.ListLayers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		for _, path := range []string{s.storage.GetLayerPath(layer.ID), s.storage.GetLayerManifestPath(layer.ID)} {
+			if _, err := os.Stat(path); err != nil {
+				id := layer.ID
+				f.problem("missing-layer", id, fmt.Sprintf("%s is missing", path), func() error {
+					return s.meta.DeleteLayer(id)
+				})
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// fsckImages resets images whose state claims files that are not there to
+// the last state they can be rebuilt from.
+func (s *Service) fsckImages(f *fsck) error {
+	images, err := s.meta.ListImages()
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		img := img
+		state := fsm.State(img.State)
+		if !fsm.Valid(state) {
+			f.problem("impossible-state", img.Name, fmt.Sprintf("unknown state %q", img.State), func() error {
+				return s.resetImage(img, fsm.StateFailed)
+			})
+			continue
+		}
+
+		blob := s.cache.Exists(img.Checksum)
+		switch state {
+		case fsm.StateUnpacked, fsm.StateStored, fsm.StateActivating, fsm.StateActive:
+			rootfs, err := s.layers.Rootfs(img.Name)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(rootfs); err == nil {
+				continue
+			}
+			to := s.rebuildFrom(img, blob)
+			f.problem("missing-rootfs", img.Name, fmt.Sprintf("%s but %s is missing, resetting to %s", img.State, rootfs, to), func() error {
+				mounted, err := s.snapshotter.Mounted()
+				if err != nil {
+					return err
+				}
+				if mounted[img.Name] {
+					if err := s.snapshotter.Unmount(img.Name); err != nil {
+						return err
+					}
+				}
+				if err := s.meta.SetLayer(img.Name, ""); err != nil {
+					return err
+				}
+				return s.resetImage(img, to)
+			})
+
+		case fsm.StateDownloaded, fsm.StateUnpacking:
+			if blob {
+				continue
+			}
+			to := s.rebuildFrom(img, false)
+			f.problem("missing-blob", img.Name, fmt.Sprintf("%s but blob %s is missing, resetting to %s", img.State, img.Checksum, to), func() error {
+				return s.resetImage(img, to)
+			})
+		}
+	}
+	return nil
+}
+
+// rebuildFrom returns the state the worker can rebuild an image from: its
+// blob if that is cached, otherwise its URL. Committed images have no URL.
+func (s *Service) rebuildFrom(img metadata.Image, blob bool) fsm.State {
+	switch {
+	case blob:
+		return fsm.StateDownloaded
+	case img.BlobKey != "":
+		return fsm.StateNew
+	}
+	return fsm.StateFailed
+}
+
+func (s *Service) resetImage(img metadata.Image, to fsm.State) error {
+	ok, err := s.meta.SetState(img.ID, img.State, string(to))
+	if err == nil && !ok {
+		err = fmt.Errorf("image %s changed state", img.Name)
+	}
+	return err
+}
+
+// fsckBlobs reports blob records whose file is gone when no image can
+// download it again, which leaves a committed image without its layer.
+// Evicted blobs of fetched images are expected to be missing. Repairing
+// drops the records; images that still need the blob are caught by
+// fsckImages.
+func (s *Service) fsckBlobs(f *fsck) error {
+	checksums, err := s.meta.BlobChecksums()
+	if err != nil {
+		return err
+	}
+	for _, checksum := range checksums {
+		if s.cache.Exists(checksum) {
+			continue
+		}
+		images, err := s.meta.ImagesWithChecksum(checksum)
+		if err != nil {
+			return err
+		}
+		refetchable := false
+		for _, img := range images {
+			refetchable = refetchable || img.BlobKey != ""
+		}
+		if refetchable {
+			continue
+		}
+		checksum := checksum
+		f.problem("missing-blob-file", checksum, fmt.Sprintf("%s is missing and cannot be downloaded again", s.cache.GetPath(checksum)), func() error {
+			return s.meta.DeleteBlob(checksum)
+		})
+	}
+	return nil
+}
+
+// fsckRows drops the blob and snapshot records of deleted images.
+func (s *Service) fsckRows(f *fsck) error {
+	n, err := s.meta.OrphanBlobs()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		f.problem("orphan-rows", "blobs", fmt.Sprintf("%d blob records of deleted images", n), s.meta.PruneBlobs)
+	}
+	n, err = s.meta.OrphanSnapshots()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		f.problem("orphan-rows", "snapshots", fmt.Sprintf("%d snapshots of deleted images", n), s.meta.PruneSnapshots)
+	}
+	return nil
+}
+
+// fsckMounts compares the mounts with the catalog, and repairs them the way
+// the worker does on start. Mounts of unknown keys are left to fsckDirs. A
+// process with private mounts cannot see the ones the catalog records.
+func (s *Service) fsckMounts(f *fsck) error {
+	if s.snapshots.Private() {
+		log.Printf("fsck: mounts are private to each process here, not checking them")
+		return nil
+	}
+	mounted, err := s.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	known, err := s.snapshotKeys()
+	if err != nil {
+		return err
+	}
+
+	// ACTIVATING images may or may not be mounted yet.
+	expected := make(map[string]bool)
+	var required []string
+	images, err := s.meta.ImagesInState(string(fsm.StateActivating), string(fsm.StateActive))
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		expected[img.Name] = true
+		if fsm.State(img.State) == fsm.StateActive {
+			required = append(required, img.Name)
+		}
+	}
+	active, err := s.meta.ActiveSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range active {
+		key := snapshots.Key(snap.Image, snap.Name)
+		expected[key] = true
+		required = append(required, key)
+	}
+
+	var reconciled bool
+	var reconcileErr error
+	reconcile := func() error {
+		if !reconciled {
+			reconciled = true
+			reconcileErr = s.snapshots.Reconcile()
+		}
+		return reconcileErr
+	}
+
+	for _, key := range required {
+		if !mounted[key] {
+			f.problem("missing-mount", key, fmt.Sprintf("%s is not mounted", s.storage.GetActivePath(key)), reconcile)
+		}
+	}
+	// A copy snapshotter cannot tell a mounted snapshot from a kept one.
+	if _, ok := s.snapshotter.(*storage.OverlayStorage); !ok {
+		return nil
+	}
+	var stray []string
+	for key := range mounted {
+		if known[key] && !expected[key] {
+			stray = append(stray, key)
+		}
+	}
+	sort.Strings(stray)
+	for _, key := range stray {
+		f.problem("stray-mount", key, fmt.Sprintf("%s is mounted but inactive", s.storage.GetActivePath(key)), reconcile)
+	}
+	return nil
+}
+
+// snapshotKeys returns the key of every image and named snapshot.
+func (s *Service) snapshotKeys() (map[string]bool, error) {
+	images, err := s.meta.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, img := range images {
+		keys[img.Name] = true
+		snaps, err := s.meta.ListSnapshots(img.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snaps {
+			keys[snapshots.Key(img.Name, snap.Name)] = true
+		}
+	}
+	return keys, nil
+}
+
+// fsckDirs removes what the catalog does not know about from layers/,
+// images/, staging/ and the snapshot dirs. A worker builds layers, staging
+// dirs and copies under .tmp names before recording them, so those are left
+// alone until they are older than the GC grace period.
+func (s *Service) fsckDirs(f *fsck) error {
+	root := filepath.Dir(s.storage.GetBlobDir())
+	cutoff := time.Now().Add(-s.config.GCGracePeriod())
+	orphan := func(path, detail string) {
+		if fi, err := os.Lstat(path); err != nil || fi.ModTime().After(cutoff) {
+			return
+		}
+		f.problem("orphan-dir", path, detail, func() error { return os.RemoveAll(path) })
+	}
+
+	layers, err := subdirs(filepath.Join(root, "layers"))
+	if err != nil {
+		return err
+	}
+	for _, id := range layers {
+		if _, err := s.meta.GetLayer(id); err == nil {
+			continue
+		} else if !errors.Is(err, metadata.ErrNotFound) {
+			return err
+		}
+		orphan(filepath.Join(root, "layers", id), "no such layer")
+	}
+
+	states := make(map[string]fsm.State)
+	images, err := s.meta.ListImages()
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		states[img.Name] = fsm.State(img.State)
+	}
+
+	legacy, err := subdirs(filepath.Join(root, "images"))
+	if err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		if _, ok := states[name]; !ok {
+			orphan(filepath.Join(root, "images", name), "no such image")
+		}
+	}
+
+	staging, err := subdirs(filepath.Join(root, "staging"))
+	if err != nil {
+		return err
+	}
+	for _, name := range staging {
+		switch states[name] {
+		case fsm.StateDownloading, fsm.StateDownloaded, fsm.StateUnpacking:
+			continue
+		}
+		orphan(filepath.Join(root, "staging", name), "no image is being extracted there")
+	}
+
+	known, err := s.snapshotKeys()
+	if err != nil {
+		return err
+	}
+	mounted, err := s.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	orphans := make(map[string]bool)
+	for key := range mounted {
+		if !known[key] {
+			orphans[key] = true
+		}
+	}
+	for _, dir := range []string{"active", "overlays"} {
+		keys, err := subdirs(filepath.Join(root, dir))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".tmp") {
+				orphan(filepath.Join(root, dir, key), "left by an interrupted activation")
+			} else if !known[key] {
+				orphans[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(orphans))
+	for key := range orphans {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		key := key
+		f.problem("orphan-snapshot", key, "no such image or snapshot", func() error {
+			if mounted[key] {
+				if err := s.snapshotter.Unmount(key); err != nil {
+					return err
+				}
+			}
+			return s.snapshotter.Remove(key)
+		})
+	}
+	return nil
+}
+
+// subdirs lists the dirs in dir, which may not exist.
+func subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imgstore/internal/fsm"
+	"imgstore/internal/metadata"
+	"imgstore/internal/types"
+)
+
+func TestFsck(t *testing.T) {
+	s := newTestService(t, nil)
+
+	layerless := fetch(t, s, "layerless", map[string]string{"etc/hostname": "layerless\n"})
+	weird := fetch(t, s, "weird", map[string]string{"etc/hostname": "weird\n"})
+	gone := fetch(t, s, "gone", map[string]string{"etc/hostname": "gone\n"})
+	if _, err := s.CreateSnapshot("gone", "s1", 0); err != nil {
+		t.Fatal(err)
+	}
+	fetch(t, s, "unmounted", map[string]string{"etc/hostname": "unmounted\n"})
+	data := tarball(t, map[string]string{"etc/hostname": "blobless\n"})
+	if err := s.EnqueueImage(context.Background(), "blobless", serve(t, data), digest(data), ""); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "blobless", fsm.StateDownloaded)
+
+	// A layer whose tree is gone.
+	if err := os.RemoveAll(s.storage.Dir(filepath.Join("layers", layerless.Layer))); err != nil {
+		t.Fatal(err)
+	}
+	// A downloaded image whose blob is gone.
+	if err := os.Remove(s.cache.GetPath(digest(data))); err != nil {
+		t.Fatal(err)
+	}
+	// An image in a state the FSM does not know.
+	if _, err := s.meta.SetState(weird.ID, weird.State, "BOGUS"); err != nil {
+		t.Fatal(err)
+	}
+	// An image deleted from the catalog alone, leaving its rows and trees.
+	if err := s.meta.MarkDeleting("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.meta.DeleteImage(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+	// An ACTIVE image that is not mounted.
+	if err := s.snapshotter.Remove("unmounted"); err != nil {
+		t.Fatal(err)
+	}
+	// The blob of a committed image, which cannot be downloaded again.
+	lost := digest([]byte("lost"))
+	ids, err := s.meta.CreateImages(metadata.Image{Name: "lost", Checksum: lost, State: string(fsm.StateFailed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.meta.MarkBlobUsed(ids[0], s.cache.GetPath(lost), lost, 4, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Directories nothing refers to, since before the grace period.
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{"layers/stray", "images/stray", "staging/stray", "active/stray.tmp"} {
+		if err := os.MkdirAll(s.storage.Dir(dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(s.storage.Dir(dir), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"missing-layer " + layerless.Layer,
+		"missing-rootfs layerless",
+		"impossible-state weird",
+		"missing-blob blobless",
+		"missing-blob-file " + lost,
+		"orphan-rows blobs",
+		"orphan-rows snapshots",
+		"missing-mount unmounted",
+		"orphan-dir " + s.storage.Dir("layers/stray"),
+		"orphan-dir " + s.storage.Dir("images/stray"),
+		"orphan-dir " + s.storage.Dir("staging/stray"),
+		"orphan-dir " + s.storage.Dir("active/stray.tmp"),
+		"orphan-snapshot gone",
+		"orphan-snapshot gone@s1",
+	}
+	report, err := s.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problems(report.Problems); !equal(got, want) || report.Repaired != 0 {
+		t.Fatalf("Fsck = %q, %d repaired, want %q", got, report.Repaired, want)
+	}
+	if state, _ := s.GetImageStatus("weird"); state != "BOGUS" {
+		t.Fatalf("Fsck without -repair changed weird to %s", state)
+	}
+
+	report, err = s.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problems(report.Problems); !equal(got, want) || report.Repaired != len(want) {
+		t.Fatalf("Fsck -repair = %q, %d repaired", got, report.Repaired)
+	}
+	// A copy cannot be remounted, so unmounted goes back to be activated.
+	for name, state := range map[string]fsm.State{"layerless": fsm.StateDownloaded, "blobless": fsm.StateNew,
+		"weird": fsm.StateFailed, "unmounted": fsm.StateStored} {
+		if got, _ := s.GetImageStatus(name); fsm.State(got) != state {
+			t.Errorf("%s was reset to %s, want %s", name, got, state)
+		}
+	}
+	for _, path := range []string{s.storage.Dir("layers/stray"), s.storage.GetActivePath("gone"), s.storage.GetActivePath("gone@s1")} {
+		if exists(path) {
+			t.Errorf("%s survived the repair", path)
+		}
+	}
+	// The worker rebuilds what was reset, after which all is well.
+	process(t, s, "layerless", fsm.StateActive)
+	process(t, s, "blobless", fsm.StateActive)
+	process(t, s, "unmounted", fsm.StateActive)
+	report, err = s.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("Fsck after the repair = %q", problems(report.Problems))
+	}
+}
+
+// problems lists the kind and target of each problem.
+func problems(list []types.FsckProblem) []string {
+	var got []string
+	for _, p := range list {
+		got = append(got, p.Kind+" "+p.Target)
+	}
+	return got
+}
+
+// equal compares two lists in any order.
+func equal(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range got {
+		count[s]++
+	}
+	for _, s := range want {
+		if count[s]--; count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// TestFsckSparesLayerBeingAdded runs a repair while a worker has moved a
+// new layer into layers/ but not recorded it yet.
+func TestFsckSparesLayerBeingAdded(t *testing.T) {
+	s := newTestService(t, nil)
+	img := fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+	layer, err := s.meta.GetLayer(img.Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.meta.DeleteLayer(img.Layer); err != nil {
+		t.Fatal(err)
+	}
+	dir := s.storage.Dir(filepath.Join("layers", img.Layer))
+
+	report, err := s.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range report.Problems {
+		if p.Target == dir {
+			t.Fatalf("Fsck -repair reported the new layer: %+v", p)
+		}
+	}
+	if !exists(dir) {
+		t.Fatal("Fsck -repair removed a layer before it was recorded")
+	}
+
+	// Once the worker records it, all is well.
+	if err := s.meta.PutLayer(layer); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = s.Fsck(false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("Fsck = %q, %v", problems(report.Problems), err)
+	}
+}
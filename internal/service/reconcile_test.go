@@ -0,0 +1,118 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"imgstore/internal/config"
+	"imgstore/internal/fsm"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
+)
+
+// mountTable stands in for the kernel's mount table on top of a copy
+// snapshotter: what is mounted is whatever the test says, and keys in
+// broken fail to mount.
+type mountTable struct {
+	storage.Snapshotter
+	mounted   map[string]bool
+	broken    map[string]bool
+	unmounted []string
+}
+
+func (m *mountTable) Mount(key string) (string, error) {
+	if m.broken[key] {
+		return "", fmt.Errorf("mount %s: no such device", key)
+	}
+	dir, err := m.Snapshotter.Mount(key)
+	if err == nil {
+		m.mounted[key] = true
+	}
+	return dir, err
+}
+
+func (m *mountTable) Unmount(key string) error {
+	delete(m.mounted, key)
+	m.unmounted = append(m.unmounted, key)
+	return nil
+}
+
+func (m *mountTable) Mounted() (map[string]bool, error) {
+	mounted := make(map[string]bool)
+	for key := range m.mounted {
+		mounted[key] = true
+	}
+	return mounted, nil
+}
+
+func (m *mountTable) keys() []string {
+	var keys []string
+	for key := range m.mounted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReconcile(t *testing.T) {
+	cfg := config.Default()
+	cfg.UnmountOnShutdown = true
+	s := newTestService(t, cfg)
+	table := &mountTable{Snapshotter: s.snapshotter, mounted: map[string]bool{}, broken: map[string]bool{}}
+	s.snapshotter = table
+	s.snapshots = snapshots.NewManager(s.meta, s.storage, table, s.cache, s.layers)
+
+	for _, name := range []string{"a", "b", "c"} {
+		fetch(t, s, name, map[string]string{"etc/hostname": name + "\n"})
+	}
+	for _, key := range [][2]string{{"a", "s1"}, {"b", "s2"}} {
+		if _, err := s.CreateSnapshot(key[0], key[1], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := table.keys(); !equal(got, []string{"a", "a@s1", "b", "b@s2", "c"}) {
+		t.Fatalf("mounted %q", got)
+	}
+
+	// A graceful shutdown unmounts everything but leaves the catalog alone.
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.mounted) != 0 {
+		t.Fatalf("still mounted after shutdown: %q", table.keys())
+	}
+	if state, _ := s.GetImageStatus("a"); state != string(fsm.StateActive) {
+		t.Fatalf("shutdown changed a to %s", state)
+	}
+
+	// After the restart the copy of c is gone, b@s2 cannot be mounted and
+	// something else was mounted below active/.
+	if err := table.Snapshotter.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	table.unmounted = nil
+	table.mounted = map[string]bool{"ghost": true}
+	table.broken = map[string]bool{"b@s2": true}
+	if err := s.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := table.keys(); !equal(got, []string{"a", "a@s1", "b"}) {
+		t.Errorf("mounted after reconciling %q", got)
+	}
+	if !equal(table.unmounted, []string{"ghost"}) {
+		t.Errorf("unmounted %q, want the stray mount", table.unmounted)
+	}
+	if state, _ := s.GetImageStatus("c"); state != string(fsm.StateStored) {
+		t.Errorf("c is %s, want STORED to be activated again", state)
+	}
+	if snap, err := s.GetSnapshot("b", "s2"); err != nil || snap.Active {
+		t.Errorf("b@s2 = %+v, %v, want inactive", snap, err)
+	}
+
+	// The worker activates c again from its layer.
+	process(t, s, "c", fsm.StateActive)
+	if !table.mounted["c"] {
+		t.Error("c is ACTIVE but not mounted")
+	}
+}
@@ -0,0 +1,924 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imgstore/internal/bundle"
+	"imgstore/internal/cache"
+	"imgstore/internal/config"
+	"imgstore/internal/downloader"
+	"imgstore/internal/export"
+	"imgstore/internal/extractor"
+	"imgstore/internal/fsm"
+	"imgstore/internal/layers"
+	"imgstore/internal/manifest"
+	"imgstore/internal/metadata"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
+	"imgstore/internal/types"
+)
+
+type Service struct {
+	meta        metadata.Store
+	storage     *storage.Layout
+	snapshotter storage.Snapshotter
+	downloader  *downloader.Downloader
+	cache       *cache.BlobCache
+	layers      *layers.Store
+	objects     *storage.ObjectStore
+	snapshots   *snapshots.Manager
+	exports     *export.Cache
+	config      *config.Config
+}
+
+func NewService(meta metadata.Store, root string, cfg *config.Config) (*Service, error) {
+	snapshotter, err := storage.New(cfg.Snapshotter, root)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := storage.NewLayout(root)
+	objects, err := storage.NewObjectStore(cfg.Dedup, layout.GetObjectDir())
+	if err != nil {
+		return nil, err
+	}
+	blobs := cache.NewBlobCache(meta, root)
+	blobs.Pin(cfg.PinnedBlobs...)
+	shared := layers.NewStore(meta, layout)
+	return &Service{
+		meta:        meta,
+		storage:     layout,
+		snapshotter: snapshotter,
+		downloader:  downloader.NewWithPeers(cfg.Peers),
+		cache:       blobs,
+		layers:      shared,
+		objects:     objects,
+		snapshots:   snapshots.NewManager(meta, layout, snapshotter, blobs, shared),
+		exports:     export.NewCache(layout.GetExportDir()),
+		config:      cfg,
+	}, nil
+}
+
+func (s *Service) Init() error {
+	if err := s.storage.Init(); err != nil {
+		return err
+	}
+	return s.snapshotter.Init()
+}
+
+// OneShot tells the service that the process exits after one command. In
+// the private mount namespace storage.ReexecRootless makes, its mounts would
+// vanish with it while the catalog still recorded them, so the commands that
+// mount or unmount are refused there.
+func (s *Service) OneShot() {
+	if storage.PrivateMounts() {
+		s.snapshots.RefuseMounts()
+	}
+}
+
+func (s *Service) EnqueueImage(ctx context.Context, name, blobURL, checksum, policy string) error {
+	if err := snapshots.ValidName(name); err != nil {
+		return err
+	}
+	if !cache.ValidDigest(checksum) {
+		return fmt.Errorf("image %s: invalid checksum %q", name, checksum)
+	}
+	if _, err := s.config.Policy(policy); err != nil {
+		return err
+	}
+	return s.meta.EnqueueImage(metadata.Image{Name: name, BlobKey: blobURL, Checksum: checksum, State: string(fsm.StateNew), Policy: policy})
+}
+
+func (s *Service) RunWorker(ctx context.Context) {
+	if every := s.config.ScrubEvery(); every > 0 {
+		go s.scrub(ctx, every)
+	}
+	var lastUsage time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			s.processNextImage(ctx)
+			if time.Since(lastUsage) >= s.config.UsageEvery() {
+				if err := s.snapshots.RefreshUsage(); err != nil {
+					log.Printf("Usage refresh failed: %v", err)
+				}
+				if err := s.evict(); err != nil {
+					log.Printf("Blob eviction failed: %v", err)
+				}
+				lastUsage = time.Now()
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+func (s *Service) processNextImage(ctx context.Context) {
+	pending, err := s.meta.ImagesInState(string(fsm.StateNew), string(fsm.StateDownloading), string(fsm.StateDownloaded),
+		string(fsm.StateUnpacking), string(fsm.StateUnpacked), string(fsm.StateStored), string(fsm.StateActivating), string(fsm.StateDeleting))
+	if err != nil {
+		return
+	}
+
+	for _, row := range pending {
+		if row.State == string(fsm.StateStored) && row.Deactivated {
+			continue
+		}
+		img := imageInfo(row)
+		currentState := fsm.State(img.State)
+		if currentState == fsm.StateDeleting {
+			if err := s.deleteImage(img); err != nil {
+				log.Printf("Image %s: delete failed, will retry: %v", img.Name, err)
+			}
+			continue
+		}
+
+		nextState := fsm.NextState(currentState)
+		if !fsm.CanTransition(currentState, nextState) {
+			continue
+		}
+		if img.Parent != "" && nextState == fsm.StateUnpacked && s.parentPending(img.Parent) {
+			continue // Loaded from a bundle along with its parent
+		}
+
+		if err := s.executeTransition(ctx, img, currentState, nextState); err != nil {
+			log.Printf("Image %s: %s -> %s failed: %v", img.Name, currentState, nextState, err)
+			s.setState(img.ID, currentState, fsm.StateFailed)
+		} else {
+			s.setState(img.ID, currentState, nextState)
+		}
+	}
+}
+
+// parentPending reports whether the parent of a derived image has yet to be
+// extracted.
+func (s *Service) parentPending(parent string) bool {
+	img, err := s.meta.GetImage(parent)
+	if err != nil {
+		return false
+	}
+	switch fsm.State(img.State) {
+	case fsm.StateNew, fsm.StateDownloading, fsm.StateDownloaded, fsm.StateUnpacking:
+		return true
+	}
+	return false
+}
+
+func (s *Service) executeTransition(ctx context.Context, img types.ImageInfo, from, to fsm.State) error {
+	switch to {
+	case fsm.StateDownloading:
+		return nil // Just mark as downloading
+	case fsm.StateDownloaded:
+		if s.config.Streaming {
+			if err := s.streamBlob(ctx, img); err != nil {
+				return err
+			}
+		} else if err := s.downloadBlob(ctx, img.BlobKey, img.Checksum); err != nil {
+			return err
+		}
+		if err := s.cache.MarkUsed(img.Checksum, img.ID); err != nil {
+			return err
+		}
+		// The new blob may have pushed the cache over its budget.
+		if err := s.evict(); err != nil {
+			log.Printf("Blob eviction failed: %v", err)
+		}
+		return nil
+	case fsm.StateUnpacking:
+		return nil // Just mark as unpacking
+	case fsm.StateUnpacked:
+		// The layer exists when another image has the same content, or
+		// when streaming extracted it while downloading.
+		linked, err := s.linkLayer(img)
+		if err != nil {
+			return err
+		}
+		if !linked {
+			if err := s.unpackBlob(img); err != nil {
+				return err
+			}
+		}
+		return s.snapshots.RecordImageUsage(img.Name)
+	case fsm.StateStored:
+		return nil // For overlay, no additional storage step needed
+	case fsm.StateActivating:
+		return nil // Just mark as activating
+	case fsm.StateActive:
+		return s.activate(img.Name)
+	}
+	return nil
+}
+
+func (s *Service) activate(name string) error {
+	return s.snapshots.Activate(name)
+}
+
+func (s *Service) downloadBlob(ctx context.Context, blobURL, expectedChecksum string) error {
+	blobPath := s.cache.GetPath(expectedChecksum)
+
+	// Check cache first
+	if cached, err := s.cached(ctx, expectedChecksum); cached || err != nil {
+		if err != nil {
+			return err
+		}
+		log.Printf("Blob %s already cached", expectedChecksum[:12])
+		return s.cache.Hit(expectedChecksum)
+	}
+
+	// Download with progress
+	log.Printf("Downloading blob %s...", expectedChecksum[:12])
+	if err := s.cache.Miss(); err != nil {
+		return err
+	}
+	if err := s.downloader.Download(ctx, blobURL, blobPath, expectedChecksum, logProgress); err != nil {
+		return err
+	}
+	return s.cache.Downloaded(expectedChecksum)
+}
+
+// cached reports whether the blob is in the cache. With verify_cache_hits
+// it is re-hashed first, and quarantined if it no longer matches.
+func (s *Service) cached(ctx context.Context, checksum string) (bool, error) {
+	if !s.cache.Exists(checksum) {
+		return false, nil
+	}
+	if !s.config.VerifyCacheHits {
+		return true, nil
+	}
+	valid, err := s.cache.Verify(ctx, checksum, 0)
+	if err != nil || valid {
+		return valid, err
+	}
+	log.Printf("Blob %s is corrupt, moved to quarantine", checksum[:12])
+	return false, s.cache.Quarantine(checksum)
+}
+
+func logProgress(downloaded, total int64) {
+	if total > 0 {
+		percent := float64(downloaded) / float64(total) * 100
+		log.Printf("Progress: %.1f%% (%d/%d bytes)", percent, downloaded, total)
+	}
+}
+
+// streamBlob downloads a blob and extracts it in the same pass. The rootfs is
+// built in a staging dir and only promoted once the checksum has verified.
+func (s *Service) streamBlob(ctx context.Context, img types.ImageInfo) error {
+	cached, err := s.cached(ctx, img.Checksum)
+	if err != nil {
+		return err
+	}
+	if cached {
+		log.Printf("Blob %s already cached", img.Checksum[:12])
+		if err := s.cache.Hit(img.Checksum); err != nil {
+			return err
+		}
+		if linked, err := s.linkLayer(img); linked || err != nil {
+			return err
+		}
+		return s.unpackBlob(img)
+	}
+	if id, _, err := s.layerID(img); err == nil && s.layers.Has(id) {
+		return s.downloadBlob(ctx, img.BlobKey, img.Checksum)
+	}
+
+	policy, err := s.config.Policy(img.Policy)
+	if err != nil {
+		return err
+	}
+	ext := extractor.NewWithPolicy(policy)
+	staging := s.storage.GetStagingPath(img.Name)
+	defer os.RemoveAll(staging)
+
+	log.Printf("Streaming blob %s into %s", img.Checksum[:12], img.Name)
+	if err := s.cache.Miss(); err != nil {
+		return err
+	}
+	var files []manifest.Entry
+	consume := func(r io.Reader) error {
+		if err := resetDir(staging); err != nil {
+			return err
+		}
+		files, err = ext.ExtractReader(r, staging)
+		if errors.Is(err, extractor.ErrRejected) {
+			return downloader.Permanent(err)
+		}
+		return err
+	}
+	if err := s.downloader.DownloadStream(ctx, img.BlobKey, s.cache.GetPath(img.Checksum), img.Checksum, logProgress, consume); err != nil {
+		return err
+	}
+	if err := s.cache.Downloaded(img.Checksum); err != nil {
+		return err
+	}
+	return s.promote(staging, img, files)
+}
+
+func (s *Service) verifyChecksum(path, expected string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	actual := fmt.Sprintf("%x", hash.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+func (s *Service) unpackBlob(img types.ImageInfo) error {
+	policy, err := s.config.Policy(img.Policy)
+	if err != nil {
+		return err
+	}
+	ext := extractor.NewWithPolicy(policy)
+
+	blobPath := s.cache.GetPath(img.Checksum)
+	staging := s.storage.GetStagingPath(img.Name)
+	defer os.RemoveAll(staging)
+
+	if img.Parent != "" {
+		return s.unpackLayer(ext, img, staging)
+	}
+
+	if err := resetDir(staging); err != nil {
+		return err
+	}
+
+	log.Printf("Extracting blob %s to %s", img.Checksum[:12], img.Name)
+	files, err := ext.Extract(blobPath, staging)
+	if err != nil {
+		return err
+	}
+	return s.promote(staging, img, files)
+}
+
+// unpackLayer builds a derived image by cloning its parent's rootfs and
+// applying the image's layer blob on top.
+func (s *Service) unpackLayer(ext *extractor.Extractor, img types.ImageInfo, staging string) error {
+	manifestPath, err := s.layers.ManifestPath(img.Parent)
+	if err != nil {
+		return fmt.Errorf("parent %s: %v", img.Parent, err)
+	}
+	base, err := manifest.Load(manifestPath)
+	if err != nil {
+		return fmt.Errorf("parent %s: %v", img.Parent, err)
+	}
+	parentRootfs, err := s.layers.Rootfs(img.Parent)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := storage.CloneTree(parentRootfs, staging); err != nil {
+		return err
+	}
+
+	log.Printf("Applying layer %s from %s to %s", img.Checksum[:12], img.Parent, img.Name)
+	files, err := ext.ExtractLayer(s.cache.GetPath(img.Checksum), staging, base)
+	if err != nil {
+		return err
+	}
+	return s.promote(staging, img, files)
+}
+
+// promote moves a fully extracted staging dir into the layer store, with
+// its file manifest, and points the image at it.
+func (s *Service) promote(staging string, img types.ImageInfo, files []manifest.Entry) error {
+	id, parent, err := s.layerID(img)
+	if err != nil {
+		return err
+	}
+	policy, err := s.config.Policy(img.Policy)
+	if err != nil {
+		return err
+	}
+	// A tree that is only partly deduplicated is still whole, so failing
+	// here costs space but not the image.
+	shared, saved, err := s.objects.Dedup(staging, files, policy.PreserveTimes)
+	if err != nil {
+		log.Printf("Deduplicating %s: %v", img.Name, err)
+	}
+	if shared > 0 {
+		log.Printf("Deduplicated %d files of %s, saving %d bytes", shared, img.Name, saved)
+	}
+	if err := s.layers.Add(id, parent, img.Checksum, staging, files); err != nil {
+		return err
+	}
+	return s.layers.Link(img.Name, id)
+}
+
+// layerID returns the layer an image's tree is stored as and the layer it is
+// built on. A parent extracted before layers were shared is identified by
+// name instead.
+func (s *Service) layerID(img types.ImageInfo) (string, string, error) {
+	policy, err := s.config.Policy(img.Policy)
+	if err != nil {
+		return "", "", err
+	}
+	var parent string
+	if img.Parent != "" {
+		if parent, err = s.layers.Layer(img.Parent); err != nil {
+			return "", "", err
+		}
+		if parent == "" {
+			parent = "image:" + img.Parent
+		}
+	}
+	return layers.ID(parent, img.Checksum, extractor.NewWithPolicy(policy).Policy()), parent, nil
+}
+
+// linkLayer points an image at an existing layer with the same content, if
+// there is one, so that it need not be extracted.
+func (s *Service) linkLayer(img types.ImageInfo) (bool, error) {
+	id, _, err := s.layerID(img)
+	if err != nil || !s.layers.Has(id) {
+		return false, err
+	}
+	log.Printf("Image %s shares layer %s", img.Name, id[:12])
+	return true, s.layers.Link(img.Name, id)
+}
+
+func resetDir(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// setState moves an image on only if it is still in state from, so that a
+// deletion requested while a transition was running is not overwritten.
+func (s *Service) setState(id int, from, to fsm.State) {
+	s.meta.SetState(id, string(from), string(to))
+}
+
+// deleteImage tears an image down in the reverse order it was built:
+// snapshots and mounts, then its directories, then its blob reference and
+// finally the row. Every step tolerates having run before, so a deletion
+// that fails part way is retried on the next pass.
+func (s *Service) deleteImage(img types.ImageInfo) error {
+	// A derived image is built from its parent's rootfs; wait until no
+	// child still needs it.
+	children, err := s.meta.Children(img.Name)
+	if err != nil {
+		return err
+	}
+	var building int
+	for _, child := range children {
+		switch fsm.State(child.State) {
+		case fsm.StateNew, fsm.StateDownloading, fsm.StateDownloaded, fsm.StateUnpacking:
+			building++
+		}
+	}
+	if building > 0 {
+		return fmt.Errorf("%d derived images are still being built from it", building)
+	}
+
+	// Names are validated when images are added, but nothing is removed
+	// for a row that would reach outside the store all the same.
+	dirs := []string{filepath.Dir(s.storage.GetImagePath(img.Name)), s.storage.GetStagingPath(img.Name)}
+	for i, parent := range []string{"images", "staging"} {
+		if err := s.within(parent, dirs[i]); err != nil {
+			return err
+		}
+	}
+	if err := s.within("active", s.storage.GetActivePath(img.Name)); err != nil {
+		return err
+	}
+
+	if err := s.snapshots.RemoveAll(img.Name); err != nil {
+		return err
+	}
+	if err := s.layers.Release(img.Name); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	exports, _ := filepath.Glob(filepath.Join(s.storage.GetExportDir(), img.Name+".tar*"))
+	snapshotExports, _ := filepath.Glob(filepath.Join(s.storage.GetExportDir(), img.Name+"@*"))
+	for _, file := range append(exports, snapshotExports...) {
+		if s.within("exports", file) == nil {
+			os.Remove(file)
+		}
+	}
+
+	if err := s.cache.Release(img.Checksum, img.ID); err != nil {
+		return err
+	}
+	if err := s.meta.DeleteImage(img.ID); err != nil {
+		return err
+	}
+	log.Printf("Image %s deleted", img.Name)
+	return nil
+}
+
+// within checks that path is an entry directly in the store dir with the
+// given name, so that removing it cannot reach anything else.
+func (s *Service) within(dir, path string) error {
+	rel, err := filepath.Rel(s.storage.Dir(dir), path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") || strings.ContainsRune(rel, filepath.Separator) {
+		return fmt.Errorf("%s is outside %s", path, s.storage.Dir(dir))
+	}
+	return nil
+}
+
+func (s *Service) GetImageStatus(name string) (string, error) {
+	img, err := s.meta.GetImage(name)
+	return img.State, err
+}
+
+func (s *Service) ListFiles(name, prefix string) ([]manifest.Entry, error) {
+	path, err := s.layers.ManifestPath(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := manifest.Load(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no file manifest for image %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Filter(files, prefix), nil
+}
+
+func (s *Service) GetAllImages() ([]types.ImageInfo, error) {
+	rows, err := s.meta.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []types.ImageInfo
+	for _, row := range rows {
+		images = append(images, imageInfo(row))
+	}
+	return images, nil
+}
+
+func (s *Service) CreateSnapshot(image, name string, quota int64) (types.SnapshotInfo, error) {
+	return s.snapshots.Create(image, name, quota)
+}
+
+func (s *Service) GetImageUsage(name string) (types.ImageUsage, error) {
+	return s.snapshots.Usage(name)
+}
+
+func (s *Service) ListSnapshots(image string) ([]types.SnapshotInfo, error) {
+	return s.snapshots.List(image)
+}
+
+func (s *Service) GetSnapshot(image, name string) (types.SnapshotInfo, error) {
+	return s.snapshots.Get(image, name)
+}
+
+func (s *Service) RemoveSnapshot(image, name string) error {
+	return s.snapshots.Remove(image, name)
+}
+
+func (s *Service) CommitSnapshot(image, snapshot, newImage string) (string, error) {
+	return s.snapshots.Commit(image, snapshot, newImage)
+}
+
+// Export streams an image's rootfs, or a snapshot's merged view, as a
+// deterministic tar.
+func (s *Service) Export(w io.Writer, image, snapshot, compression string) error {
+	dir, err := s.snapshots.Path(image, snapshot)
+	if err != nil {
+		return err
+	}
+	return export.Write(w, dir, compression)
+}
+
+// ExportFile opens a cached export for serving with Range support. Image
+// exports are rebuilt when the rootfs is re-extracted. Snapshots change
+// under their users, so their exports are rebuilt on every request unless
+// resume asks for the bytes of the previous one.
+func (s *Service) ExportFile(image, snapshot, compression string, resume bool) (*export.File, error) {
+	dir, err := s.snapshots.Path(image, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	key := image
+	var since time.Time
+	if snapshot == "" {
+		if path, err := s.layers.ManifestPath(image); err == nil {
+			if fi, err := os.Stat(path); err == nil {
+				since = fi.ModTime()
+			}
+		}
+	} else {
+		key = snapshots.Key(image, snapshot)
+		if !resume {
+			since = time.Now()
+		}
+	}
+	return s.exports.Get(key, dir, compression, since)
+}
+
+func (s *Service) ActivateImage(name string) error {
+	return s.snapshots.Reactivate(name)
+}
+
+func (s *Service) DeactivateImage(name string, discard bool) error {
+	return s.snapshots.Deactivate(name, discard)
+}
+
+// RemoveImage marks an image DELETING; the worker unmounts it, removes its
+// files and then the row.
+func (s *Service) RemoveImage(name string) error {
+	return s.meta.MarkDeleting(name)
+}
+
+// Reconcile remounts what the database says is mounted and unmounts what it
+// does not know about.
+func (s *Service) Reconcile() error {
+	return s.snapshots.Reconcile()
+}
+
+// Shutdown unmounts every snapshot when the config asks for it. The
+// database is left alone, so Reconcile restores the mounts on next start.
+func (s *Service) Shutdown() error {
+	if !s.config.UnmountOnShutdown {
+		return nil
+	}
+	return s.snapshots.UnmountAll()
+}
+
+// GC collects unreferenced blobs and file objects, and cached exports older
+// than the grace period; a grace of 0 uses the configured one.
+func (s *Service) GC(dryRun bool, grace time.Duration) (types.GCReport, error) {
+	if grace <= 0 {
+		grace = s.config.GCGracePeriod()
+	}
+	report, err := s.cache.GC(dryRun, grace)
+	if err != nil {
+		return report, err
+	}
+	refs, err := s.layers.Contents()
+	if err != nil {
+		return report, err
+	}
+	report.Objects, report.ObjectBytes, err = s.objects.GC(dryRun, refs)
+	if err != nil {
+		return report, err
+	}
+	report.Exports, report.ExportBytes, err = s.exports.GC(dryRun, grace)
+	return report, err
+}
+
+// DedupStats reports the file object store and the space it saves.
+func (s *Service) DedupStats() (types.DedupStats, error) {
+	refs, err := s.layers.Contents()
+	if err != nil {
+		return types.DedupStats{}, err
+	}
+	return s.objects.Stats(refs)
+}
+
+// OpenBlob opens a cached blob to serve to a peer.
+func (s *Service) OpenBlob(checksum string) (*os.File, error) {
+	file, err := s.cache.Open(checksum)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.Touch(checksum); err != nil {
+		log.Printf("Blob %s: %v", checksum[:12], err)
+	}
+	return file, nil
+}
+
+// evict trims the blob cache to the configured budget.
+func (s *Service) evict() error {
+	budget, err := s.config.CacheBudgetBytes(s.storage.GetBlobDir())
+	if err != nil || budget == 0 {
+		return err
+	}
+	evicted, freed, err := s.cache.Evict(budget)
+	for _, checksum := range evicted {
+		log.Printf("Evicted blob %s", checksum[:12])
+	}
+	if len(evicted) > 0 {
+		log.Printf("Freed %d bytes of blob cache", freed)
+	}
+	return err
+}
+
+// CacheStats reports the blob cache counters and contents.
+func (s *Service) CacheStats() (types.CacheStats, error) {
+	stats, err := s.cache.Stats()
+	if err != nil {
+		return stats, err
+	}
+	stats.Budget, err = s.config.CacheBudgetBytes(s.storage.GetBlobDir())
+	return stats, err
+}
+
+// Pin protects an image's blob (kind "image") or a blob (kind "blob") from
+// garbage collection and eviction, for ttl if it is above 0.
+func (s *Service) Pin(kind, target, reason string, ttl time.Duration) (types.Pin, error) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Truncate(time.Second)
+	}
+	return s.cache.AddPin(kind, target, reason, expires)
+}
+
+func (s *Service) Unpin(kind, target string) error {
+	return s.cache.RemovePin(kind, target)
+}
+
+func (s *Service) ListPins() ([]types.Pin, error) {
+	return s.cache.Pins()
+}
+
+// VerifyCache re-hashes every cached blob and quarantines corrupt ones; a
+// rate of 0 uses the configured one.
+func (s *Service) VerifyCache(ctx context.Context, rate int64) (types.ScrubReport, error) {
+	if rate <= 0 {
+		var err error
+		if rate, err = s.config.ScrubBytesPerSecond(); err != nil {
+			return types.ScrubReport{}, err
+		}
+	}
+	report, err := s.cache.Scrub(ctx, rate)
+	for _, checksum := range report.Quarantined {
+		log.Printf("Blob %s is corrupt, moved to quarantine", checksum[:12])
+	}
+	for _, checksum := range report.Unrecoverable {
+		log.Printf("Blob %s cannot be downloaded again; images built from it cannot be rebuilt", checksum[:12])
+	}
+	return report, err
+}
+
+// RunMaintenance keeps usage figures current, enforces snapshot quotas and
+// the cache budget, and scrubs the blob cache, without processing images;
+// the API server runs it alongside an imgstore worker.
+func (s *Service) RunMaintenance(ctx context.Context) {
+	if every := s.config.ScrubEvery(); every > 0 {
+		go s.scrub(ctx, every)
+	}
+	ticker := time.NewTicker(s.config.UsageEvery())
+	defer ticker.Stop()
+	for {
+		if err := s.snapshots.RefreshUsage(); err != nil {
+			log.Printf("Usage refresh failed: %v", err)
+		}
+		if err := s.evict(); err != nil {
+			log.Printf("Blob eviction failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrub verifies the blob cache every interval until ctx is done.
+func (s *Service) scrub(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.VerifyCache(ctx, 0); err != nil && ctx.Err() == nil {
+			log.Printf("Blob scrub failed: %v", err)
+		}
+	}
+}
+
+// CreateBundle writes the named images, the images they derive from and
+// their blobs to w as a bundle signed with key.
+func (s *Service) CreateBundle(w io.Writer, names []string, key ed25519.PrivateKey) error {
+	index := bundle.Index{Created: time.Now().UTC()}
+	added := make(map[string]bool)
+	blobs := make(map[string]bool)
+
+	var add func(name string) error
+	add = func(name string) error {
+		if added[name] {
+			return nil
+		}
+		added[name] = true
+
+		row, err := s.meta.GetImage(name)
+		if err != nil {
+			return err
+		}
+		if fsm.State(row.State) == fsm.StateFailed || fsm.State(row.State) == fsm.StateDeleting {
+			return fmt.Errorf("image %s is %s", name, row.State)
+		}
+		img := bundle.Image{Name: row.Name, Checksum: row.Checksum, Policy: row.Policy, Parent: row.Parent, URL: row.BlobKey}
+		if img.Parent != "" {
+			if err := add(img.Parent); err != nil {
+				return fmt.Errorf("image %s: %w", name, err)
+			}
+		}
+
+		info, err := os.Stat(s.cache.GetPath(img.Checksum))
+		if err != nil {
+			return fmt.Errorf("image %s: blob %s is not cached", name, img.Checksum[:12])
+		}
+		if !blobs[img.Checksum] {
+			blobs[img.Checksum] = true
+			index.Blobs = append(index.Blobs, bundle.Blob{Digest: img.Checksum, Size: info.Size()})
+		}
+		index.Images = append(index.Images, img)
+		return nil
+	}
+	for _, name := range names {
+		if err := add(name); err != nil {
+			return err
+		}
+	}
+	return bundle.Write(w, index, key, s.cache.Open)
+}
+
+// LoadBundle verifies a bundle against the trusted keys, stores its blobs
+// and registers its images as DOWNLOADED, so the worker extracts them
+// without fetching anything. Images that already exist with the same
+// checksum are left alone. It returns the images registered.
+func (s *Service) LoadBundle(r io.Reader, trusted []ed25519.PublicKey) ([]string, error) {
+	var register []bundle.Image
+	accept := func(index bundle.Index) error {
+		included := make(map[string]bool)
+		for _, img := range index.Images {
+			if err := snapshots.ValidName(img.Name); err != nil {
+				return err
+			}
+			if !cache.ValidDigest(img.Checksum) {
+				return fmt.Errorf("image %s: invalid checksum %q", img.Name, img.Checksum)
+			}
+			if img.Parent != "" && !included[img.Parent] {
+				return fmt.Errorf("image %s: parent %s is not in the bundle", img.Name, img.Parent)
+			}
+			included[img.Name] = true
+			if _, err := s.config.Policy(img.Policy); err != nil {
+				return fmt.Errorf("image %s: %v", img.Name, err)
+			}
+
+			existing, err := s.meta.GetImage(img.Name)
+			switch {
+			case errors.Is(err, metadata.ErrNotFound):
+				register = append(register, img)
+			case err != nil:
+				return err
+			case existing.Checksum != img.Checksum:
+				return fmt.Errorf("image %s already exists with checksum %s", img.Name, existing.Checksum[:12])
+			}
+		}
+		return nil
+	}
+	if _, err := bundle.Read(r, trusted, accept, s.cache.Put); err != nil {
+		return nil, err
+	}
+
+	rows := make([]metadata.Image, len(register))
+	for i, img := range register {
+		rows[i] = metadata.Image{Name: img.Name, BlobKey: img.URL, Checksum: img.Checksum,
+			State: string(fsm.StateDownloaded), Policy: img.Policy, Parent: img.Parent}
+	}
+	ids, err := s.meta.CreateImages(rows...)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for i, img := range register {
+		if err := s.cache.MarkUsed(img.Checksum, ids[i]); err != nil {
+			return names, err
+		}
+		names = append(names, img.Name)
+	}
+	return names, nil
+}
+
+func imageInfo(img metadata.Image) types.ImageInfo {
+	return types.ImageInfo{ID: img.ID, Name: img.Name, BlobKey: img.BlobKey, Checksum: img.Checksum, State: img.State,
+		Policy: img.Policy, Parent: img.Parent, Created: img.Created, Updated: img.Updated}
+}
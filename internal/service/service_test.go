@@ -0,0 +1,406 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"imgstore/internal/config"
+	"imgstore/internal/fsm"
+	"imgstore/internal/metadata"
+	"imgstore/internal/snapshots"
+	"imgstore/internal/storage"
+)
+
+const migrations = "../../migrations"
+
+// newTestService returns a service on an empty store in a temp dir. It uses
+// the copy snapshotter unless cfg says otherwise, so nothing is mounted.
+func newTestService(t *testing.T, cfg *config.Config) *Service {
+	t.Helper()
+
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	if cfg.Snapshotter == "" {
+		cfg.Snapshotter = storage.BackendCopy
+	}
+	dir := t.TempDir()
+	meta, err := metadata.OpenSQLite(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { meta.Close() })
+	if err := meta.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewService(meta, filepath.Join(dir, "store"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newOverlayService is newTestService with the overlay snapshotter. It
+// skips the test where this process cannot mount overlays.
+func newOverlayService(t *testing.T, cfg *config.Config) *Service {
+	t.Helper()
+
+	probe := storage.NewOverlayStorage(t.TempDir())
+	if err := probe.Init(); err != nil {
+		t.Skipf("overlay: %v", err)
+	}
+	if err := probe.Prepare("probe", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := probe.Mount("probe"); err != nil {
+		t.Skipf("overlay: %v", err)
+	}
+	probe.Unmount("probe")
+
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	cfg.Snapshotter = storage.BackendOverlay
+	s := newTestService(t, cfg)
+	t.Cleanup(func() { s.snapshots.UnmountAll() })
+	return s
+}
+
+// tarball builds an image blob holding files, path to content.
+func tarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digest(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// serve starts an origin serving data at /blob.tar.
+func serve(t *testing.T, data []byte) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/blob.tar"
+}
+
+// process runs worker passes until the image reaches state, or is gone
+// when state is empty.
+func process(t *testing.T, s *Service, name string, state fsm.State) {
+	t.Helper()
+
+	for i := 0; i < 20; i++ {
+		img, err := s.meta.GetImage(name)
+		if state == "" && errors.Is(err, metadata.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fsm.State(img.State) == state {
+			return
+		}
+		if fsm.State(img.State) == fsm.StateFailed {
+			t.Fatalf("image %s failed on the way to %q", name, state)
+		}
+		s.processNextImage(context.Background())
+	}
+	img, _ := s.meta.GetImage(name)
+	t.Fatalf("image %s is stuck at %s on the way to %q", name, img.State, state)
+}
+
+// fetch adds an image with files from an origin and runs the worker until
+// it is ACTIVE.
+func fetch(t *testing.T, s *Service, name string, files map[string]string) metadata.Image {
+	t.Helper()
+
+	data := tarball(t, files)
+	if err := s.EnqueueImage(context.Background(), name, serve(t, data), digest(data), ""); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, name, fsm.StateActive)
+	img, err := s.meta.GetImage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestEnqueueRejectsInvalidNames(t *testing.T) {
+	s := newTestService(t, nil)
+	checksum := strings.Repeat("a", 64)
+
+	for _, name := range []string{"..", ".", "a/b", "../blobs", "a@b", ".hidden", ""} {
+		err := s.EnqueueImage(context.Background(), name, "http://example.com/a.tar", checksum, "")
+		if !errors.Is(err, snapshots.ErrInvalidName) {
+			t.Errorf("EnqueueImage(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+	if n, err := s.meta.CountImages(); err != nil || n != 0 {
+		t.Fatalf("CountImages = %d, %v", n, err)
+	}
+
+	if err := s.EnqueueImage(context.Background(), "alpine-3.19_x", "http://example.com/a.tar", checksum, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnqueueRejectsInvalidChecksums(t *testing.T) {
+	s := newTestService(t, nil)
+	for _, checksum := range []string{"", "abc", strings.Repeat("A", 64), strings.Repeat("a", 63), "../../" + strings.Repeat("a", 58)} {
+		if err := s.EnqueueImage(context.Background(), "a", "http://example.com/a.tar", checksum, ""); err == nil {
+			t.Errorf("EnqueueImage accepted checksum %q", checksum)
+		}
+	}
+	if n, err := s.meta.CountImages(); err != nil || n != 0 {
+		t.Fatalf("CountImages = %d, %v", n, err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	s := newTestService(t, nil)
+	fetch(t, s, "a", map[string]string{"etc/hostname": "a\n", "usr/bin/env": "env", "usr/binx": "x"})
+
+	for prefix, want := range map[string][]string{
+		"usr/bin":  {"usr/bin/env"},
+		"usr/bin/": {"usr/bin/env"},
+		"usr/binx": {"usr/binx"},
+		"var":      {},
+	} {
+		files, err := s.ListFiles("a", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("ListFiles(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+	if _, err := s.ListFiles("missing", ""); err == nil {
+		t.Error("ListFiles of a missing image succeeded")
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	s := newTestService(t, nil)
+	img := fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+	if _, err := s.CreateSnapshot("a", "s1", 0); err != nil {
+		t.Fatal(err)
+	}
+	exports := []string{
+		filepath.Join(s.storage.GetExportDir(), "a.tar"),
+		filepath.Join(s.storage.GetExportDir(), "a@s1.tar.gz"),
+	}
+	for _, path := range exports {
+		if err := os.WriteFile(path, []byte("export"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := filepath.Join(s.storage.GetExportDir(), "ab.tar")
+	if err := os.WriteFile(kept, []byte("export"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RemoveImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := s.GetImageStatus("a"); state != string(fsm.StateDeleting) {
+		t.Fatalf("state after RemoveImage = %s", state)
+	}
+	process(t, s, "a", "")
+
+	gone := append(exports, s.storage.GetActivePath("a"), s.storage.GetActivePath("a@s1"),
+		s.storage.Dir(filepath.Join("layers", img.Layer)), s.cache.GetPath(img.Checksum))
+	for _, path := range gone {
+		if exists(path) {
+			t.Errorf("%s survived the deletion", path)
+		}
+	}
+	if !exists(kept) {
+		t.Errorf("the export of another image was removed")
+	}
+	if n, _ := s.meta.OrphanSnapshots(); n != 0 {
+		t.Errorf("%d snapshot rows survived the deletion", n)
+	}
+}
+
+func TestDeleteImageStaysInStore(t *testing.T) {
+	s := newTestService(t, nil)
+	blob := filepath.Join(s.storage.GetBlobDir(), "keep.tar")
+	if err := os.WriteFile(blob, []byte("blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	victim := filepath.Join(s.storage.Dir(""), "..", "victim")
+	if err := os.MkdirAll(victim, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows written before names were validated.
+	for _, name := range []string{"..", "../blobs", "../../victim"} {
+		if err := s.meta.EnqueueImage(metadata.Image{Name: name, Checksum: strings.Repeat("a", 64), State: string(fsm.StateNew)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.meta.MarkDeleting(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.processNextImage(context.Background())
+
+	for _, path := range []string{s.storage.Dir("images"), s.storage.Dir("staging"), blob, victim} {
+		if !exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+	if n, _ := s.meta.CountImages(); n != 3 {
+		t.Errorf("%d rows left, want all 3 kept", n)
+	}
+}
+
+func TestStreamingRetriesTruncatedDownload(t *testing.T) {
+	cfg := config.Default()
+	cfg.Streaming = true
+	s := newTestService(t, cfg)
+
+	data := tarball(t, map[string]string{"etc/hostname": "a\n", "bin/sh": strings.Repeat("x", 100000)})
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Write(data[:len(data)/2])
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	if err := s.EnqueueImage(context.Background(), "a", srv.URL+"/a.tar", digest(data), ""); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "a", fsm.StateActive)
+	if hits != 2 {
+		t.Fatalf("%d requests, want a retry after the truncated one", hits)
+	}
+	got, err := os.ReadFile(filepath.Join(s.storage.GetActivePath("a"), "bin", "sh"))
+	if err != nil || len(got) != 100000 {
+		t.Fatalf("extracted bin/sh: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestPipelineWithCopySnapshotter(t *testing.T) {
+	cfg := config.Default()
+	cfg.Snapshotter = storage.BackendCopy
+	s := newTestService(t, cfg)
+	data := tarball(t, map[string]string{"etc/hostname": "a\n", "bin/sh": "#!\n"})
+	if err := s.EnqueueImage(context.Background(), "a", serve(t, data), digest(data), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []fsm.State{fsm.StateNew, fsm.StateDownloading, fsm.StateDownloaded, fsm.StateUnpacking,
+		fsm.StateUnpacked, fsm.StateStored, fsm.StateActivating, fsm.StateActive}
+	for i, state := range want {
+		if got, err := s.GetImageStatus("a"); err != nil || fsm.State(got) != state {
+			t.Fatalf("after %d passes: state %s, %v, want %s", i, got, err, state)
+		}
+		s.processNextImage(context.Background())
+	}
+
+	img, err := s.meta.GetImage("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(s.cache.GetPath(img.Checksum)) {
+		t.Error("the blob is not in the cache")
+	}
+	stored := filepath.Join(s.storage.GetLayerPath(img.Layer), "etc", "hostname")
+	active := filepath.Join(s.storage.GetActivePath("a"), "etc", "hostname")
+	for _, path := range []string{stored, active} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != "a\n" {
+			t.Errorf("%s = %q, %v", path, got, err)
+		}
+	}
+	if err := os.WriteFile(active, []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(stored); string(got) != "a\n" {
+		t.Errorf("a write to the active copy reached the stored layer: %q", got)
+	}
+	if mounted, err := s.snapshotter.Mounted(); err != nil || !mounted["a"] {
+		t.Errorf("Mounted = %v, %v", mounted, err)
+	}
+}
+
+func TestIdenticalImagesShareLayer(t *testing.T) {
+	s := newTestService(t, nil)
+	files := map[string]string{"etc/hostname": "same\n"}
+	a := fetch(t, s, "a", files)
+	b := fetch(t, s, "b", files)
+	if a.Layer == "" || a.Layer != b.Layer {
+		t.Fatalf("layers %q and %q, want one shared layer", a.Layer, b.Layer)
+	}
+	if layers, _ := subdirs(s.storage.Dir("layers")); len(layers) != 1 {
+		t.Fatalf("layers on disk: %q", layers)
+	}
+
+	if err := s.RemoveImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "a", "")
+	if !exists(s.storage.GetLayerPath(b.Layer)) {
+		t.Fatal("the shared layer was removed with a")
+	}
+	if err := s.RemoveImage("b"); err != nil {
+		t.Fatal(err)
+	}
+	process(t, s, "b", "")
+	if exists(s.storage.Dir(filepath.Join("layers", b.Layer))) {
+		t.Fatal("the layer outlived both images")
+	}
+}
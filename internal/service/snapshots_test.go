@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imgstore/internal/fsm"
+	"imgstore/internal/snapshots"
+)
+
+func TestSnapshots(t *testing.T) {
+	s := newTestService(t, nil)
+	fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+
+	for _, name := range []string{"s1", "s2"} {
+		snap, err := s.CreateSnapshot("a", name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !snap.Active || snap.Path != s.storage.GetActivePath("a@"+name) {
+			t.Fatalf("CreateSnapshot(%s) = %+v", name, snap)
+		}
+	}
+
+	// Each snapshot is writable on its own.
+	if err := os.WriteFile(filepath.Join(s.storage.GetActivePath("a@s1"), "etc", "hostname"), []byte("s1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "a@s2"} {
+		if got := read(t, filepath.Join(s.storage.GetActivePath(key), "etc", "hostname")); got != "a\n" {
+			t.Errorf("a write to a@s1 shows in %s: %q", key, got)
+		}
+	}
+
+	checksum := strings.Repeat("b", 64)
+	if err := s.EnqueueImage(context.Background(), "pending", "http://example.com/b.tar", checksum, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		image, name string
+		quota       int64
+		err         error
+	}{
+		{"a", "s1", 0, snapshots.ErrExists},
+		{"a", "../s3", 0, snapshots.ErrInvalidName},
+		{"a", "s3@x", 0, snapshots.ErrInvalidName},
+		{"a", ".s3", 0, snapshots.ErrInvalidName},
+		{"a", "s3", -1, snapshots.ErrInvalidQuota},
+		{"pending", "s3", 0, snapshots.ErrNotReady},
+		{"missing", "s3", 0, snapshots.ErrNotFound},
+	} {
+		if _, err := s.CreateSnapshot(tt.image, tt.name, tt.quota); !errors.Is(err, tt.err) {
+			t.Errorf("CreateSnapshot(%q, %q, %d) = %v, want %v", tt.image, tt.name, tt.quota, err, tt.err)
+		}
+	}
+
+	list, err := s.ListSnapshots("a")
+	if err != nil || len(list) != 2 || list[0].Name != "s1" || list[1].Name != "s2" {
+		t.Fatalf("ListSnapshots = %+v, %v", list, err)
+	}
+	if snap, err := s.GetSnapshot("a", "s2"); err != nil || !snap.Active || snap.Image != "a" {
+		t.Fatalf("GetSnapshot = %+v, %v", snap, err)
+	}
+
+	if err := s.RemoveSnapshot("a", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(s.storage.GetActivePath("a@s1")) {
+		t.Error("the removed snapshot is still on disk")
+	}
+	if _, err := s.GetSnapshot("a", "s1"); !errors.Is(err, snapshots.ErrNotFound) {
+		t.Errorf("GetSnapshot of a removed snapshot = %v", err)
+	}
+	if err := s.RemoveSnapshot("a", "s1"); !errors.Is(err, snapshots.ErrNotFound) {
+		t.Errorf("RemoveSnapshot twice = %v", err)
+	}
+	if list, _ := s.ListSnapshots("a"); len(list) != 1 || list[0].Name != "s2" {
+		t.Errorf("ListSnapshots after the removal = %+v", list)
+	}
+}
+
+func TestDeactivateReactivate(t *testing.T) {
+	s := newTestService(t, nil)
+	fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+	written := filepath.Join(s.storage.GetActivePath("a"), "etc", "written")
+	if err := os.WriteFile(written, []byte("kept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeactivateImage("a", false); err != nil {
+		t.Fatal(err)
+	}
+	img, err := s.meta.GetImage("a")
+	if err != nil || fsm.State(img.State) != fsm.StateStored || !img.Deactivated {
+		t.Fatalf("after DeactivateImage: %+v, %v", img, err)
+	}
+	// The worker leaves a deactivated image alone.
+	s.processNextImage(context.Background())
+	if state, _ := s.GetImageStatus("a"); fsm.State(state) != fsm.StateStored {
+		t.Fatalf("the worker moved a deactivated image to %s", state)
+	}
+
+	if err := s.ActivateImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := s.meta.GetImage("a"); fsm.State(img.State) != fsm.StateActive || img.Deactivated {
+		t.Fatalf("after ActivateImage: %+v", img)
+	}
+	if got := read(t, written); got != "kept\n" {
+		t.Fatalf("a write before deactivation is %q after reactivation", got)
+	}
+	if err := s.ActivateImage("a"); err != nil {
+		t.Fatalf("ActivateImage of an ACTIVE image = %v", err)
+	}
+
+	// Discarding drops what was written.
+	if err := s.DeactivateImage("a", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ActivateImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(written) {
+		t.Fatal("a discarded write came back")
+	}
+	if got := read(t, filepath.Join(s.storage.GetActivePath("a"), "etc", "hostname")); got != "a\n" {
+		t.Fatalf("etc/hostname after a discard = %q", got)
+	}
+
+	if err := s.EnqueueImage(context.Background(), "pending", "http://example.com/b.tar", strings.Repeat("b", 64), ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		op   func(string) error
+		err  error
+	}{
+		{"pending", func(name string) error { return s.DeactivateImage(name, false) }, snapshots.ErrNotReady},
+		{"pending", s.ActivateImage, snapshots.ErrNotReady},
+		{"missing", func(name string) error { return s.DeactivateImage(name, false) }, snapshots.ErrNotFound},
+		{"missing", s.ActivateImage, snapshots.ErrNotFound},
+	} {
+		if err := tt.op(tt.name); !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if state, _ := s.GetImageStatus("pending"); fsm.State(state) != fsm.StateNew {
+		t.Errorf("a rejected operation moved pending to %s", state)
+	}
+}
+
+func TestOneShotRefusesPrivateMounts(t *testing.T) {
+	s := newTestService(t, nil)
+	fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+	if _, err := s.CreateSnapshot("a", "kept", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside a re-executed process, mounts outlive the command.
+	t.Setenv("IMGSTORE_USERNS", "")
+	s.OneShot()
+	if _, err := s.CreateSnapshot("a", "shared", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("IMGSTORE_USERNS", "1")
+	s.OneShot()
+	if _, err := s.CreateSnapshot("a", "private", 0); !errors.Is(err, snapshots.ErrPrivateMounts) {
+		t.Fatalf("CreateSnapshot = %v, want ErrPrivateMounts", err)
+	}
+	if _, err := s.GetSnapshot("a", "private"); !errors.Is(err, snapshots.ErrNotFound) {
+		t.Fatalf("a refused snapshot was recorded: %v", err)
+	}
+	for op, err := range map[string]error{
+		"deactivate":      s.DeactivateImage("a", false),
+		"activate":        s.ActivateImage("a"),
+		"remove snapshot": s.RemoveSnapshot("a", "kept"),
+		"reconcile":       s.Reconcile(),
+	} {
+		if !errors.Is(err, snapshots.ErrPrivateMounts) {
+			t.Errorf("%s = %v, want ErrPrivateMounts", op, err)
+		}
+	}
+	if img, _ := s.meta.GetImage("a"); fsm.State(img.State) != fsm.StateActive {
+		t.Errorf("image a is %s after refused commands", img.State)
+	}
+	if snap, err := s.GetSnapshot("a", "kept"); err != nil || !snap.Active {
+		t.Errorf("snapshot kept = %+v, %v after a refused removal", snap, err)
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"imgstore/internal/cache"
+	"imgstore/internal/config"
+)
+
+func TestCacheStats(t *testing.T) {
+	filesA := map[string]string{"etc/hostname": "a\n"}
+	filesB := map[string]string{"etc/hostname": "b\n"}
+	size := int64(len(tarball(t, filesA)))
+
+	// Room for one blob.
+	cfg := config.Default()
+	cfg.CacheBudget = fmt.Sprint(size)
+	s := newTestService(t, cfg)
+
+	a := fetch(t, s, "a", filesA)
+	stats, err := s.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 0 || stats.Misses != 1 || stats.DownloadedBytes != size || stats.CachedBytes != 0 {
+		t.Fatalf("after a download: %+v", stats)
+	}
+	if stats.Size != size || stats.Budget != size || len(stats.Blobs) != 1 {
+		t.Fatalf("after a download: %+v", stats)
+	}
+
+	// The same blob again is served from the cache.
+	fetch(t, s, "a2", filesA)
+	stats, err = s.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.CachedBytes != size || stats.DownloadedBytes != size || stats.HitRatio != 0.5 {
+		t.Fatalf("after a hit: %+v", stats)
+	}
+	if blob := stats.Blobs[0]; blob.Digest != a.Checksum || blob.Size != size || blob.Refs != 2 || blob.Pinned {
+		t.Fatalf("blob = %+v", blob)
+	}
+
+	// Last used is kept to the second; make a's blob clearly the older one
+	// so that b's download evicts it.
+	used := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := s.meta.TouchBlob(a.Checksum, used); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = s.CacheStats(); err != nil || !stats.Blobs[0].LastUsed.Equal(used) {
+		t.Fatalf("last used = %v, %v; want %v", stats.Blobs[0].LastUsed, err, used)
+	}
+	b := fetch(t, s, "b", filesB)
+	stats, err = s.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Misses != 2 || stats.DownloadedBytes != 2*size || stats.Evictions != 1 || stats.EvictedBytes != size {
+		t.Fatalf("after an eviction: %+v", stats)
+	}
+	if stats.Size != size || len(stats.Blobs) != 1 || stats.Blobs[0].Digest != b.Checksum {
+		t.Fatalf("after an eviction: %+v", stats)
+	}
+
+	if _, err := s.Pin(cache.PinImage, "b", "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = s.CacheStats(); err != nil || !stats.Blobs[0].Pinned || stats.Blobs[0].Refs != 1 {
+		t.Fatalf("blob = %+v, %v", stats.Blobs, err)
+	}
+}
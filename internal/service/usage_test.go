@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imgstore/internal/snapshots"
+)
+
+func TestUsage(t *testing.T) {
+	s := newTestService(t, nil)
+	files := map[string]string{"etc/hostname": "a\n", "bin/sh": strings.Repeat("x", 3000)}
+	fetch(t, s, "a", files)
+	blob := int64(len(tarball(t, files)))
+
+	usage, err := s.GetImageUsage("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.BlobSize != blob || usage.RootfsSize != 3002 {
+		t.Fatalf("usage after extraction = %+v, want a %d byte blob and a 3002 byte rootfs", usage, blob)
+	}
+
+	if _, err := s.CreateSnapshot("a", "job", 0); err != nil {
+		t.Fatal(err)
+	}
+	for key, size := range map[string]int{"a": 5000, "a@job": 700} {
+		path := filepath.Join(s.storage.GetActivePath(key), "written")
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.snapshots.RefreshUsage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy holds the whole tree, so that is what its snapshots take.
+	usage, err = s.GetImageUsage("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.UpperSize != 3002+5000 {
+		t.Errorf("image upper size = %d, want %d", usage.UpperSize, 3002+5000)
+	}
+	if len(usage.Snapshots) != 1 || usage.Snapshots[0].UpperSize != 3002+700 {
+		t.Errorf("snapshots = %+v, want job at %d bytes", usage.Snapshots, 3002+700)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newOverlayService(t, nil)
+	fetch(t, s, "a", map[string]string{"etc/hostname": "a\n"})
+
+	limited, err := s.CreateSnapshot("a", "limited", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSnapshot("a", "free", 0); err != nil {
+		t.Fatal(err)
+	}
+	write := func(key, name string, size int) error {
+		return os.WriteFile(filepath.Join(s.storage.GetActivePath(key), name), make([]byte, size), 0644)
+	}
+
+	switch limited.QuotaMode {
+	case snapshots.QuotaProject:
+		// The filesystem stops the write itself.
+		if err := write("a@limited", "big", 64<<10); err == nil {
+			t.Fatal("a write past a project quota succeeded")
+		}
+	case snapshots.QuotaPeriodic:
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		t.Cleanup(func() { log.SetOutput(os.Stderr) })
+		overQuota := func() int { return strings.Count(logs.String(), "a@limited is over its quota") }
+
+		// The write goes through, and the next pass freezes the snapshot.
+		if err := write("a@limited", "big", 8192); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.snapshots.RefreshUsage(); err != nil {
+			t.Fatal(err)
+		}
+		if err := write("a@limited", "more", 1); err == nil {
+			t.Fatal("a snapshot over its quota is still writable")
+		}
+		snap, err := s.GetSnapshot("a", "limited")
+		if err != nil || snap.UpperSize < 8192 || snap.Quota != 4096 {
+			t.Fatalf("limited snapshot = %+v, %v", snap, err)
+		}
+
+		// Crossing the quota is logged once, not on every pass while the
+		// snapshot stays over it.
+		if err := s.snapshots.RefreshUsage(); err != nil {
+			t.Fatal(err)
+		}
+		if n := overQuota(); n != 1 {
+			t.Fatalf("logged over quota %d times, want once:\n%s", n, logs.String())
+		}
+		// A pass that found it back under its quota makes the next crossing
+		// logged again.
+		if err := s.meta.SetSnapshotUpperSize(snap.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.snapshots.RefreshUsage(); err != nil {
+			t.Fatal(err)
+		}
+		if n := overQuota(); n != 2 {
+			t.Fatalf("logged over quota %d times after crossing again, want twice:\n%s", n, logs.String())
+		}
+	default:
+		t.Fatalf("quota mode %q", limited.QuotaMode)
+	}
+
+	if err := write("a@free", "big", 64<<10); err != nil {
+		t.Fatalf("the snapshot without a quota was limited: %v", err)
+	}
+	if err := s.snapshots.RefreshUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("a@free", "more", 1); err != nil {
+		t.Fatalf("the snapshot without a quota was frozen: %v", err)
+	}
+}
@@ -0,0 +1,513 @@
+package snapshots
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+
+	"imgstore/internal/cache"
+	"imgstore/internal/fsm"
+	"imgstore/internal/layers"
+	"imgstore/internal/metadata"
+	"imgstore/internal/storage"
+	"imgstore/internal/types"
+)
+
+var (
+	ErrNotFound     = metadata.ErrNotFound
+	ErrExists       = metadata.ErrExists
+	ErrInvalidName  = errors.New("invalid name")
+	ErrNotReady     = errors.New("image not ready")
+	ErrInvalidQuota = errors.New("invalid quota")
+	// ErrPrivateMounts is returned by a Manager that refuses mounts; see
+	// RefuseMounts.
+	ErrPrivateMounts = errors.New("mounts made here vanish when the process exits; use the API server or the worker")
+)
+
+// Quota modes: project quotas stop writes in the filesystem; otherwise
+// RefreshUsage makes a snapshot read-only once it is over its quota.
+const (
+	QuotaProject  = "project"
+	QuotaPeriodic = "periodic"
+)
+
+// projectBase offsets snapshot IDs into the filesystem project ID space, away
+// from the low IDs administrators assign by hand.
+const projectBase = 100000
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidName checks an image or snapshot name. Names become paths under the
+// store and <image>@<name> keys, so they cannot hold separators, @ or
+// start with a dot.
+func ValidName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Manager keeps named snapshots of an image in the snapshots table. Each
+// snapshot gets its own snapshotter key, <image>@<name>, so it has private
+// upper/work dirs and is mounted at active/<image>@<name>.
+type Manager struct {
+	meta        metadata.Store
+	layout      *storage.Layout
+	snapshotter storage.Snapshotter
+	cache       *cache.BlobCache
+	layers      *layers.Store
+	// private is set by RefuseMounts.
+	private bool
+}
+
+func NewManager(meta metadata.Store, layout *storage.Layout, snapshotter storage.Snapshotter, cache *cache.BlobCache, layers *layers.Store) *Manager {
+	return &Manager{meta: meta, layout: layout, snapshotter: snapshotter, cache: cache, layers: layers}
+}
+
+// RefuseMounts makes every call that mounts or unmounts fail with
+// ErrPrivateMounts, before anything is recorded. It is for processes whose
+// mounts nobody else sees and that exit before the catalog could learn the
+// mounts are gone.
+func (m *Manager) RefuseMounts() {
+	m.private = true
+}
+
+func (m *Manager) Private() bool {
+	return m.private
+}
+
+func (m *Manager) checkMounts(op string) error {
+	if m.private {
+		return fmt.Errorf("%s: %w", op, ErrPrivateMounts)
+	}
+	return nil
+}
+
+func Key(image, name string) string {
+	return image + "@" + name
+}
+
+// Create mounts a new named snapshot of image. A quota above 0 limits, in
+// bytes, how much can be written to it.
+func (m *Manager) Create(image, name string, quota int64) (types.SnapshotInfo, error) {
+	if err := ValidName(name); err != nil {
+		return types.SnapshotInfo{}, err
+	}
+	if quota < 0 {
+		return types.SnapshotInfo{}, fmt.Errorf("%w: %d", ErrInvalidQuota, quota)
+	}
+	if err := m.checkMounts("create snapshot"); err != nil {
+		return types.SnapshotInfo{}, err
+	}
+
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return types.SnapshotInfo{}, err
+	}
+	switch fsm.State(img.State) {
+	case fsm.StateStored, fsm.StateActivating, fsm.StateActive:
+	default:
+		return types.SnapshotInfo{}, fmt.Errorf("image %s is %s: %w", image, img.State, ErrNotReady)
+	}
+
+	// The unique index on (image_id, snapshot_name) makes the row act as a
+	// lock: a concurrent create of the same name fails here.
+	id, err := m.meta.CreateSnapshot(img.ID, name, quota)
+	if errors.Is(err, ErrExists) {
+		return types.SnapshotInfo{}, fmt.Errorf("snapshot %s of %s: %w", name, image, ErrExists)
+	}
+	if err != nil {
+		return types.SnapshotInfo{}, err
+	}
+
+	key := Key(image, name)
+	rootfs, err := m.layers.Rootfs(image)
+	if err == nil {
+		err = m.mount(key, rootfs)
+	}
+	if err != nil {
+		m.snapshotter.Remove(key)
+		m.meta.DeleteSnapshot(id)
+		return types.SnapshotInfo{}, err
+	}
+	mode := ""
+	if quota > 0 {
+		mode = m.limit(key, id, quota)
+	}
+	if err := m.meta.SetSnapshotMounted(id, mode); err != nil {
+		return types.SnapshotInfo{}, err
+	}
+	return m.Get(image, name)
+}
+
+// limit sets a project quota on the snapshot when the snapshotter and the
+// filesystem support it, and falls back to periodic enforcement otherwise.
+func (m *Manager) limit(key string, id int, quota int64) string {
+	limiter, ok := m.snapshotter.(storage.Limiter)
+	if !ok {
+		return QuotaPeriodic
+	}
+	if err := limiter.SetQuota(key, uint32(projectBase+id), quota); err != nil {
+		if !errors.Is(err, storage.ErrNotSupported) {
+			log.Printf("Snapshot %s: project quota: %v; enforcing periodically", key, err)
+		}
+		return QuotaPeriodic
+	}
+	return QuotaProject
+}
+
+func (m *Manager) mount(key, lowerDir string) error {
+	if err := m.snapshotter.Prepare(key, lowerDir); err != nil {
+		return err
+	}
+	_, err := m.snapshotter.Mount(key)
+	return err
+}
+
+// Activate mounts the image's own snapshot at active/<image>. It is a no-op
+// when the snapshot is already mounted, so an activation interrupted after
+// the mount can simply be retried.
+func (m *Manager) Activate(image string) error {
+	if err := m.checkMounts("activate"); err != nil {
+		return err
+	}
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	if mounted[image] {
+		return nil
+	}
+	rootfs, err := m.layers.Rootfs(image)
+	if err != nil {
+		return err
+	}
+	return m.mount(image, rootfs)
+}
+
+// Deactivate unmounts an ACTIVE image and returns it to STORED, where the
+// worker leaves it until Reactivate. A STORED image is only kept from being
+// activated. The upper dir is kept unless discard is
+// set, so reactivating brings back everything written to the image.
+func (m *Manager) Deactivate(image string, discard bool) error {
+	if err := m.checkMounts("deactivate"); err != nil {
+		return err
+	}
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return err
+	}
+	switch fsm.State(img.State) {
+	case fsm.StateActive, fsm.StateStored:
+	default:
+		return fmt.Errorf("image %s is %s: %w", image, img.State, ErrNotReady)
+	}
+
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	if mounted[image] {
+		if err := m.snapshotter.Unmount(image); err != nil {
+			return err
+		}
+	}
+	if discard {
+		if err := m.snapshotter.Remove(image); err != nil {
+			return err
+		}
+	}
+
+	ok, err := m.meta.SetDeactivated(img.ID, img.State, string(fsm.StateStored), true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("image %s changed state during deactivation: %w", image, ErrNotReady)
+	}
+	return nil
+}
+
+// Reactivate mounts a STORED image and makes it ACTIVE straight away,
+// reusing its rootfs and any upper dir kept by Deactivate. It is a no-op for
+// an image that is already ACTIVE.
+func (m *Manager) Reactivate(image string) error {
+	if err := m.checkMounts("activate"); err != nil {
+		return err
+	}
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return err
+	}
+	switch fsm.State(img.State) {
+	case fsm.StateActive:
+		return nil
+	case fsm.StateStored:
+	default:
+		return fmt.Errorf("image %s is %s: %w", image, img.State, ErrNotReady)
+	}
+
+	if err := m.Activate(image); err != nil {
+		return err
+	}
+
+	// The worker may have activated the image in the meantime; either way
+	// it ends up ACTIVE.
+	if _, err := m.meta.SetDeactivated(img.ID, string(fsm.StateStored), string(fsm.StateActive), false); err != nil {
+		return err
+	}
+	if img, err = m.meta.GetImage(image); err != nil {
+		return err
+	}
+	if fsm.State(img.State) != fsm.StateActive {
+		return fmt.Errorf("image %s changed state during activation: %w", image, ErrNotReady)
+	}
+	return nil
+}
+
+func (m *Manager) List(image string) ([]types.SnapshotInfo, error) {
+	snapshots, err := m.meta.ListSnapshots(image)
+	for i := range snapshots {
+		snapshots[i].Path = m.layout.GetActivePath(Key(image, snapshots[i].Name))
+	}
+	return snapshots, err
+}
+
+func (m *Manager) Get(image, name string) (types.SnapshotInfo, error) {
+	snap, err := m.meta.GetSnapshot(image, name)
+	if err != nil {
+		return types.SnapshotInfo{}, err
+	}
+	snap.Path = m.layout.GetActivePath(Key(image, name))
+	return snap, nil
+}
+
+// Path returns the directory holding the contents of an image, or with a
+// snapshot name, the merged view of that snapshot.
+func (m *Manager) Path(image, snapshot string) (string, error) {
+	if snapshot == "" {
+		dir, err := m.layers.Rootfs(image)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("rootfs of %s: %w", image, ErrNotFound)
+		}
+		return dir, nil
+	}
+
+	snap, err := m.Get(image, snapshot)
+	if err != nil {
+		return "", err
+	}
+	if !snap.Active {
+		return "", fmt.Errorf("snapshot %s of %s is not mounted: %w", snapshot, image, ErrNotReady)
+	}
+	return snap.Path, nil
+}
+
+// Remove unmounts the snapshot, deletes its directories and then its row, so
+// a failure part way leaves a row behind that can be removed again.
+func (m *Manager) Remove(image, name string) error {
+	snap, err := m.Get(image, name)
+	if err != nil {
+		return err
+	}
+
+	key := Key(image, name)
+	if snap.Active {
+		if err := m.checkMounts("remove snapshot"); err != nil {
+			return err
+		}
+		if err := m.snapshotter.Unmount(key); err != nil {
+			return err
+		}
+		if err := m.meta.SetSnapshotUnmounted(snap.ID); err != nil {
+			return err
+		}
+	}
+	// The project ID is reused by the next snapshot with this row ID.
+	if limiter, ok := m.snapshotter.(storage.Limiter); ok && snap.QuotaMode == QuotaProject {
+		if err := limiter.SetQuota(key, uint32(projectBase+snap.ID), 0); err != nil {
+			log.Printf("Snapshot %s: lift project quota: %v", key, err)
+		}
+	}
+	if err := m.snapshotter.Remove(key); err != nil {
+		return err
+	}
+	return m.meta.DeleteSnapshot(snap.ID)
+}
+
+// RemoveAll unmounts and deletes every snapshot of an image, including its
+// own, ahead of the image being removed.
+func (m *Manager) RemoveAll(image string) error {
+	snaps, err := m.List(image)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		if err := m.Remove(image, snap.Name); err != nil {
+			return err
+		}
+	}
+
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	if mounted[image] {
+		if err := m.snapshotter.Unmount(image); err != nil {
+			return err
+		}
+	}
+	return m.snapshotter.Remove(image)
+}
+
+// Reconcile brings the mounts in line with the database, typically after a
+// reboot or crash. Snapshots recorded as mounted are remounted; an image
+// whose snapshot cannot be remounted goes back to STORED so the worker
+// activates it again, and a named snapshot is marked inactive. Mounts under
+// active/ that nothing refers to are unmounted.
+func (m *Manager) Reconcile() error {
+	if err := m.checkMounts("reconcile"); err != nil {
+		return err
+	}
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+
+	// expected holds every key that should stay mounted; ACTIVATING images
+	// are in it too, but only the worker mounts them.
+	expected := make(map[string]bool)
+	type target struct {
+		id    int
+		key   string
+		image bool
+	}
+	var targets []target
+
+	images, err := m.meta.ImagesInState(string(fsm.StateActivating), string(fsm.StateActive))
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		expected[img.Name] = true
+		if fsm.State(img.State) == fsm.StateActive {
+			targets = append(targets, target{id: img.ID, key: img.Name, image: true})
+		}
+	}
+
+	snapshots, err := m.meta.ActiveSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		t := target{id: snap.ID, key: Key(snap.Image, snap.Name)}
+		expected[t.key] = true
+		targets = append(targets, t)
+	}
+
+	for _, t := range targets {
+		if mounted[t.key] {
+			continue
+		}
+		_, err := m.snapshotter.Mount(t.key)
+		switch {
+		case err == nil:
+			log.Printf("Reconcile: remounted %s", t.key)
+		case t.image:
+			log.Printf("Reconcile: cannot remount %s, reactivating: %v", t.key, err)
+			_, err = m.meta.SetState(t.id, string(fsm.StateActive), string(fsm.StateStored))
+		default:
+			log.Printf("Reconcile: cannot remount snapshot %s: %v", t.key, err)
+			err = m.meta.SetSnapshotUnmounted(t.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for key := range mounted {
+		if expected[key] {
+			continue
+		}
+		if err := m.snapshotter.Unmount(key); err != nil {
+			log.Printf("Reconcile: unmount stray %s: %v", key, err)
+			continue
+		}
+		log.Printf("Reconcile: unmounted stray %s", key)
+	}
+	return nil
+}
+
+// UnmountAll unmounts every snapshot without touching the database, so that
+// Reconcile mounts them again on the next start.
+func (m *Manager) UnmountAll() error {
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+	var failed error
+	for key := range mounted {
+		if err := m.snapshotter.Unmount(key); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// Commit stores the changes made in a snapshot as a layer blob in the cache
+// and registers newImage as that layer on top of image. An empty snapshot
+// commits the image's own active snapshot. The new image enters the FSM at
+// DOWNLOADED, and the worker builds its rootfs from the parent's. It returns
+// the layer digest.
+func (m *Manager) Commit(image, snapshot, newImage string) (string, error) {
+	if err := ValidName(newImage); err != nil {
+		return "", err
+	}
+
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return "", err
+	}
+	state := img.State
+
+	if _, err := m.meta.GetImage(newImage); err == nil {
+		return "", fmt.Errorf("image %s: %w", newImage, ErrExists)
+	} else if !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+
+	if fsm.State(state) == fsm.StateDeleting {
+		return "", fmt.Errorf("image %s is %s: %w", image, state, ErrNotReady)
+	}
+
+	key := image
+	if snapshot != "" {
+		if _, err := m.Get(image, snapshot); err != nil {
+			return "", err
+		}
+		key = Key(image, snapshot)
+	} else if fsm.State(state) != fsm.StateActive {
+		return "", fmt.Errorf("image %s is %s: %w", image, state, ErrNotReady)
+	}
+
+	checksum, err := m.cache.Store(func(w io.Writer) error {
+		return m.snapshotter.Diff(key, w)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ids, err := m.meta.CreateImages(metadata.Image{
+		Name: newImage, Checksum: checksum, State: string(fsm.StateDownloaded), Policy: img.Policy, Parent: image,
+	})
+	if err != nil {
+		return "", err
+	}
+	return checksum, m.cache.MarkUsed(checksum, ids[0])
+}
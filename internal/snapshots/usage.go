@@ -0,0 +1,127 @@
+package snapshots
+
+import (
+	"log"
+	"os"
+
+	"imgstore/internal/fsm"
+	"imgstore/internal/storage"
+	"imgstore/internal/types"
+)
+
+// RecordImageUsage stores the size of an image's blob and extracted rootfs.
+// It is called once the rootfs is in place; neither changes afterwards.
+func (m *Manager) RecordImageUsage(image string) error {
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return err
+	}
+
+	var blobSize int64
+	if fi, err := os.Stat(m.cache.GetPath(img.Checksum)); err == nil {
+		blobSize = fi.Size()
+	}
+	dir, err := m.layers.Rootfs(image)
+	if err != nil {
+		return err
+	}
+	rootfs, err := storage.DiskUsage(dir)
+	if err != nil {
+		return err
+	}
+	return m.meta.SetUsage(image, blobSize, rootfs.Size)
+}
+
+// RefreshUsage measures the upper dir of every mounted snapshot and makes
+// snapshots that are over their quota read-only. Images stored before usage
+// was recorded get their blob and rootfs sizes filled in as well.
+func (m *Manager) RefreshUsage() error {
+	stored, err := m.meta.ImagesInState(string(fsm.StateStored), string(fsm.StateActivating), string(fsm.StateActive))
+	if err != nil {
+		return err
+	}
+	for _, img := range stored {
+		if img.RootfsSize != 0 {
+			continue
+		}
+		if err := m.RecordImageUsage(img.Name); err != nil {
+			log.Printf("Usage of %s: %v", img.Name, err)
+		}
+	}
+
+	mounted, err := m.snapshotter.Mounted()
+	if err != nil {
+		return err
+	}
+
+	for _, img := range stored {
+		name := img.Name
+		if fsm.State(img.State) != fsm.StateActive || !mounted[name] {
+			continue
+		}
+		usage, err := m.snapshotter.Usage(name)
+		if err != nil {
+			log.Printf("Usage of %s: %v", name, err)
+			continue
+		}
+		if err := m.meta.SetUpperSize(name, usage.Size); err != nil {
+			return err
+		}
+	}
+
+	snaps, err := m.meta.ActiveSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		key := Key(snap.Image, snap.Name)
+		if !mounted[key] {
+			continue
+		}
+		usage, err := m.snapshotter.Usage(key)
+		if err != nil {
+			log.Printf("Usage of %s: %v", key, err)
+			continue
+		}
+		previous := snap.UpperSize
+		if err := m.meta.SetSnapshotUpperSize(snap.ID, usage.Size); err != nil {
+			return err
+		}
+		if snap.Quota > 0 && usage.Size > snap.Quota {
+			m.enforce(key, snap.Quota, previous, usage.Size)
+		}
+	}
+	return nil
+}
+
+// enforce freezes a snapshot whose size has outgrown its quota. Freezing
+// again is harmless, so it happens on every pass in case the snapshot was
+// remounted; only crossing the quota, from the size recorded by the
+// previous pass, is logged.
+func (m *Manager) enforce(key string, quota, previous, size int64) {
+	if previous <= quota {
+		log.Printf("Snapshot %s is over its quota: %d of %d bytes", key, size, quota)
+	}
+	limiter, ok := m.snapshotter.(storage.Limiter)
+	if !ok {
+		return
+	}
+	if err := limiter.Freeze(key); err != nil {
+		log.Printf("Snapshot %s: %v", key, err)
+	}
+}
+
+// Usage reports the recorded sizes of an image and its named snapshots.
+func (m *Manager) Usage(image string) (types.ImageUsage, error) {
+	var usage types.ImageUsage
+	img, err := m.meta.GetImage(image)
+	if err != nil {
+		return usage, err
+	}
+	usage.BlobSize = img.BlobSize
+	usage.RootfsSize = img.RootfsSize
+	usage.UpperSize = img.UpperSize
+	usage.BlobQuarantined = img.BlobQuarantined
+	usage.Snapshots, err = m.List(image)
+	return usage, err
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type cloneMode int
+
+const (
+	cloneCopy    cloneMode = iota // full data copy
+	cloneReflink                  // copy-on-write clone, falling back to a copy
+)
+
+// CopySnapshotter materialises each snapshot as a complete tree under
+// active/<key>. It needs no mounts or privileges, which makes it usable on
+// hosts without overlayfs.
+type CopySnapshotter struct {
+	root  string
+	clone cloneMode
+}
+
+func NewCopySnapshotter(root string, clone cloneMode) *CopySnapshotter {
+	return &CopySnapshotter{root: root, clone: clone}
+}
+
+func (c *CopySnapshotter) Init() error {
+	return os.MkdirAll(filepath.Join(c.root, "active"), 0755)
+}
+
+func (c *CopySnapshotter) Prepare(key, lowerDir string) error {
+	activeDir := filepath.Join(c.root, "active", key)
+	if _, err := os.Lstat(activeDir); err == nil {
+		return fmt.Errorf("snapshot %s already exists", key)
+	}
+
+	tmpDir := activeDir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := copyTree(lowerDir, tmpDir, c.clone); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return os.Rename(tmpDir, activeDir)
+}
+
+// Mount is a no-op: the copied tree is usable in place.
+func (c *CopySnapshotter) Mount(key string) (string, error) {
+	activeDir := filepath.Join(c.root, "active", key)
+	if _, err := os.Stat(activeDir); err != nil {
+		return "", err
+	}
+	return activeDir, nil
+}
+
+func (c *CopySnapshotter) Unmount(key string) error {
+	return nil
+}
+
+func (c *CopySnapshotter) Remove(key string) error {
+	return os.RemoveAll(filepath.Join(c.root, "active", key))
+}
+
+func (c *CopySnapshotter) Usage(key string) (Usage, error) {
+	return DiskUsage(filepath.Join(c.root, "active", key))
+}
+
+// Diff is not supported: a copied tree keeps no record of what changed.
+func (c *CopySnapshotter) Diff(key string, w io.Writer) error {
+	return fmt.Errorf("diff %s: %w", key, ErrNotSupported)
+}
+
+// Mounted lists every complete copy under active/; half-written .tmp trees
+// from an interrupted Prepare are not snapshots.
+func (c *CopySnapshotter) Mounted() (map[string]bool, error) {
+	entries, err := os.ReadDir(filepath.Join(c.root, "active"))
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			mounted[entry.Name()] = true
+		}
+	}
+	return mounted, nil
+}
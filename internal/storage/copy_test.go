@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// lowerTree builds a small rootfs with a subdir, a symlink and a hardlink.
+func lowerTree(t *testing.T) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "rootfs")
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc", "hostname"), []byte("lower\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hostname", filepath.Join(dir, "etc", "name")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "etc", "hostname"), filepath.Join(dir, "etc", "alias")); err != nil {
+		t.Skipf("hardlinks: %v", err)
+	}
+	return dir
+}
+
+// supported skips backends the temp dir's filesystem cannot serve.
+func supported(t *testing.T, backend, lower string) {
+	t.Helper()
+
+	src := filepath.Join(lower, "etc", "hostname")
+	dst := filepath.Join(t.TempDir(), "probe")
+	switch backend {
+	case BackendReflink:
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		out, err := os.Create(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if err := reflinkFile(out, in); err != nil {
+			t.Skipf("reflinks: %v", err)
+		}
+	}
+}
+
+func TestCopySnapshotter(t *testing.T) {
+	for _, backend := range []string{BackendCopy, BackendReflink} {
+		t.Run(backend, func(t *testing.T) {
+			lower := lowerTree(t)
+			supported(t, backend, lower)
+
+			root := t.TempDir()
+			s, err := New(backend, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Prepare("a", lower); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Prepare("a", lower); err == nil {
+				t.Fatal("Prepare succeeded twice for the same key")
+			}
+
+			dir, err := s.Mount("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dir != filepath.Join(root, "active", "a") {
+				t.Fatalf("Mount = %s", dir)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "etc", "name")); err != nil || string(got) != "lower\n" {
+				t.Fatalf("etc/name through the symlink = %q, %v", got, err)
+			}
+			if link, err := os.Readlink(filepath.Join(dir, "etc", "name")); err != nil || link != "hostname" {
+				t.Fatalf("etc/name links to %q, %v", link, err)
+			}
+			// Only Linux reports link counts to copyTree.
+			if runtime.GOOS == "linux" && !sameFile(t, filepath.Join(dir, "etc", "hostname"), filepath.Join(dir, "etc", "alias")) {
+				t.Error("the hardlink within the tree was not kept")
+			}
+			if sameFile(t, filepath.Join(dir, "etc", "hostname"), filepath.Join(lower, "etc", "hostname")) {
+				t.Error("snapshot shares inodes with the lower dir")
+			}
+
+			// Neither writing a file in place nor replacing it reaches the
+			// lower dir.
+			f, err := os.OpenFile(filepath.Join(dir, "etc", "alias"), os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteString("edited\n"); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			if got, _ := os.ReadFile(filepath.Join(lower, "etc", "alias")); string(got) != "lower\n" {
+				t.Fatalf("lower etc/alias = %q after an in-place write to the snapshot", got)
+			}
+			tmp := filepath.Join(dir, "etc", "hostname.new")
+			if err := os.WriteFile(tmp, []byte("upper\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(tmp, filepath.Join(dir, "etc", "hostname")); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(lower, "etc", "hostname")); string(got) != "lower\n" {
+				t.Fatalf("lower etc/hostname = %q after a write to the snapshot", got)
+			}
+
+			if usage, err := s.Usage("a"); err != nil || usage.Inodes == 0 {
+				t.Fatalf("Usage = %+v, %v", usage, err)
+			}
+			if err := s.Diff("a", io.Discard); !errors.Is(err, ErrNotSupported) {
+				t.Fatalf("Diff = %v, want ErrNotSupported", err)
+			}
+
+			if err := os.MkdirAll(filepath.Join(root, "active", "b.tmp"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			mounted, err := s.Mounted()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mounted) != 1 || !mounted["a"] {
+				t.Fatalf("Mounted = %v, want only a", mounted)
+			}
+
+			if err := s.Unmount("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Remove("a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+				t.Fatalf("active/a after Remove: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(lower, "etc", "alias")); err != nil {
+				t.Fatalf("Remove reached the lower dir: %v", err)
+			}
+		})
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+
+	ai, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ai, bi)
+}
+
+func TestHardlinkSnapshotterIsRefused(t *testing.T) {
+	if _, err := New("hardlink", t.TempDir()); err == nil {
+		t.Fatal("New accepted the hardlink snapshotter")
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrNotSupported = errors.New("not supported by this snapshotter")
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+type TarOptions struct {
+	// Layer translates overlay whiteouts into OCI whiteout entries.
+	Layer bool
+
+	// ModTime, when set, replaces the times of every entry so that the
+	// output depends only on the tree's content and metadata.
+	ModTime time.Time
+}
+
+// writeLayer writes the contents of an overlay upper dir to w as an OCI
+// layer. Overlay whiteouts (0/0 char devices) become .wh.<name> entries and
+// opaque directories get a .wh..wh..opq entry right after their header, so
+// it applies to lower layers only. fuse-overlayfs without privileges writes
+// .wh. files instead, which already are OCI whiteouts.
+func writeLayer(w io.Writer, upperDir string) error {
+	return WriteTar(w, upperDir, TarOptions{Layer: true})
+}
+
+// WriteTar writes the tree below dir to w as a tar stream with entries in
+// lexical order, numeric ownership only, and hardlinks within the tree kept.
+func WriteTar(w io.Writer, dir string, opts TarOptions) error {
+	tw := tar.NewWriter(w)
+	links := make(map[fileID]string)
+
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+
+		modTime := info.ModTime()
+		if !opts.ModTime.IsZero() {
+			modTime = opts.ModTime
+		}
+
+		if opts.Layer && isWhiteout(info) {
+			parent, base := path.Split(name)
+			return tw.WriteHeader(&tar.Header{
+				Name:     parent + whiteoutPrefix + base,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				ModTime:  modTime,
+			})
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Uname, header.Gname = "", ""
+		header.ModTime = modTime
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		for attr, value := range layerXattrs(file) {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords["SCHILY.xattr."+attr] = value
+		}
+		if header.PAXRecords != nil {
+			header.Format = tar.FormatPAX
+		}
+
+		if info.IsDir() {
+			header.Name += "/"
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if opts.Layer && isOpaque(file) {
+				return tw.WriteHeader(&tar.Header{
+					Name:     name + "/" + whiteoutOpaque,
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+					ModTime:  modTime,
+				})
+			}
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			if id, shared := hardlinkID(info); shared {
+				if first, seen := links[id]; seen {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+					return tw.WriteHeader(header)
+				}
+				links[id] = name
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// overlayXattr reports xattrs that describe the overlay itself rather than
+// the file, which must not leak into a layer. fuse-overlayfs uses its own.
+func overlayXattr(name string) bool {
+	return strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") ||
+		strings.HasPrefix(name, "user.fuseoverlayfs.")
+}
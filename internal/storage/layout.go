@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Layout knows where everything that is not a snapshot lives in the store.
+type Layout struct {
+	root string
+}
+
+func NewLayout(root string) *Layout {
+	return &Layout{root: root}
+}
+
+func (l *Layout) Init() error {
+	dirs := []string{"blobs", "images", "layers", "staging", "exports", "objects"}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(l.root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dir is the top-level dir of the store with the given name, e.g. "staging".
+func (l *Layout) Dir(name string) string {
+	return filepath.Join(l.root, name)
+}
+
+func (l *Layout) GetImagePath(imageName string) string {
+	return filepath.Join(l.root, "images", imageName, "rootfs")
+}
+
+func (l *Layout) GetManifestPath(imageName string) string {
+	return filepath.Join(l.root, "images", imageName, "manifest.json")
+}
+
+// GetLayerPath is the rootfs of a layer shared by every image built from the
+// same content.
+func (l *Layout) GetLayerPath(id string) string {
+	return filepath.Join(l.root, "layers", id, "rootfs")
+}
+
+func (l *Layout) GetLayerManifestPath(id string) string {
+	return filepath.Join(l.root, "layers", id, "manifest.json")
+}
+
+func (l *Layout) GetStagingPath(imageName string) string {
+	return filepath.Join(l.root, "staging", imageName)
+}
+
+func (l *Layout) GetExportDir() string {
+	return filepath.Join(l.root, "exports")
+}
+
+func (l *Layout) GetBlobDir() string {
+	return filepath.Join(l.root, "blobs")
+}
+
+// GetObjectDir holds the file objects extracted trees are deduplicated
+// against.
+func (l *Layout) GetObjectDir() string {
+	return filepath.Join(l.root, "objects")
+}
+
+func (l *Layout) GetBlobPath(checksum string) string {
+	return filepath.Join(l.root, "blobs", checksum+".tar")
+}
+
+// GetActivePath is where the snapshot with the given key is mounted.
+func (l *Layout) GetActivePath(key string) string {
+	return filepath.Join(l.root, "active", key)
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"imgstore/internal/manifest"
+	"imgstore/internal/types"
+)
+
+const (
+	DedupHardlink = "hardlink"
+	DedupReflink  = "reflink"
+)
+
+// ObjectStore keeps one copy of each regular file of the extracted trees
+// under objects/<xx>/<key> and links the trees' files to it. A hardlinked
+// object shares its inode with the files, so its key covers their mode,
+// ownership, mtime and xattrs as well as their content; a reflinked object
+// only shares data blocks and is keyed by content alone.
+type ObjectStore struct {
+	dir  string
+	mode string
+}
+
+func NewObjectStore(mode, dir string) (*ObjectStore, error) {
+	switch mode {
+	case "", DedupHardlink, DedupReflink:
+		return &ObjectStore{dir: dir, mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unknown dedup mode %q", mode)
+}
+
+func (s *ObjectStore) Mode() string {
+	return s.mode
+}
+
+// Dedup links the regular files of an extracted tree to their objects,
+// adding objects for content not seen before. Unless times were restored
+// from the archive, hardlinked files take the mtime of their object. It
+// returns how many files were replaced by a link and the bytes that freed.
+func (s *ObjectStore) Dedup(tree string, files []manifest.Entry, times bool) (int, int64, error) {
+	var shared int
+	var saved int64
+	if s.mode == "" {
+		return shared, saved, nil
+	}
+	used := make(map[string]fs.FileInfo)
+
+	for _, entry := range files {
+		if entry.SHA256 == "" || entry.Size == 0 {
+			continue
+		}
+		path := filepath.Join(tree, filepath.FromSlash(entry.Path))
+		info, err := os.Lstat(path)
+		if err != nil {
+			return shared, saved, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		var freed bool
+		if s.mode == DedupHardlink {
+			freed, err = s.hardlink(path, entry.SHA256, info, times, used)
+		} else {
+			freed, err = s.reflink(path, entry.SHA256, info)
+		}
+		if err != nil {
+			return shared, saved, fmt.Errorf("%s: %v", entry.Path, err)
+		}
+		if freed {
+			shared++
+			saved += info.Size()
+		}
+	}
+	return shared, saved, nil
+}
+
+// hardlink links a file to its object. Within one tree an object is only
+// linked to by files that were already hardlinked together: copying the
+// tree keeps its hardlinks, so linking copies that happen to match would
+// make a write to one show up in the others.
+func (s *ObjectStore) hardlink(path, digest string, info fs.FileInfo, times bool, used map[string]fs.FileInfo) (bool, error) {
+	meta, ok := inodeKey(path, info, times)
+	if !ok {
+		return false, fmt.Errorf("hardlink dedup is not supported on this platform")
+	}
+	object := s.objectPath(fmt.Sprintf("%s-%x", digest, sha256.Sum256([]byte(meta)))[:len(digest)+17])
+
+	err := os.Link(path, object)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return false, err
+		}
+		err = os.Link(path, object)
+	}
+	if err == nil {
+		used[object] = info
+	}
+	if err == nil || !os.IsExist(err) {
+		return false, err
+	}
+	if first, ok := used[object]; ok && !os.SameFile(first, info) {
+		return false, nil
+	}
+
+	existing, err := os.Lstat(object)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(info, existing) {
+		return false, nil
+	}
+	used[object] = info
+	tmp := path + ".dedup~"
+	if err := os.Link(object, tmp); err != nil {
+		if errors.Is(err, syscall.EMLINK) {
+			return false, nil // The object is at the link limit; keep the copy
+		}
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	// Only the last link to the old inode frees its blocks.
+	return linkCount(info) == 1, nil
+}
+
+func (s *ObjectStore) reflink(path, digest string, info fs.FileInfo) (bool, error) {
+	object := s.objectPath(digest)
+	if _, err := os.Lstat(object); os.IsNotExist(err) {
+		return false, s.add(path, object)
+	} else if err != nil {
+		return false, err
+	}
+
+	src, err := os.Open(object)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsPermission(err) {
+		return false, nil // A read-only file can only be linked
+	}
+	if err != nil {
+		return false, err
+	}
+	err = reflinkFile(dst, src)
+	dst.Close()
+	if err != nil {
+		return false, err
+	}
+	// Cloning counts as a write, so the mtime has to be put back.
+	return true, os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// add clones a file into a new reflinked object.
+func (s *ObjectStore) add(path, object string) error {
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(object), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = reflinkFile(tmp, src)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), object)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *ObjectStore) objectPath(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+// GC removes hardlinked objects that no tree links to any more, and
+// reflinked objects whose content refs, counting the trees' files by
+// checksum, no longer lists. It returns the objects removed, or that would
+// be on a dry run, and their size.
+func (s *ObjectStore) GC(dryRun bool, refs map[string]int) (int, int64, error) {
+	var removed int
+	var bytes int64
+	err := s.walk(func(path string, info fs.FileInfo) error {
+		name := info.Name()
+		if strings.Contains(name, "-") {
+			if linkCount(info) != 1 {
+				return nil
+			}
+		} else if refs[name] > 0 {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		removed++
+		bytes += info.Size()
+		return nil
+	})
+	return removed, bytes, err
+}
+
+// Stats counts the objects and what sharing them saves, with refs as for GC.
+func (s *ObjectStore) Stats(refs map[string]int) (types.DedupStats, error) {
+	stats := types.DedupStats{Mode: s.mode}
+	err := s.walk(func(path string, info fs.FileInfo) error {
+		users := int64(refs[info.Name()])
+		if strings.Contains(info.Name(), "-") {
+			users = int64(linkCount(info)) - 1
+		}
+		stats.Objects++
+		stats.Bytes += info.Size()
+		if users > 1 {
+			stats.Saved += (users - 1) * info.Size()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// walk calls fn for every object, skipping clones still being written.
+func (s *ObjectStore) walk(fn func(path string, info fs.FileInfo) error) error {
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
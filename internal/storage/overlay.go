@@ -2,21 +2,41 @@ package storage
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"imgstore/internal/mountinfo"
+)
+
+type overlayMode string
+
+const (
+	modeKernel overlayMode = "kernel"
+	modeUserNS overlayMode = "userns"
+	modeFuse   overlayMode = "fuse-overlayfs"
 )
 
 type OverlayStorage struct {
 	root string
+	mode overlayMode
 }
 
 func NewOverlayStorage(root string) *OverlayStorage {
 	return &OverlayStorage{root: root}
 }
 
+// Init detects how overlays can be mounted by this process; see
+// detectOverlayMode.
 func (o *OverlayStorage) Init() error {
-	dirs := []string{"blobs", "images", "overlays", "active"}
+	mode, err := detectOverlayMode()
+	if err != nil {
+		return err
+	}
+	o.mode = mode
+
+	dirs := []string{"overlays", "active"}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(filepath.Join(o.root, dir), 0755); err != nil {
 			return err
@@ -25,12 +45,11 @@ func (o *OverlayStorage) Init() error {
 	return nil
 }
 
-func (o *OverlayStorage) CreateSnapshot(imageName string) error {
-	overlayDir := filepath.Join(o.root, "overlays", imageName)
+func (o *OverlayStorage) Prepare(key, lowerDir string) error {
+	overlayDir := filepath.Join(o.root, "overlays", key)
 	upperDir := filepath.Join(overlayDir, "upper")
 	workDir := filepath.Join(overlayDir, "work")
-	activeDir := filepath.Join(o.root, "active", imageName)
-	lowerDir := filepath.Join(o.root, "images", imageName, "rootfs")
+	activeDir := filepath.Join(o.root, "active", key)
 
 	// Create directories
 	for _, dir := range []string{upperDir, workDir, activeDir} {
@@ -39,22 +58,125 @@ func (o *OverlayStorage) CreateSnapshot(imageName string) error {
 		}
 	}
 
+	// Remember the lower dir so Mount can be called again later
+	return os.WriteFile(filepath.Join(overlayDir, "lower"), []byte(lowerDir), 0644)
+}
+
+func (o *OverlayStorage) Mount(key string) (string, error) {
+	overlayDir := filepath.Join(o.root, "overlays", key)
+	activeDir := filepath.Join(o.root, "active", key)
+
+	lowerDir, err := os.ReadFile(filepath.Join(overlayDir, "lower"))
+	if err != nil {
+		return "", err
+	}
+
 	// Mount overlay
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir)
-	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", opts, activeDir)
-	return cmd.Run()
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		lowerDir, filepath.Join(overlayDir, "upper"), filepath.Join(overlayDir, "work"))
+	var cmd *exec.Cmd
+	switch o.mode {
+	case modeFuse:
+		cmd = exec.Command("fuse-overlayfs", "-o", opts, activeDir)
+	case modeUserNS:
+		// Without trusted.* xattrs, overlayfs keeps its metadata in user.*.
+		cmd = exec.Command("mount", "-t", "overlay", "overlay", "-o", opts+",userxattr", activeDir)
+	default:
+		cmd = exec.Command("mount", "-t", "overlay", "overlay", "-o", opts, activeDir)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("mount overlay %s: %v: %s", key, err, out)
+	}
+	return activeDir, nil
 }
 
-func (o *OverlayStorage) RemoveSnapshot(imageName string) error {
-	activeDir := filepath.Join(o.root, "active", imageName)
+func (o *OverlayStorage) Unmount(key string) error {
+	activeDir := filepath.Join(o.root, "active", key)
 	cmd := exec.Command("umount", activeDir)
-	return cmd.Run()
+	if o.mode == modeFuse {
+		helper, err := fusermount()
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command(helper, "-u", activeDir)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("umount %s: %v: %s", key, err, out)
+	}
+	return nil
+}
+
+// fusermount finds the helper that unmounts FUSE filesystems without
+// privileges.
+func fusermount() (string, error) {
+	if path, err := exec.LookPath("fusermount3"); err == nil {
+		return path, nil
+	}
+	return exec.LookPath("fusermount")
+}
+
+// Remove deletes the snapshot's directories. The mount point is removed with
+// os.Remove so that a snapshot which is still mounted is never recursed into.
+func (o *OverlayStorage) Remove(key string) error {
+	activeDir := filepath.Join(o.root, "active", key)
+	if err := os.Remove(activeDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(o.root, "overlays", key))
+}
+
+// SetQuota limits the upper dir with a project quota, which needs an XFS or
+// ext4 filesystem mounted with prjquota.
+func (o *OverlayStorage) SetQuota(key string, project uint32, size int64) error {
+	return setProjectQuota(filepath.Join(o.root, "overlays", key, "upper"), project, size)
+}
+
+// Freeze remounts the overlay read-only; it stays so until it is mounted
+// again.
+func (o *OverlayStorage) Freeze(key string) error {
+	activeDir := filepath.Join(o.root, "active", key)
+	cmd := exec.Command("mount", "-o", "remount,bind,ro", activeDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("remount %s read-only: %v: %s", key, err, out)
+	}
+	return nil
 }
 
-func (o *OverlayStorage) GetImagePath(imageName string) string {
-	return filepath.Join(o.root, "images", imageName, "rootfs")
+// Usage reports the upper dir, which holds everything written to the snapshot.
+func (o *OverlayStorage) Usage(key string) (Usage, error) {
+	return DiskUsage(filepath.Join(o.root, "overlays", key, "upper"))
 }
 
-func (o *OverlayStorage) GetBlobPath(checksum string) string {
-	return filepath.Join(o.root, "blobs", checksum+".tar")
-}
\ No newline at end of file
+// Diff writes the upper dir, which holds every change made through the
+// mount, as a layer. Writers should be quiesced for a consistent result.
+func (o *OverlayStorage) Diff(key string, w io.Writer) error {
+	upperDir := filepath.Join(o.root, "overlays", key, "upper")
+	if _, err := os.Stat(upperDir); err != nil {
+		return err
+	}
+	return writeLayer(w, upperDir)
+}
+
+// Mounted lists the overlays mounted directly below active/, as reported by
+// the kernel rather than by the database.
+func (o *OverlayStorage) Mounted() (map[string]bool, error) {
+	activeDir, err := filepath.Abs(filepath.Join(o.root, "active"))
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(activeDir); err == nil {
+		activeDir = resolved
+	}
+
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	for _, m := range mounts {
+		if filepath.Dir(m.MountPoint) == activeDir {
+			mounted[filepath.Base(m.MountPoint)] = true
+		}
+	}
+	return mounted, nil
+}
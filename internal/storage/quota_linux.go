@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"imgstore/internal/mountinfo"
+)
+
+// Project quotas are not wrapped by x/sys; these follow <linux/fs.h> and
+// <linux/quota.h> with the asm-generic ioctl encoding.
+const (
+	fsIocFsgetxattr    = 0x801c581f
+	fsIocFssetxattr    = 0x401c5820
+	fsXflagProjinherit = 0x00000200
+	qSetQuotaPrjquota  = 0x800008<<8 | 2
+	qifBlimits         = 1
+	quotaBlockSize     = 1024
+)
+
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+type dqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+	_          uint32
+}
+
+// setProjectQuota assigns project to dir and everything below it, with new
+// entries inheriting it, and limits the project to size bytes. size 0 lifts
+// the limit and leaves the tree as it is.
+func setProjectQuota(dir string, project uint32, size int64) error {
+	dev, err := quotaDevice(dir)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		if err := setProject(dir, project); err != nil {
+			return err
+		}
+	}
+
+	blocks := uint64((size + quotaBlockSize - 1) / quotaBlockSize)
+	dq := dqblk{bhardlimit: blocks, bsoftlimit: blocks, valid: qifBlimits}
+	devPtr, err := unix.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, qSetQuotaPrjquota,
+		uintptr(unsafe.Pointer(devPtr)), uintptr(project), uintptr(unsafe.Pointer(&dq)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("set quota for project %d on %s: %w", project, dev, errno)
+	}
+	return nil
+}
+
+// quotaDevice returns the block device of the filesystem holding dir, if it
+// is mounted with project quotas.
+func quotaDevice(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		return "", err
+	}
+	var best *mountinfo.Mount
+	for i, m := range mounts {
+		if dir != m.MountPoint && !strings.HasPrefix(dir, strings.TrimSuffix(m.MountPoint, "/")+"/") {
+			continue
+		}
+		// Later mounts on the same point hide earlier ones.
+		if best == nil || len(m.MountPoint) >= len(best.MountPoint) {
+			best = &mounts[i]
+		}
+	}
+	if best == nil || !projectQuotaOn(best) {
+		return "", fmt.Errorf("project quota on %s: %w", dir, ErrNotSupported)
+	}
+	return best.Source, nil
+}
+
+func projectQuotaOn(m *mountinfo.Mount) bool {
+	if m.FSType != "xfs" && m.FSType != "ext4" {
+		return false
+	}
+	for _, opt := range strings.Split(m.Options+","+m.SuperOptions, ",") {
+		switch opt {
+		case "prjquota", "pquota", "prjjquota":
+			return true
+		}
+	}
+	return false
+}
+
+func setProject(dir string, project uint32) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		var attr fsxattr
+		if err := fsxattrIoctl(fd, fsIocFsgetxattr, &attr); err != nil {
+			return fmt.Errorf("get project of %s: %w", path, err)
+		}
+		attr.projid = project
+		if d.IsDir() {
+			attr.xflags |= fsXflagProjinherit
+		}
+		if err := fsxattrIoctl(fd, fsIocFssetxattr, &attr); err != nil {
+			return fmt.Errorf("set project of %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func fsxattrIoctl(fd int, req uintptr, attr *fsxattr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(attr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package storage
+
+import "fmt"
+
+func setProjectQuota(dir string, project uint32, size int64) error {
+	return fmt.Errorf("project quota on %s: %w", dir, ErrNotSupported)
+}
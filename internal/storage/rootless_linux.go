@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// userNSEnv is set in the environment of a process re-executed by
+// ReexecRootless, so it does not try again.
+const userNSEnv = "IMGSTORE_USERNS"
+
+// detectOverlayMode picks how overlays can be mounted by this process: with
+// the mount binary as root, as root of a user namespace on a kernel that
+// allows overlayfs there, or with fuse-overlayfs.
+func detectOverlayMode() (overlayMode, error) {
+	root := os.Geteuid() == 0
+	return overlayModeFor(root, root && inUserNamespace(), kernelAtLeast(5, 11), fuseAvailable())
+}
+
+// overlayModeFor is detectOverlayMode for a process that is root or not,
+// in a user namespace or not, on a kernel that mounts overlayfs in user
+// namespaces or not, and with fuse-overlayfs available or not.
+func overlayModeFor(root, userNS, kernelUserNS, fuse bool) (overlayMode, error) {
+	if root {
+		if !userNS {
+			return modeKernel, nil
+		}
+		if kernelUserNS {
+			return modeUserNS, nil
+		}
+	}
+	if fuse {
+		return modeFuse, nil
+	}
+	return "", errors.New("overlay snapshotter: cannot mount as an unprivileged user; " +
+		"run as root, allow unprivileged user namespaces (kernel 5.11+), " +
+		"install fuse-overlayfs, or use the copy snapshotter")
+}
+
+// ReexecRootless runs the program again inside a new user and mount
+// namespace, with the current user mapped to root, so that the overlay
+// backend can use kernel overlayfs without privileges. It returns nil
+// straight away when that is not needed or not possible; otherwise it exits
+// with the child's status. Mounts made in the namespace are only visible to
+// the child.
+func ReexecRootless(backend string) error {
+	if backend != "" && backend != BackendOverlay {
+		return nil
+	}
+	if os.Geteuid() == 0 || os.Getenv(userNSEnv) != "" || !kernelAtLeast(5, 11) {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), userNSEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}},
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("user namespace: %w", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	code := 0
+	var exit *exec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exit) {
+		code = exit.ExitCode()
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+	os.Exit(code)
+	return nil
+}
+
+// PrivateMounts reports whether this process runs in the mount namespace
+// ReexecRootless made for it, where its mounts vanish when it exits and no
+// other process sees them.
+func PrivateMounts() bool {
+	return os.Getenv(userNSEnv) != ""
+}
+
+// inUserNamespace reports whether the uid map is narrower than the initial
+// namespace's, which maps the whole range onto itself.
+func inUserNamespace() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+}
+
+func kernelAtLeast(major, minor int) bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	release := unix.ByteSliceToString(uts.Release[:])
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	min, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
+
+func fuseAvailable() bool {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		return false
+	}
+	if _, err := fusermount(); err != nil {
+		return false
+	}
+	_, err := os.Stat("/dev/fuse")
+	return err == nil
+}
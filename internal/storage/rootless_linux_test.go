@@ -0,0 +1,36 @@
+package storage
+
+import "testing"
+
+func TestOverlayModeFor(t *testing.T) {
+	for _, tt := range []struct {
+		root, userNS, kernel, fuse bool
+		want                       overlayMode
+	}{
+		{root: true, want: modeKernel},
+		{root: true, kernel: true, fuse: true, want: modeKernel},
+		{root: true, userNS: true, kernel: true, want: modeUserNS},
+		{root: true, userNS: true, fuse: true, want: modeFuse},
+		{kernel: true, fuse: true, want: modeFuse},
+		{fuse: true, want: modeFuse},
+		{kernel: true},
+		{root: true, userNS: true},
+	} {
+		got, err := overlayModeFor(tt.root, tt.userNS, tt.kernel, tt.fuse)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("overlayModeFor(root %v, userns %v, kernel %v, fuse %v) = %q, %v; want %q",
+				tt.root, tt.userNS, tt.kernel, tt.fuse, got, err, tt.want)
+		}
+	}
+}
+
+func TestPrivateMounts(t *testing.T) {
+	t.Setenv(userNSEnv, "")
+	if PrivateMounts() {
+		t.Fatal("PrivateMounts outside a re-executed process")
+	}
+	t.Setenv(userNSEnv, "1")
+	if !PrivateMounts() {
+		t.Fatal("PrivateMounts is false in a re-executed process")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package storage
+
+// detectOverlayMode keeps the mount binary: overlayfs only exists on Linux,
+// so mounting fails there with the binary's own error.
+func detectOverlayMode() (overlayMode, error) {
+	return modeKernel, nil
+}
+
+// PrivateMounts is always false: ReexecRootless never re-executes here.
+func PrivateMounts() bool {
+	return false
+}
+
+// ReexecRootless does nothing: user namespaces are Linux-only.
+func ReexecRootless(backend string) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+)
+
+// Snapshotter manages writable snapshots on top of an extracted rootfs. A
+// snapshot is identified by key and mounted at active/<key>.
+type Snapshotter interface {
+	Init() error
+	Prepare(key, lowerDir string) error
+	Mount(key string) (string, error)
+	Unmount(key string) error
+	Remove(key string) error
+	Usage(key string) (Usage, error)
+
+	// Mounted returns the keys of the snapshots that are currently usable
+	// at active/<key>.
+	Mounted() (map[string]bool, error)
+
+	// Diff writes the changes made in the snapshot as an OCI layer tar.
+	Diff(key string, w io.Writer) error
+}
+
+// Limiter is implemented by snapshotters that can limit how much a snapshot
+// writes.
+type Limiter interface {
+	// SetQuota caps the snapshot's writable dir at size bytes with a
+	// filesystem project quota under the given project ID; a size of 0
+	// lifts the limit. It returns ErrNotSupported when the filesystem has
+	// no project quotas.
+	SetQuota(key string, project uint32, size int64) error
+
+	// Freeze makes the mounted snapshot read-only.
+	Freeze(key string) error
+}
+
+type Usage struct {
+	Size   int64 `json:"size"`
+	Inodes int64 `json:"inodes"`
+}
+
+const (
+	BackendOverlay = "overlay"
+	BackendCopy    = "copy"
+	BackendReflink = "reflink"
+)
+
+// CloneTree copies the tree at src to dst, which must not exist yet, using
+// reflinks where the filesystem supports them.
+func CloneTree(src, dst string) error {
+	return copyTree(src, dst, cloneReflink)
+}
+
+func New(backend, root string) (Snapshotter, error) {
+	switch backend {
+	case "", BackendOverlay:
+		return NewOverlayStorage(root), nil
+	case BackendCopy:
+		return NewCopySnapshotter(root, cloneCopy), nil
+	case BackendReflink:
+		return NewCopySnapshotter(root, cloneReflink), nil
+	case "hardlink":
+		// Its snapshots shared inodes with the layer, so any write to one
+		// reached every image built on that layer.
+		return nil, fmt.Errorf("the hardlink snapshotter is no longer supported: writes to its snapshots reached the layer; use %q", BackendReflink)
+	}
+	return nil, fmt.Errorf("unknown snapshotter %q", backend)
+}
+
+// DiskUsage sums the apparent size of every entry below dir.
+func DiskUsage(dir string) (Usage, error) {
+	var usage Usage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.Inodes++
+		if info.Mode().IsRegular() {
+			usage.Size += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// FilesystemSize returns the total size of the filesystem holding path.
+func FilesystemSize(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), nil
+}
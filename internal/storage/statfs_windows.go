@@ -0,0 +1,16 @@
+package storage
+
+import "golang.org/x/sys/windows"
+
+// FilesystemSize returns the total size of the volume holding path.
+func FilesystemSize(path string) (int64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return int64(total), nil
+}
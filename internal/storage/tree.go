@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// copyTree recreates src at dst, preserving symlinks, hardlinks within the
+// tree, special files and as much metadata as the process may set.
+func copyTree(src, dst string, clone cloneMode) error {
+	links := make(map[fileID]string)
+	var dirs []string
+	var dirInfos []fs.FileInfo
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			// Directory metadata is applied once its contents are in place.
+			dirs = append(dirs, target)
+			dirInfos = append(dirInfos, info)
+			return nil
+
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+
+		case mode.IsRegular():
+			if id, shared := hardlinkID(info); shared {
+				if first, seen := links[id]; seen {
+					return os.Link(first, target)
+				}
+				links[id] = target
+			}
+			if err := cloneFile(path, target, clone == cloneReflink); err != nil {
+				return err
+			}
+
+		default:
+			if err := mknodLike(target, info); err != nil {
+				return err
+			}
+		}
+		return copyMetadata(path, target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := filepath.Rel(dst, dirs[i])
+		if err := copyMetadata(filepath.Join(src, rel), dirs[i], dirInfos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cloneFile(src, dst string, reflink bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if reflink && reflinkFile(out, in) == nil {
+		return nil
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func hardlinkID(info fs.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: st.Dev, ino: st.Ino}, true
+}
+
+func reflinkFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+func mknodLike(target string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if info.Mode()&fs.ModeSocket != 0 {
+		return nil // Sockets are meaningless without their listener
+	}
+	return unix.Mknod(target, st.Mode, int(st.Rdev))
+}
+
+// copyMetadata copies ownership, mode, xattrs and times from src to target.
+// Ownership and privileged xattrs are best effort for unprivileged runs.
+func copyMetadata(src, target string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	symlink := info.Mode()&fs.ModeSymlink != 0
+
+	if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	if !symlink {
+		if err := unix.Chmod(target, st.Mode&07777); err != nil {
+			return err
+		}
+	}
+
+	copyXattrs(src, target)
+
+	atime := time.Unix(st.Atim.Unix())
+	mtime := time.Unix(st.Mtim.Unix())
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func copyXattrs(src, target string) {
+	for name, value := range readXattrs(src) {
+		unix.Lsetxattr(target, name, []byte(value), 0)
+	}
+}
+
+// readXattrs returns every xattr of path that the process can read.
+func readXattrs(path string) map[string]string {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+
+	attrs := make(map[string]string)
+	start := 0
+	for i := 0; i < size; i++ {
+		if buf[i] != 0 {
+			continue
+		}
+		name := string(buf[start:i])
+		start = i + 1
+
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, name, value); err != nil {
+			continue
+		}
+		attrs[name] = string(value[:vsize])
+	}
+	return attrs
+}
+
+func layerXattrs(path string) map[string]string {
+	attrs := readXattrs(path)
+	for name := range attrs {
+		if overlayXattr(name) {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// isWhiteout reports an overlay whiteout: a character device numbered 0/0.
+func isWhiteout(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0
+}
+
+// isOpaque reports a directory that hides the lower dir's contents, marked
+// with trusted.overlay.opaque, user.overlay.opaque on userxattr mounts, or
+// user.fuseoverlayfs.opaque by fuse-overlayfs.
+func isOpaque(path string) bool {
+	attrs := readXattrs(path)
+	return attrs["trusted.overlay.opaque"] == "y" || attrs["user.overlay.opaque"] == "y" ||
+		attrs["user.fuseoverlayfs.opaque"] == "y"
+}
+
+func linkCount(info fs.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Nlink)
+}
+
+// inodeKey describes what hardlinks share besides content: mode, ownership,
+// xattrs and, if times matter, mtime.
+func inodeKey(path string, info fs.FileInfo, times bool) (string, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	attrs := readXattrs(path)
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := fmt.Sprintf("%o %d %d", st.Mode, st.Uid, st.Gid)
+	if times {
+		key += fmt.Sprintf(" %d", info.ModTime().UnixNano())
+	}
+	for _, name := range names {
+		key += fmt.Sprintf("\n%s=%q", name, attrs[name])
+	}
+	return key, true
+}
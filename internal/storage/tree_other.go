@@ -0,0 +1,53 @@
+//go:build !linux
+
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+type fileID struct{}
+
+func hardlinkID(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func reflinkFile(dst, src *os.File) error {
+	return fmt.Errorf("reflink not supported on this platform")
+}
+
+func mknodLike(target string, info fs.FileInfo) error {
+	return nil // Special files are skipped
+}
+
+func copyMetadata(src, target string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(target, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+func layerXattrs(path string) map[string]string {
+	return nil
+}
+
+func isWhiteout(info fs.FileInfo) bool {
+	return false
+}
+
+func isOpaque(path string) bool {
+	return false
+}
+
+func linkCount(info fs.FileInfo) uint64 {
+	return 0
+}
+
+func inodeKey(path string, info fs.FileInfo, times bool) (string, bool) {
+	return "", false
+}
@@ -1,11 +1,123 @@
 package types
 
+import "time"
+
 type ImageInfo struct {
 	ID       int    `json:"id"`
 	Name     string `json:"name"`
 	BlobKey  string `json:"blob_key"`
 	Checksum string `json:"checksum"`
 	State    string `json:"state"`
+	Policy   string `json:"policy"`
+	Parent   string `json:"parent,omitempty"`
 	Created  string `json:"created_at"`
 	Updated  string `json:"updated_at"`
-}
\ No newline at end of file
+}
+type SnapshotInfo struct {
+	ID        int    `json:"id"`
+	Image     string `json:"image"`
+	Name      string `json:"name"`
+	Active    bool   `json:"active"`
+	Path      string `json:"path"`
+	UpperSize int64  `json:"upper_size"`
+	Quota     int64  `json:"quota,omitempty"`
+	QuotaMode string `json:"quota_mode,omitempty"`
+	Created   string `json:"created_at"`
+}
+
+// ImageUsage is the space taken by an image, in bytes: its blob, its
+// extracted rootfs and what has been written to its own snapshot.
+type ImageUsage struct {
+	BlobSize   int64          `json:"blob_size"`
+	RootfsSize int64          `json:"rootfs_size"`
+	UpperSize  int64          `json:"upper_size"`
+	Snapshots  []SnapshotInfo `json:"snapshots"`
+
+	// BlobQuarantined is set when the image's blob failed verification and
+	// was moved to blobs/quarantine/.
+	BlobQuarantined bool `json:"blob_quarantined,omitempty"`
+}
+
+// GCReport describes a blob garbage collection: the files removed, or that
+// would be on a dry run, and the bytes they take. Objects and ObjectBytes
+// count the deduplicated file objects removed with them, Exports and
+// ExportBytes the cached exports.
+type GCReport struct {
+	DryRun      bool     `json:"dry_run"`
+	Live        int      `json:"live"`
+	Removed     []string `json:"removed"`
+	Bytes       int64    `json:"bytes"`
+	Objects     int      `json:"objects"`
+	ObjectBytes int64    `json:"object_bytes"`
+	Exports     int      `json:"exports"`
+	ExportBytes int64    `json:"export_bytes"`
+}
+
+// DedupStats describes the file object store: the objects it holds, the
+// bytes they take and the bytes extracted trees would take on top of that
+// without them.
+type DedupStats struct {
+	Mode    string `json:"mode"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+	Saved   int64  `json:"saved"`
+}
+
+// ScrubReport describes a blob verification pass. Unrecoverable lists the
+// quarantined blobs that no image can download again.
+type ScrubReport struct {
+	Checked       int      `json:"checked"`
+	Bytes         int64    `json:"bytes"`
+	Quarantined   []string `json:"quarantined"`
+	Unrecoverable []string `json:"unrecoverable"`
+}
+
+// FsckProblem is a disagreement between the catalog and the store found by
+// fsck, and whether it was repaired.
+type FsckProblem struct {
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Problems []FsckProblem `json:"problems"`
+	Repaired int           `json:"repaired"`
+}
+
+// CacheStats describes how the blob cache has performed since the store was
+// created, and what it holds now.
+type CacheStats struct {
+	Hits            int64      `json:"hits"`
+	Misses          int64      `json:"misses"`
+	HitRatio        float64    `json:"hit_ratio"`
+	CachedBytes     int64      `json:"cached_bytes"`
+	DownloadedBytes int64      `json:"downloaded_bytes"`
+	Evictions       int64      `json:"evictions"`
+	EvictedBytes    int64      `json:"evicted_bytes"`
+	Quarantined     int64      `json:"quarantined"`
+	Size            int64      `json:"size"`
+	Budget          int64      `json:"budget,omitempty"`
+	Blobs           []BlobInfo `json:"blobs"`
+}
+
+// BlobInfo is a cached blob; Refs counts the images built from it.
+type BlobInfo struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Refs     int       `json:"refs"`
+	LastUsed time.Time `json:"last_used"`
+	Pinned   bool      `json:"pinned"`
+}
+
+// Pin protects the blob Checksum, directly (kind "blob") or as the blob of
+// the image Target (kind "image"), from garbage collection and eviction.
+type Pin struct {
+	Kind     string     `json:"kind"`
+	Target   string     `json:"target"`
+	Checksum string     `json:"checksum"`
+	Reason   string     `json:"reason,omitempty"`
+	Expires  *time.Time `json:"expires_at,omitempty"`
+	Created  string     `json:"created_at"`
+}
@@ -2,44 +2,93 @@ package main
 
 import (
 	"context"
-	"database/sql"
-	"io/ioutil"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"imgstore/internal/bundle"
+	"imgstore/internal/cache"
+	"imgstore/internal/config"
+	"imgstore/internal/metadata"
+	"imgstore/internal/service"
+	"imgstore/internal/storage"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run carries out the command and returns the exit status, so deferred
+// cleanup such as closing the catalog happens before the process exits.
+func run() int {
 	if len(os.Args) < 2 {
 		log.Fatal("Usage: imgstore <command> [args...]")
 	}
 
-	db, err := sql.Open("sqlite3", "./store.db?_journal_mode=WAL")
+	cfg, err := config.Load(configPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := storage.ReexecRootless(cfg.Snapshotter); err != nil {
+		log.Printf("Rootless overlay: %v", err)
+	}
+
+	// The catalog is replaced before anything opens it.
+	if os.Args[1] == "restore" {
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore restore <backup.db>")
+		}
+		err := metadata.Restore(os.Args[2], cfg.DatabaseDSN())
+		if errors.Is(err, metadata.ErrInUse) {
+			log.Fatalf("%v; stop the server and worker first", err)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	meta, err := metadata.Open(cfg.DatabaseDSN())
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer meta.Close()
 
-	if err := initSchema(db); err != nil {
+	if err := initSchema(meta); err != nil {
 		log.Fatal(err)
 	}
 
-	svc := NewService(db, "./store")
+	svc, err := service.NewService(meta, "./store", cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if err := svc.Init(); err != nil {
 		log.Fatal(err)
 	}
+	if os.Args[1] != "worker" {
+		svc.OneShot()
+	}
 
 	ctx := context.Background()
 	
 	switch os.Args[1] {
 	case "fetch":
-		if len(os.Args) != 5 {
-			log.Fatal("Usage: imgstore fetch <name> <url> <checksum>")
+		if len(os.Args) != 5 && len(os.Args) != 6 {
+			log.Fatal("Usage: imgstore fetch <name> <url> <checksum> [policy]")
 		}
 		name, url, checksum := os.Args[2], os.Args[3], os.Args[4]
-		if err := svc.EnqueueImage(ctx, name, url, checksum); err != nil {
+		policy := ""
+		if len(os.Args) == 6 {
+			policy = os.Args[5]
+		}
+		if err := svc.EnqueueImage(ctx, name, url, checksum, policy); err != nil {
 			log.Fatal(err)
 		}
 		log.Printf("Enqueued image %s", name)
@@ -54,21 +103,409 @@ func main() {
 			log.Fatal(err)
 		}
 		log.Printf("Image %s: %s", name, state)
+		if usage, err := svc.GetImageUsage(name); err == nil {
+			log.Printf("Usage: blob %d, rootfs %d, upper %d bytes", usage.BlobSize, usage.RootfsSize, usage.UpperSize)
+			if usage.BlobQuarantined {
+				log.Printf("Blob failed verification and was quarantined; it is downloaded again when next needed")
+			}
+		}
 		
+	case "rm":
+		if len(os.Args) != 3 {
+			log.Fatal("Usage: imgstore rm <name>")
+		}
+		if err := svc.RemoveImage(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Image %s marked for deletion", os.Args[2])
+
+	case "ls":
+		if len(os.Args) != 3 && len(os.Args) != 4 {
+			log.Fatal("Usage: imgstore ls <name> [path]")
+		}
+		prefix := ""
+		if len(os.Args) == 4 {
+			prefix = os.Args[3]
+		}
+		files, err := svc.ListFiles(os.Args[2], prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, f := range files {
+			line := fmt.Sprintf("%-8s %s %12d  %s", f.Type, f.Mode, f.Size, f.Path)
+			if f.Linkname != "" {
+				line += " -> " + f.Linkname
+			}
+			fmt.Println(line)
+		}
+
+	case "snapshot":
+		if len(os.Args) < 4 {
+			log.Fatal("Usage: imgstore snapshot <create|ls|rm> <image> [name] [-quota bytes]")
+		}
+		image := os.Args[3]
+		switch {
+		case os.Args[2] == "create" && len(os.Args) >= 5:
+			flags := flag.NewFlagSet("snapshot create", flag.ExitOnError)
+			quota := flags.Int64("quota", 0, "Limit writes to this many bytes")
+			flags.Parse(os.Args[5:])
+			snap, err := svc.CreateSnapshot(image, os.Args[4], *quota)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Snapshot %s of %s mounted at %s", snap.Name, image, snap.Path)
+		case os.Args[2] == "ls" && len(os.Args) == 4:
+			snaps, err := svc.ListSnapshots(image)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, snap := range snaps {
+				fmt.Printf("%-20s %-6t %12d %12d %s  %s\n", snap.Name, snap.Active, snap.UpperSize, snap.Quota, snap.Created, snap.Path)
+			}
+		case os.Args[2] == "rm" && len(os.Args) == 5:
+			if err := svc.RemoveSnapshot(image, os.Args[4]); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Removed snapshot %s of %s", os.Args[4], image)
+		default:
+			log.Fatal("Usage: imgstore snapshot <create|ls|rm> <image> [name] [-quota bytes]")
+		}
+
+	case "activate":
+		if len(os.Args) != 3 {
+			log.Fatal("Usage: imgstore activate <name>")
+		}
+		if err := svc.ActivateImage(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Image %s: ACTIVE", os.Args[2])
+
+	case "deactivate":
+		flags := flag.NewFlagSet("deactivate", flag.ExitOnError)
+		discard := flags.Bool("discard", false, "Delete the upper dir as well")
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore deactivate <name> [-discard]")
+		}
+		flags.Parse(os.Args[3:])
+		if err := svc.DeactivateImage(os.Args[2], *discard); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Image %s: STORED", os.Args[2])
+
+	case "pin":
+		flags := flag.NewFlagSet("pin", flag.ExitOnError)
+		blob := flags.Bool("blob", false, "Pin a blob by digest instead of an image")
+		reason := flags.String("reason", "", "Why the pin exists")
+		ttl := flags.Duration("ttl", 0, "Expire the pin after this long")
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore pin <image|digest> [-blob] [-reason text] [-ttl 72h]")
+		}
+		flags.Parse(os.Args[3:])
+		kind := cache.PinImage
+		if *blob {
+			kind = cache.PinBlob
+		}
+		pin, err := svc.Pin(kind, os.Args[2], *reason, *ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		until := ""
+		if pin.Expires != nil {
+			until = " until " + pin.Expires.Format(time.RFC3339)
+		}
+		log.Printf("Pinned %s %s (blob %s)%s", pin.Kind, pin.Target, pin.Checksum[:12], until)
+
+	case "unpin":
+		flags := flag.NewFlagSet("unpin", flag.ExitOnError)
+		blob := flags.Bool("blob", false, "Unpin a blob by digest instead of an image")
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore unpin <image|digest> [-blob]")
+		}
+		flags.Parse(os.Args[3:])
+		kind := cache.PinImage
+		if *blob {
+			kind = cache.PinBlob
+		}
+		if err := svc.Unpin(kind, os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Unpinned %s %s", kind, os.Args[2])
+
+	case "pins":
+		pins, err := svc.ListPins()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, pin := range pins {
+			expires := "never"
+			if pin.Expires != nil {
+				expires = pin.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%-5s %-20s %s  %-20s %s\n", pin.Kind, pin.Target, pin.Checksum[:12], expires, pin.Reason)
+		}
+
+	case "commit":
+		if len(os.Args) != 4 {
+			log.Fatal("Usage: imgstore commit <image>[@snapshot] <new-name>")
+		}
+		image, snapshot, _ := strings.Cut(os.Args[2], "@")
+		checksum, err := svc.CommitSnapshot(image, snapshot, os.Args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Committed %s as %s (layer %s)", os.Args[2], os.Args[3], checksum[:12])
+
+	case "export":
+		flags := flag.NewFlagSet("export", flag.ExitOnError)
+		output := flags.String("o", "", "Write to file instead of stdout")
+		compression := flags.String("compress", "", "Compression: gzip or zstd")
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore export <name>[@snapshot] [-o file] [-compress gzip|zstd]")
+		}
+		flags.Parse(os.Args[3:])
+		image, snapshot, _ := strings.Cut(os.Args[2], "@")
+
+		var out io.Writer = os.Stdout
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			out = file
+		}
+		if err := svc.Export(out, image, snapshot, *compression); err != nil {
+			log.Fatal(err)
+		}
+
+	case "cleanup":
+		flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "Report what would be removed")
+		grace := flags.Duration("grace", 0, "Keep temp files younger than this")
+		flags.Parse(os.Args[2:])
+		report, err := svc.GC(*dryRun, *grace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, path := range report.Removed {
+			fmt.Println(path)
+		}
+		verb := "Removed"
+		if report.DryRun {
+			verb = "Would remove"
+		}
+		log.Printf("%s %d files (%d bytes); %d blobs live", verb, len(report.Removed), report.Bytes, report.Live)
+		if report.Objects > 0 {
+			log.Printf("%s %d file objects (%d bytes)", verb, report.Objects, report.ObjectBytes)
+		}
+		if report.Exports > 0 {
+			log.Printf("%s %d cached exports (%d bytes)", verb, report.Exports, report.ExportBytes)
+		}
+
+	case "backup":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore backup <backup.db>")
+		}
+		if err := meta.Backup(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Backed up the catalog to %s", os.Args[2])
+
+	case "restore":
+		log.Printf("Restored the catalog from %s; run imgstore fsck to check it against the store", os.Args[2])
+
+	case "fsck":
+		flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "Repair the problems found")
+		flags.Parse(os.Args[2:])
+		report, err := svc.Fsck(*repair)
+		for _, p := range report.Problems {
+			repaired := ""
+			if p.Repaired {
+				repaired = " (repaired)"
+			}
+			fmt.Printf("%-16s %s: %s%s\n", p.Kind, p.Target, p.Detail, repaired)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d problems, %d repaired", len(report.Problems), report.Repaired)
+		if report.Repaired < len(report.Problems) {
+			return 1
+		}
+
+	case "dedup":
+		stats, err := svc.DedupStats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		mode := stats.Mode
+		if mode == "" {
+			mode = "off"
+		}
+		fmt.Printf("Mode:    %s\n", mode)
+		fmt.Printf("Objects: %d (%d bytes)\n", stats.Objects, stats.Bytes)
+		fmt.Printf("Saved:   %d bytes\n", stats.Saved)
+
+	case "cache":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: imgstore cache <verify [-rate 32M] | stats>")
+		}
+		switch os.Args[2] {
+		case "verify":
+			flags := flag.NewFlagSet("cache verify", flag.ExitOnError)
+			rate := flags.String("rate", "", "Read at most this many bytes per second")
+			flags.Parse(os.Args[3:])
+			var limit int64
+			if *rate != "" {
+				if limit, err = config.ParseSize(*rate); err != nil {
+					log.Fatal(err)
+				}
+			}
+			report, err := svc.VerifyCache(ctx, limit)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Verified %d blobs (%d bytes), %d quarantined, %d unrecoverable", report.Checked, report.Bytes,
+				len(report.Quarantined), len(report.Unrecoverable))
+
+		case "stats":
+			stats, err := svc.CacheStats()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Hits:        %d (%d bytes), hit ratio %.1f%%\n", stats.Hits, stats.CachedBytes, stats.HitRatio*100)
+			fmt.Printf("Misses:      %d (%d bytes downloaded)\n", stats.Misses, stats.DownloadedBytes)
+			fmt.Printf("Evictions:   %d (%d bytes)\n", stats.Evictions, stats.EvictedBytes)
+			fmt.Printf("Quarantined: %d\n", stats.Quarantined)
+			if stats.Budget > 0 {
+				fmt.Printf("Size:        %d of %d bytes in %d blobs\n", stats.Size, stats.Budget, len(stats.Blobs))
+			} else {
+				fmt.Printf("Size:        %d bytes in %d blobs\n", stats.Size, len(stats.Blobs))
+			}
+			fmt.Println()
+			for _, blob := range stats.Blobs {
+				pinned := ""
+				if blob.Pinned {
+					pinned = "pinned"
+				}
+				fmt.Printf("%s %12d %4d  %s  %s\n", blob.Digest, blob.Size, blob.Refs, blob.LastUsed.Format(time.RFC3339), pinned)
+			}
+
+		default:
+			log.Fatal("Usage: imgstore cache <verify [-rate 32M] | stats>")
+		}
+
+	case "bundle":
+		if len(os.Args) < 4 {
+			log.Fatal("Usage: imgstore bundle <keygen <prefix> | create <name...> -o bundle.tar [-key file] | load <bundle.tar> [-pubkey file]>")
+		}
+		switch os.Args[2] {
+		case "keygen":
+			if err := bundle.GenerateKey(os.Args[3]); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Wrote %s.key and %s.pub", os.Args[3], os.Args[3])
+
+		case "create":
+			flags := flag.NewFlagSet("bundle create", flag.ExitOnError)
+			output := flags.String("o", "", "Bundle file to write")
+			keyPath := flags.String("key", cfg.BundleKey, "Private key to sign with")
+			names := os.Args[3:]
+			for i, arg := range names {
+				if strings.HasPrefix(arg, "-") {
+					flags.Parse(names[i:])
+					names = names[:i]
+					break
+				}
+			}
+			if len(names) == 0 || *output == "" {
+				log.Fatal("Usage: imgstore bundle create <name...> -o bundle.tar [-key file]")
+			}
+			if *keyPath == "" {
+				log.Fatal("No signing key: pass -key or set bundle_key")
+			}
+			key, err := bundle.LoadPrivateKey(*keyPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			file, err := os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = svc.CreateBundle(file, names, key)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(*output)
+				log.Fatal(err)
+			}
+			log.Printf("Wrote %s", *output)
+
+		case "load":
+			flags := flag.NewFlagSet("bundle load", flag.ExitOnError)
+			pubkey := flags.String("pubkey", "", "Public key to trust besides trusted_keys")
+			flags.Parse(os.Args[4:])
+			paths := cfg.TrustedKeys
+			if *pubkey != "" {
+				paths = append(paths, *pubkey)
+			}
+			if len(paths) == 0 {
+				log.Fatal("No trusted keys: pass -pubkey or set trusted_keys")
+			}
+			var trusted []ed25519.PublicKey
+			for _, path := range paths {
+				key, err := bundle.LoadPublicKey(path)
+				if err != nil {
+					log.Fatal(err)
+				}
+				trusted = append(trusted, key)
+			}
+			file, err := os.Open(os.Args[3])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			names, err := svc.LoadBundle(file, trusted)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, name := range names {
+				log.Printf("Registered image %s", name)
+			}
+			log.Printf("Loaded %s: %d new images", os.Args[3], len(names))
+
+		default:
+			log.Fatal("Usage: imgstore bundle <keygen|create|load> ...")
+		}
+
 	case "worker":
 		log.Println("Starting worker...")
+		if err := svc.Reconcile(); err != nil {
+			log.Printf("Mount reconciliation failed: %v", err)
+		}
+		ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
 		svc.RunWorker(ctx)
+		log.Println("Worker stopped")
+		if err := svc.Shutdown(); err != nil {
+			log.Printf("Unmount error: %v", err)
+		}
 		
 	default:
 		log.Fatal("Unknown command:", os.Args[1])
 	}
+	return 0
 }
 
-func initSchema(db *sql.DB) error {
-	schema, err := ioutil.ReadFile(filepath.Join("migrations", "001_init.sql"))
-	if err != nil {
-		return err
+func initSchema(meta metadata.Store) error {
+	return meta.Migrate("migrations")
+}
+
+func configPath() string {
+	if path := os.Getenv("IMGSTORE_CONFIG"); path != "" {
+		return path
 	}
-	_, err = db.Exec(string(schema))
-	return err
+	return "./imgstore.json"
 }
\ No newline at end of file
@@ -0,0 +1,68 @@
+-- The schema of migrations/sqlite up to 011_pins in one step. image_id has
+-- no foreign key: SQLite does not enforce them, and blob records of deleted
+-- images are pruned instead.
+CREATE TABLE images (
+  id SERIAL PRIMARY KEY,
+  name TEXT UNIQUE,
+  blob_key TEXT,
+  checksum TEXT,
+  state TEXT,
+  created_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP,
+  policy TEXT DEFAULT '',
+  parent TEXT DEFAULT '',
+  deactivated INTEGER DEFAULT 0,
+  blob_size BIGINT DEFAULT 0,
+  rootfs_size BIGINT DEFAULT 0,
+  upper_size BIGINT DEFAULT 0,
+  layer TEXT DEFAULT '',
+  blob_quarantined INTEGER DEFAULT 0
+);
+CREATE INDEX images_layer ON images(layer);
+
+CREATE TABLE blobs (
+  id SERIAL PRIMARY KEY,
+  image_id INTEGER,
+  path TEXT,
+  size BIGINT,
+  checksum TEXT,
+  created_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP,
+  last_used BIGINT DEFAULT 0
+);
+CREATE INDEX blobs_checksum ON blobs(checksum);
+
+CREATE TABLE snapshots (
+  id SERIAL PRIMARY KEY,
+  image_id INTEGER,
+  snapshot_name TEXT,
+  active INTEGER DEFAULT 0,
+  created_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP,
+  upper_size BIGINT DEFAULT 0,
+  quota BIGINT DEFAULT 0,
+  quota_mode TEXT DEFAULT ''
+);
+CREATE UNIQUE INDEX snapshots_image_name ON snapshots(image_id, snapshot_name);
+
+CREATE TABLE layers (
+  id TEXT PRIMARY KEY,
+  checksum TEXT NOT NULL,
+  parent TEXT DEFAULT '',
+  size BIGINT DEFAULT 0,
+  created_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE cache_stats (
+  name TEXT PRIMARY KEY,
+  value BIGINT DEFAULT 0
+);
+
+CREATE TABLE pins (
+  id SERIAL PRIMARY KEY,
+  kind TEXT NOT NULL,
+  target TEXT NOT NULL,
+  checksum TEXT NOT NULL,
+  reason TEXT DEFAULT '',
+  expires_at BIGINT DEFAULT 0,
+  created_at TIMESTAMPTZ(0) DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(kind, target)
+);
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS snapshots_image_name ON snapshots(image_id, snapshot_name);
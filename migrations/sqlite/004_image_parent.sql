@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN parent TEXT DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN deactivated INTEGER DEFAULT 0;
@@ -0,0 +1,6 @@
+ALTER TABLE images ADD COLUMN blob_size INTEGER DEFAULT 0;
+ALTER TABLE images ADD COLUMN rootfs_size INTEGER DEFAULT 0;
+ALTER TABLE images ADD COLUMN upper_size INTEGER DEFAULT 0;
+ALTER TABLE snapshots ADD COLUMN upper_size INTEGER DEFAULT 0;
+ALTER TABLE snapshots ADD COLUMN quota INTEGER DEFAULT 0;
+ALTER TABLE snapshots ADD COLUMN quota_mode TEXT DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS layers (
+  id TEXT PRIMARY KEY,
+  checksum TEXT NOT NULL,
+  parent TEXT DEFAULT '',
+  size INTEGER DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+ALTER TABLE images ADD COLUMN layer TEXT DEFAULT '';
+CREATE INDEX IF NOT EXISTS images_layer ON images(layer);
@@ -0,0 +1,2 @@
+ALTER TABLE blobs ADD COLUMN last_used INTEGER DEFAULT 0;
+CREATE INDEX IF NOT EXISTS blobs_checksum ON blobs(checksum);
@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN blob_quarantined INTEGER DEFAULT 0;
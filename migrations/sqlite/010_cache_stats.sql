@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS cache_stats (
+  name TEXT PRIMARY KEY,
+  value INTEGER DEFAULT 0
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS pins (
+  id INTEGER PRIMARY KEY,
+  kind TEXT NOT NULL,
+  target TEXT NOT NULL,
+  checksum TEXT NOT NULL,
+  reason TEXT DEFAULT '',
+  expires_at INTEGER DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE(kind, target)
+);
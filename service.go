@@ -1,209 +0,0 @@
-package main
-
-import (
-	"context"
-	"crypto/sha256"
-	"database/sql"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"time"
-
-	"imgstore/internal/cache"
-	"imgstore/internal/downloader"
-	"imgstore/internal/extractor"
-	"imgstore/internal/fsm"
-	"imgstore/internal/storage"
-)
-
-type Service struct {
-	db         *sql.DB
-	storage    *storage.OverlayStorage
-	downloader *downloader.Downloader
-	cache      *cache.BlobCache
-	extractor  *extractor.Extractor
-}
-
-func NewService(db *sql.DB, root string) *Service {
-	return &Service{
-		db:         db,
-		storage:    storage.NewOverlayStorage(root),
-		downloader: downloader.New(),
-		cache:      cache.NewBlobCache(db, root),
-		extractor:  extractor.New(),
-	}
-}
-
-func (s *Service) Init() error {
-	return s.storage.Init()
-}
-
-func (s *Service) EnqueueImage(ctx context.Context, name, blobURL, checksum string) error {
-	_, err := s.db.Exec("INSERT OR IGNORE INTO images(name, blob_key, checksum, state) VALUES (?,?,?,?)",
-		name, blobURL, checksum, string(fsm.StateNew))
-	return err
-}
-
-func (s *Service) RunWorker(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			s.processNextImage(ctx)
-			time.Sleep(2 * time.Second)
-		}
-	}
-}
-
-func (s *Service) processNextImage(ctx context.Context) {
-	rows, err := s.db.Query("SELECT id, name, blob_key, checksum, state FROM images WHERE state NOT IN ('ACTIVE', 'FAILED') LIMIT 1")
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var id int
-		var name, blobKey, checksum, state string
-		if err := rows.Scan(&id, &name, &blobKey, &checksum, &state); err != nil {
-			continue
-		}
-
-		currentState := fsm.State(state)
-		nextState := fsm.NextState(currentState)
-		
-		if !fsm.CanTransition(currentState, nextState) {
-			continue
-		}
-
-		if err := s.executeTransition(ctx, id, name, blobKey, checksum, currentState, nextState); err != nil {
-			s.setState(id, fsm.StateFailed)
-		} else {
-			s.setState(id, nextState)
-		}
-	}
-}
-
-func (s *Service) executeTransition(ctx context.Context, id int, name, blobKey, checksum string, from, to fsm.State) error {
-	switch to {
-	case fsm.StateDownloading:
-		return nil // Just mark as downloading
-	case fsm.StateDownloaded:
-		if err := s.downloadBlob(ctx, blobKey, checksum); err != nil {
-			return err
-		}
-		return s.cache.MarkUsed(checksum, id)
-	case fsm.StateUnpacking:
-		return nil // Just mark as unpacking
-	case fsm.StateUnpacked:
-		return s.unpackBlob(checksum, name)
-	case fsm.StateStored:
-		return nil // For overlay, no additional storage step needed
-	case fsm.StateActivating:
-		return nil // Just mark as activating
-	case fsm.StateActive:
-		return s.storage.CreateSnapshot(name)
-	}
-	return nil
-}
-
-func (s *Service) downloadBlob(ctx context.Context, blobURL, expectedChecksum string) error {
-	blobPath := s.cache.GetPath(expectedChecksum)
-	
-	// Check cache first
-	if s.cache.Exists(expectedChecksum) {
-		log.Printf("Blob %s already cached", expectedChecksum[:12])
-		return nil
-	}
-
-	// Download with progress
-	log.Printf("Downloading blob %s...", expectedChecksum[:12])
-	progress := func(downloaded, total int64) {
-		if total > 0 {
-			percent := float64(downloaded) / float64(total) * 100
-			log.Printf("Progress: %.1f%% (%d/%d bytes)", percent, downloaded, total)
-		}
-	}
-
-	return s.downloader.Download(ctx, blobURL, blobPath, expectedChecksum, progress)
-}
-
-func (s *Service) verifyChecksum(path, expected string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return err
-	}
-
-	actual := fmt.Sprintf("%x", hash.Sum(nil))
-	if actual != expected {
-		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
-	}
-	return nil
-}
-
-func (s *Service) unpackBlob(checksum, imageName string) error {
-	blobPath := s.cache.GetPath(checksum)
-	imagePath := s.storage.GetImagePath(imageName)
-
-	if err := os.MkdirAll(imagePath, 0755); err != nil {
-		return err
-	}
-
-	log.Printf("Extracting blob %s to %s", checksum[:12], imageName)
-	return s.extractor.Extract(blobPath, imagePath)
-}
-
-func (s *Service) setState(id int, state fsm.State) {
-	s.db.Exec("UPDATE images SET state=?, updated_at=datetime('now') WHERE id=?", string(state), id)
-}
-
-func (s *Service) GetImageStatus(name string) (string, error) {
-	var state string
-	err := s.db.QueryRow("SELECT state FROM images WHERE name=?", name).Scan(&state)
-	return state, err
-}
-
-func (s *Service) GetAllImages() ([]ImageInfo, error) {
-	rows, err := s.db.Query("SELECT id, name, blob_key, checksum, state, created_at, updated_at FROM images")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var images []ImageInfo
-	for rows.Next() {
-		var img ImageInfo
-		if err := rows.Scan(&img.ID, &img.Name, &img.BlobKey, &img.Checksum, &img.State, &img.Created, &img.Updated); err != nil {
-			continue
-		}
-		images = append(images, img)
-	}
-	return images, nil
-}
-
-func (s *Service) RemoveImage(name string) error {
-	_, err := s.db.Exec("DELETE FROM images WHERE name=?", name)
-	return err
-}
-
-func (s *Service) Cleanup() error {
-	return s.cache.Cleanup()
-}
-
-type ImageInfo struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	BlobKey  string `json:"blob_key"`
-	Checksum string `json:"checksum"`
-	State    string `json:"state"`
-	Created  string `json:"created_at"`
-	Updated  string `json:"updated_at"`
-}
\ No newline at end of file